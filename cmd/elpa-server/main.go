@@ -0,0 +1,198 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// elpa-server serves the archive from a plain net/http server, storing
+// packages on local disk instead of in App Engine.  Run it from the
+// top of the repository, or point it at the templates and static
+// directories:
+//
+//	elpa-server -listen :8080 -data /var/lib/elpa \
+//	    -templates templates -static static
+//
+// Users log in with one of -htpasswd (HTTP basic authentication),
+// -passwords (a login form) or the -oidc flags.  Without any of them
+// the archive is read-only.  Browsers only send the login cookies over
+// HTTPS, or to localhost, so put the server behind an HTTPS proxy.
+//
+// With -signing-key, archive-contents and package files are signed, and
+// the public key is served at /signing-key.asc.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	elpa "github.com/ahyatt/elpa-on-appengine/src"
+)
+
+var (
+	listen    = flag.String("listen", ":8080", "Address to listen on.")
+	dataDir   = flag.String("data", "elpa-data", "Directory to store packages in.")
+	templates = flag.String("templates", "templates", "Directory containing the HTML templates.")
+	static    = flag.String("static", "static", "Directory containing the static files.")
+	maxUpload = flag.Int64("max-upload-size", 32<<20, "Largest upload to accept, in bytes.")
+	maxUnpack = flag.Int64("max-unpacked-size", 128<<20, "Largest a compressed upload may be once decompressed, in bytes.")
+
+	htpasswd   = flag.String("htpasswd", "", "Log users in with HTTP basic authentication, checked against this htpasswd file.")
+	passwords  = flag.String("passwords", "", "Log users in with a form, checked against this htpasswd file.")
+	sessionKey = flag.String("session-key", "", "File containing the key that signs login cookies. If empty, a new key is made each time the server starts.")
+	admins     = flag.String("admins", "", "Comma-separated users who can upload to any package.")
+
+	oidcIssuer       = flag.String("oidc-issuer", "", "Log users in with this OpenID Connect provider.")
+	oidcAuthURL      = flag.String("oidc-auth-url", "", "The OpenID Connect provider's authorization endpoint.")
+	oidcTokenURL     = flag.String("oidc-token-url", "", "The OpenID Connect provider's token endpoint.")
+	oidcJWKSURL      = flag.String("oidc-jwks-url", "", "The OpenID Connect provider's JSON Web Key Set, which RS256 ID tokens are checked against. Without it, ID tokens must be signed with HS256 and the client secret.")
+	oidcClientID     = flag.String("oidc-client-id", "", "The archive's OpenID Connect client ID.")
+	oidcClientSecret = flag.String("oidc-client-secret", "", "The archive's OpenID Connect client secret.")
+	oidcRedirectURL  = flag.String("oidc-redirect-url", "", "The URL of /login/callback on this server, as registered with the provider.")
+
+	signingKey        = flag.String("signing-key", "", "File containing the OpenPGP private key to sign the archive with.")
+	signingPassphrase = flag.String("signing-passphrase", "", "File containing the passphrase of -signing-key, if it is encrypted.")
+
+	builtins           = flag.String("builtins", "", "JSON file listing Emacs releases and the packages that come with them, to check dependencies against.")
+	strictDependencies = flag.Bool("strict-dependencies", false, "Reject uploads that require packages that can't be installed, instead of warning.")
+)
+
+// loadSessionKey reads the session key, or makes one up if there is no
+// key file.
+func loadSessionKey() []byte {
+	if *sessionKey != "" {
+		key, err := ioutil.ReadFile(*sessionKey)
+		if err != nil {
+			log.Fatalf("Could not read session key: %v", err)
+		}
+		return key
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+func authenticator() elpa.Authenticator {
+	switch {
+	case *htpasswd != "":
+		p, err := elpa.LoadPasswords(*htpasswd)
+		if err != nil {
+			log.Fatalf("Could not load %v: %v", *htpasswd, err)
+		}
+		return &elpa.BasicAuth{Passwords: p, Realm: "ELPA"}
+	case *passwords != "":
+		p, err := elpa.LoadPasswords(*passwords)
+		if err != nil {
+			log.Fatalf("Could not load %v: %v", *passwords, err)
+		}
+		return &elpa.PasswordAuth{Passwords: p, Sessions: &elpa.Sessions{Key: loadSessionKey()}}
+	case *oidcIssuer != "":
+		return &elpa.OIDCAuth{
+			Issuer:       *oidcIssuer,
+			AuthURL:      *oidcAuthURL,
+			TokenURL:     *oidcTokenURL,
+			JWKSURL:      *oidcJWKSURL,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  *oidcRedirectURL,
+			Sessions:     &elpa.Sessions{Key: loadSessionKey()},
+		}
+	}
+	log.Printf("No way for users to log in was given, so the archive is read-only")
+	return nil
+}
+
+// signer loads the archive's signing key, if there is one.
+func signer() *elpa.Signer {
+	if *signingKey == "" {
+		return nil
+	}
+	f, err := os.Open(*signingKey)
+	if err != nil {
+		log.Fatalf("Could not open signing key: %v", err)
+	}
+	defer f.Close()
+	var passphrase []byte
+	if *signingPassphrase != "" {
+		if passphrase, err = ioutil.ReadFile(*signingPassphrase); err != nil {
+			log.Fatalf("Could not read signing passphrase: %v", err)
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+	}
+	s, err := elpa.NewSigner(f, passphrase)
+	if err != nil {
+		log.Fatalf("Could not load signing key %v: %v", *signingKey, err)
+	}
+	return s
+}
+
+// emacsReleases loads the -builtins file, or returns nil to use the
+// default list.
+func emacsReleases() []elpa.EmacsRelease {
+	if *builtins == "" {
+		return nil
+	}
+	f, err := os.Open(*builtins)
+	if err != nil {
+		log.Fatalf("Could not open builtins: %v", err)
+	}
+	defer f.Close()
+	releases, err := elpa.ReadBuiltins(f)
+	if err != nil {
+		log.Fatalf("Could not read %v: %v", *builtins, err)
+	}
+	return releases
+}
+
+func main() {
+	flag.Parse()
+	store, err := elpa.NewFileStore(*dataDir)
+	if err != nil {
+		log.Fatalf("Could not open data directory %v: %v", *dataDir, err)
+	}
+	t, err := template.ParseGlob(filepath.Join(*templates, "*"))
+	if err != nil {
+		log.Fatalf("Could not load templates from %v: %v", *templates, err)
+	}
+	s := &elpa.Server{
+		Store:              func(r *http.Request) elpa.PackageStore { return store },
+		Templates:          t,
+		MaxUploadSize:      *maxUpload,
+		MaxUnpackedSize:    *maxUnpack,
+		Auth:               authenticator(),
+		Signer:             signer(),
+		Builtins:           emacsReleases(),
+		StrictDependencies: *strictDependencies,
+	}
+	adminUsers := make(map[string]bool)
+	for _, admin := range strings.Split(*admins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			adminUsers[admin] = true
+		}
+	}
+	s.IsAdmin = func(r *http.Request) bool {
+		return s.Auth != nil && adminUsers[s.Auth.User(r)]
+	}
+	mux := http.NewServeMux()
+	s.Register(mux)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(*static))))
+	log.Printf("Serving the archive from %v on %v", *dataDir, *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
@@ -0,0 +1,53 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has maintenance tasks for admins.
+
+package elpa
+
+import (
+	"net/http"
+)
+
+// reindex rebuilds the indexes that are kept up to date on each upload,
+// for archives with packages uploaded before the indexes were kept.
+func (s *Server) reindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Reindexing must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.requireUser(w, r, "/") == "" {
+		return
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "Only admins can reindex the archive", http.StatusForbidden)
+		return
+	}
+	store := s.Store(r)
+	if err := rebuildDependents(store); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := rebuildSearchIndex(store); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := s.updateArchiveContents(r, store); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("Reindexed the archive\n"))
+}
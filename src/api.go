@@ -0,0 +1,329 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has the JSON API, which describes the same packages as
+// archive-contents and the HTML pages, and lets scripts publish
+// packages.
+
+package elpa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PackageJSON is how the JSON API describes a package.
+type PackageJSON struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Description string   `json:"description"`
+	Author      string   `json:"author,omitempty"`
+	Type        string   `json:"type"`
+	Owners      []string `json:"owners"`
+}
+
+func packageJSON(p *Package) PackageJSON {
+	owners := p.Owners
+	if owners == nil {
+		owners = []string{}
+	}
+	return PackageJSON{
+		Name:        p.Name,
+		Version:     p.LatestVersion,
+		Description: p.Description,
+		Author:      p.Author,
+		Type:        getType(p.Type),
+		Owners:      owners,
+	}
+}
+
+// serveJSON writes v as the JSON response to r.
+func (s *Server) serveJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.errorf(r, "Failed to write JSON response to %v: %v", r.URL.Path, err)
+	}
+}
+
+// apiError reports an error from the JSON API as {"error": "..."}.
+func (s *Server) apiError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	s.serveJSON(w, r, status, map[string]string{"error": err.Error()})
+}
+
+// UploadResult is what /api/upload returns.  Dependencies says where
+// each of the packages it requires can be installed from.
+type UploadResult struct {
+	Package      PackageJSON  `json:"package"`
+	Details      *Details     `json:"details"`
+	Dependencies []Resolution `json:"dependencies"`
+}
+
+// apiUpload takes an .el or .tar file as the body of a POST or PUT,
+// authorized by an API token.  The file name can be given in the
+// "filename" query parameter, to help tell what kind of file it is.
+// A signature sent with a compressed tar file must be of the tar file
+// before it was compressed.
+func (s *Server) apiUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Uploads must be a POST or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	store := s.Store(r)
+	defer holdBlobs(store)()
+	token, err := requestToken(store, r)
+	if err == errNoToken || err == errBadToken {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.apiError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	file, err := s.receiveBody(r, store)
+	if err != nil {
+		s.apiError(w, r, uploadStatus(err), err)
+		return
+	}
+	pkg, err := s.storeUpload(r, store, file, token.User, false, token.Packages)
+	if err != nil {
+		s.apiError(w, r, uploadStatus(err), err)
+		return
+	}
+	details, err := decodeDetails(&pkg.Details)
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	resolutions, err := s.resolveDependencies(store, details.Required)
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.serveJSON(w, r, http.StatusCreated, UploadResult{packageJSON(pkg), jsonDetails(details), resolutions})
+}
+
+// The default and largest number of packages in a page of
+// /api/packages.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// PackageList is a page of the package list.  Next is the URL of the
+// next page, if there is one.
+type PackageList struct {
+	Packages []PackageJSON `json:"packages"`
+	Page     int           `json:"page"`
+	PerPage  int           `json:"per_page"`
+	Total    int           `json:"total"`
+	Next     string        `json:"next,omitempty"`
+}
+
+// PackageDetail is everything we know about a package.  Dependents
+// are the packages that require it.
+type PackageDetail struct {
+	Package    PackageJSON   `json:"package"`
+	Details    *Details      `json:"details"`
+	Versions   []VersionInfo `json:"versions"`
+	Dependents []PackageRef  `json:"dependents"`
+}
+
+// VersionDetail describes one version of a package.
+type VersionDetail struct {
+	Name string `json:"name"`
+	VersionInfo
+	Details *Details `json:"details"`
+}
+
+// intParam returns the value of the integer form value name, or def if
+// it is missing.
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 1 {
+		return 0, errors.New(fmt.Sprintf("%v must be a positive integer", name))
+	}
+	return i, nil
+}
+
+// apiPackageList serves /api/packages, a page of the packages sorted
+// by name.  The page and per_page query parameters choose which page.
+func (s *Server) apiPackageList(w http.ResponseWriter, r *http.Request) {
+	page, err := intParam(r, "page", 1)
+	if err != nil {
+		s.apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	perPage, err := intParam(r, "per_page", defaultPageSize)
+	if err != nil {
+		s.apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+	packages, err := s.Store(r).ListPackages()
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	list := PackageList{
+		Packages: make([]PackageJSON, 0, perPage),
+		Page:     page,
+		PerPage:  perPage,
+		Total:    len(packages),
+	}
+	// Pages past the end are empty.  They are checked for before
+	// working out where the page starts, which could overflow.
+	if pages := (len(packages) + perPage - 1) / perPage; page-1 < pages {
+		start := (page - 1) * perPage
+		for i := start; i < len(packages) && i < start+perPage; i++ {
+			list.Packages = append(list.Packages, packageJSON(packages[i]))
+		}
+		if start+perPage < len(packages) {
+			list.Next = fmt.Sprintf("/api/packages?page=%d&per_page=%d", page+1, perPage)
+		}
+	}
+	s.serveJSON(w, r, http.StatusOK, list)
+}
+
+// apiPackages serves a package at /api/packages/<name>, its versions
+// at /api/packages/<name>/versions, the packages that require it at
+// /api/packages/<name>/dependents, its downloads at
+// /api/packages/<name>/downloads, and one version at
+// /api/packages/<name>/<version>.
+func (s *Server) apiPackages(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/packages/"), "/")
+	if len(parts) > 2 {
+		s.apiError(w, r, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	p, err := store.GetPackage(parts[0])
+	if err == ErrNotFound {
+		s.apiError(w, r, http.StatusNotFound, errors.New("No package named "+parts[0]))
+		return
+	}
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "downloads" {
+		days, err := daysParam(r)
+		if err != nil {
+			s.apiError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		stats, err := getDownloadStats(store, p.Name, days)
+		if err != nil {
+			s.apiError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.serveJSON(w, r, http.StatusOK, stats)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "dependents" {
+		dependents, err := getDependents(store, p.Name)
+		if err != nil {
+			s.apiError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.serveJSON(w, r, http.StatusOK, dependents)
+		return
+	}
+	if len(parts) == 2 && parts[1] != "versions" {
+		s.apiVersion(w, r, store, p, parts[1])
+		return
+	}
+	versions, err := getVersions(store, p.Name)
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(parts) == 2 {
+		s.serveJSON(w, r, http.StatusOK, versionInfos(p, versions))
+		return
+	}
+	details, err := decodeDetails(&p.Details)
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	dependents, err := getDependents(store, p.Name)
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.serveJSON(w, r, http.StatusOK, PackageDetail{
+		Package:    packageJSON(p),
+		Details:    jsonDetails(details),
+		Versions:   versionInfos(p, versions),
+		Dependents: dependents,
+	})
+}
+
+// apiVersion serves /api/packages/<name>/<version>.
+func (s *Server) apiVersion(w http.ResponseWriter, r *http.Request, store PackageStore, p *Package, v string) {
+	version, err := ParseVersion(v)
+	if err != nil {
+		s.apiError(w, r, http.StatusNotFound, err)
+		return
+	}
+	contents, err := store.GetVersion(p.Name, version)
+	if err == ErrNotFound {
+		s.apiError(w, r, http.StatusNotFound,
+			errors.New(fmt.Sprintf("%v has no version %v", p.Name, v)))
+		return
+	}
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	detailBytes := contents.Details
+	if detailBytes == nil && contents.Version == p.LatestVersion {
+		// Versions uploaded before we kept details for each version.
+		detailBytes = p.Details
+	}
+	details := &Details{}
+	if detailBytes != nil {
+		if details, err = decodeDetails(&detailBytes); err != nil {
+			s.apiError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	s.serveJSON(w, r, http.StatusOK, VersionDetail{
+		Name:        p.Name,
+		VersionInfo: versionInfos(p, []*Contents{contents})[0],
+		Details:     jsonDetails(details),
+	})
+}
+
+// jsonDetails makes sure empty lists are written as [] rather than
+// null.
+func jsonDetails(details *Details) *Details {
+	if details.Required == nil {
+		details.Required = make([]PackageRef, 0)
+	}
+	return details
+}
@@ -0,0 +1,172 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file builds the archive-contents file that package.el reads.
+// It has no appengine dependencies, so that it can be tested.
+
+package elpa
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// archiveContentsVersion is the format version package.el checks at
+// the head of archive-contents.  Entries with the extras alist are
+// still version 1.
+const archiveContentsVersion = 1
+
+// archiveContents builds the archive-contents form for packages.
+// Packages that can't be represented are skipped, and the reasons are
+// returned so the caller can log them.
+func archiveContents(packages []*Package) (Sexp, []error) {
+	elems := []Sexp{Integer(archiveContentsVersion)}
+	var errs []error
+	for _, pkg := range packages {
+		entry, err := archiveEntry(pkg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Skipping %v in archive-contents: %v", pkg.Name, err))
+			continue
+		}
+		elems = append(elems, entry)
+	}
+	return sexpList(elems...), errs
+}
+
+// writeArchiveContents prints the form built by archiveContents, with
+// one package per line so the file is readable.
+func writeArchiveContents(w io.Writer, contents Sexp) error {
+	list, ok := contents.(*List)
+	if !ok {
+		return printSexp(w, contents)
+	}
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('(')
+	for i, elem := range list.Elems {
+		if i > 0 {
+			bw.WriteByte('\n')
+		}
+		writeSexp(bw, elem)
+	}
+	bw.WriteString(")\n")
+	return bw.Flush()
+}
+
+// archiveEntry builds the entry for a single package, which is of the
+// form (name . [version requirements description kind extras]).
+func archiveEntry(pkg *Package) (Sexp, error) {
+	details, err := decodeDetails(&pkg.Details)
+	if err != nil {
+		return nil, err
+	}
+	version, err := versionSexp(pkg.LatestVersion)
+	if err != nil {
+		return nil, err
+	}
+	required, err := requiredSexp(details.Required)
+	if err != nil {
+		return nil, err
+	}
+	return sexpCons(Symbol(pkg.Name), Vector{
+		version,
+		required,
+		String(pkg.Description),
+		Symbol(getType(pkg.Type)),
+		extrasSexp(details),
+	}), nil
+}
+
+// versionSexp converts a version string such as "1.2.3" into the list
+// (1 2 3) that package.el expects.
+func versionSexp(version string) (Sexp, error) {
+	v, err := ParseVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	return v.Sexp(), nil
+}
+
+func requiredSexp(required []PackageRef) (Sexp, error) {
+	elems := make([]Sexp, 0, len(required))
+	for _, require := range required {
+		version, err := versionSexp(require.Version)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, sexpList(Symbol(require.Name), version))
+	}
+	return sexpList(elems...), nil
+}
+
+func personSexp(p *Person) Sexp {
+	if len(p.Email) == 0 {
+		return sexpCons(String(p.Name), nilSymbol)
+	}
+	return sexpCons(String(p.Name), String(p.Email))
+}
+
+// extrasSexp returns the alist that makes up the fifth element of each
+// archive-contents entry, which package.el reads the homepage,
+// keywords, authors, maintainer and commit from.
+func extrasSexp(details *Details) Sexp {
+	extras := make([]Sexp, 0)
+	if len(details.URL) > 0 {
+		extras = append(extras, sexpCons(Symbol(":url"), String(details.URL)))
+	}
+	if len(details.Keywords) > 0 {
+		keywords := []Sexp{Symbol(":keywords")}
+		for _, keyword := range details.Keywords {
+			keywords = append(keywords, String(keyword))
+		}
+		extras = append(extras, sexpList(keywords...))
+	}
+	if len(details.Authors) > 0 {
+		authors := []Sexp{Symbol(":authors")}
+		for i := range details.Authors {
+			authors = append(authors, personSexp(&details.Authors[i]))
+		}
+		extras = append(extras, sexpList(authors...))
+	}
+	if details.Maintainer != nil {
+		extras = append(extras, sexpCons(Symbol(":maintainer"), personSexp(details.Maintainer)))
+	}
+	if len(details.Commit) > 0 {
+		extras = append(extras, sexpCons(Symbol(":commit"), String(details.Commit)))
+	}
+	return sexpList(extras...)
+}
+
+// packageFileName returns the name package.el downloads a version of
+// a package from, relative to the archive.  package.el uses the
+// normalized version in file names, so we do too.
+func packageFileName(name string, version string, t PackageType) string {
+	if normalized, err := normalizeVersion(version); err == nil {
+		version = normalized
+	}
+	if t == TAR {
+		return name + "-" + version + ".tar"
+	}
+	return name + "-" + version + ".el"
+}
+
+func getType(t PackageType) string {
+	switch t {
+	case TAR:
+		return "tar"
+	case SINGLE:
+		return "single"
+	}
+	return "unknown"
+}
@@ -0,0 +1,289 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has the ways users can log in to the archive outside of
+// App Engine: HTTP basic authentication or a login form checked
+// against a password file, or OpenID Connect (in oidc.go).
+
+package elpa
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An Authenticator works out who is making a request.  User names are
+// whatever the Authenticator uses to identify people, such as a login
+// name or an email address, and are what package owners are listed as.
+type Authenticator interface {
+	// User returns the user making r, or "" if they have not logged
+	// in.
+	User(r *http.Request) string
+	// Login asks the user to log in, and then to go back to returnTo.
+	Login(w http.ResponseWriter, r *http.Request, returnTo string)
+}
+
+// loginHandler is implemented by Authenticators that serve their own
+// pages, such as a login form or a callback from an identity provider.
+type loginHandler interface {
+	register(s *Server, mux *http.ServeMux)
+}
+
+// localPath returns path if it is on this site, and "/" otherwise, so
+// that we can't be used to redirect users to other sites after they
+// log in.
+func localPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") ||
+		strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// Passwords maps user names to password hashes, as written by
+// "htpasswd -B" (bcrypt) or "htpasswd -s" (SHA-1).
+type Passwords map[string]string
+
+// ReadPasswords reads a file in htpasswd format: one "user:hash" line
+// per user.  Blank lines and lines starting with # are ignored.
+func ReadPasswords(r io.Reader) (Passwords, error) {
+	passwords := make(Passwords)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, errors.New(fmt.Sprintf("Line %d: expected user:hash", line))
+		}
+		user, hash := text[:i], text[i+1:]
+		if !strings.HasPrefix(hash, "$2a$") && !strings.HasPrefix(hash, "$2b$") &&
+			!strings.HasPrefix(hash, "$2y$") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, errors.New(fmt.Sprintf(
+				"Line %d: unsupported password hash for %v; use htpasswd -B", line, user))
+		}
+		passwords[user] = hash
+	}
+	return passwords, scanner.Err()
+}
+
+// LoadPasswords reads a password file from disk.
+func LoadPasswords(path string) (Passwords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPasswords(f)
+}
+
+// Check returns true if password is the password of user.
+func (p Passwords) Check(user, password string) bool {
+	hash, ok := p[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// BasicAuth logs users in with HTTP basic authentication.
+type BasicAuth struct {
+	Passwords Passwords
+	// Realm is shown to users when their browser asks for a password.
+	Realm string
+}
+
+func (a *BasicAuth) User(r *http.Request) string {
+	user, password, ok := r.BasicAuth()
+	if !ok || !a.Passwords.Check(user, password) {
+		return ""
+	}
+	return user
+}
+
+func (a *BasicAuth) Login(w http.ResponseWriter, r *http.Request, returnTo string) {
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(a.Realm))
+	http.Error(w, "Please log in", http.StatusUnauthorized)
+}
+
+// sessionCookie is the name of the cookie that remembers who is logged
+// in.
+const sessionCookie = "elpa-session"
+
+// sessionLength is how long users stay logged in.
+const sessionLength = 30 * 24 * time.Hour
+
+// Sessions remembers logged in users with a signed cookie, so that no
+// session state has to be stored on the server.  The cookie is only
+// sent over HTTPS, or to localhost, and not with requests from other
+// sites' pages.
+type Sessions struct {
+	// Key signs the cookies.  It must be kept secret, and should be
+	// at least 32 random bytes.
+	Key []byte
+}
+
+func (s *Sessions) sign(value string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Set logs user in on w.
+func (s *Sessions) Set(w http.ResponseWriter, user string) {
+	value := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." +
+		strconv.FormatInt(time.Now().Add(sessionLength).Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value + "." + s.sign(value),
+		Path:     "/",
+		MaxAge:   int(sessionLength / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Clear logs out whoever is logged in on w.
+func (s *Sessions) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+}
+
+// User returns the user logged in on r, or "" if there isn't a valid
+// session.
+func (s *Sessions) User(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	i := strings.LastIndex(cookie.Value, ".")
+	if i < 0 || !hmac.Equal([]byte(cookie.Value[i+1:]), []byte(s.sign(cookie.Value[:i]))) {
+		return ""
+	}
+	parts := strings.Split(cookie.Value[:i], ".")
+	if len(parts) != 2 {
+		return ""
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ""
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ""
+	}
+	return string(user)
+}
+
+// PasswordAuth logs users in with a form, checked against a password
+// file.  Scripts can use HTTP basic authentication instead.
+type PasswordAuth struct {
+	Passwords Passwords
+	Sessions  *Sessions
+}
+
+func (a *PasswordAuth) User(r *http.Request) string {
+	if user, password, ok := r.BasicAuth(); ok {
+		if a.Passwords.Check(user, password) {
+			return user
+		}
+		return ""
+	}
+	return a.Sessions.User(r)
+}
+
+func (a *PasswordAuth) Login(w http.ResponseWriter, r *http.Request, returnTo string) {
+	http.Redirect(w, r, "/login?return="+url.QueryEscape(returnTo), http.StatusFound)
+}
+
+func (a *PasswordAuth) register(s *Server, mux *http.ServeMux) {
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		returnTo := localPath(r.FormValue("return"))
+		var message string
+		if r.Method == "POST" {
+			// Otherwise another site could log users in as someone
+			// else, and see what they upload.
+			if err := checkCSRF(r, r.PostFormValue(csrfField)); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			user := r.FormValue("user")
+			if a.Passwords.Check(user, r.FormValue("password")) {
+				a.Sessions.Set(w, user)
+				http.Redirect(w, r, returnTo, http.StatusFound)
+				return
+			}
+			message = "Incorrect user name or password"
+		}
+		csrf, err := csrfToken(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if message != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		templateData := struct {
+			Return  string
+			Message string
+			CSRF    string
+		}{returnTo, message, csrf}
+		err = s.Templates.ExecuteTemplate(w, "login", templateData)
+		if err != nil {
+			s.errorf(r, "Failed to show the login page: %v", err)
+		}
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		logout(w, r, a.Sessions)
+	})
+}
+
+// logout ends the session of a user who posted the logout form.  Other
+// sites could log users out with a link, so it must be a POST with the
+// form's CSRF token.
+func logout(w http.ResponseWriter, r *http.Request, sessions *Sessions) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Logging out must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := checkCSRF(r, r.PostFormValue(csrfField)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	sessions.Clear(w)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
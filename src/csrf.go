@@ -0,0 +1,74 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file protects our forms from cross-site request forgery.  When
+// a browser is shown a form it is given a random token in a cookie,
+// and the form posts the token back.  Other sites can neither read nor
+// set our cookies, so they can't make a form that passes the check.
+// This is needed however users log in, since browsers send HTTP basic
+// authentication and session cookies with forms posted from anywhere.
+
+package elpa
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// csrfCookie is the cookie that holds a browser's CSRF token, and
+// csrfField the form field that posts it back.
+const (
+	csrfCookie = "elpa-csrf"
+	csrfField  = "csrf"
+)
+
+// csrfToken returns the token to put in the forms of a page served in
+// response to r, giving the browser one if it doesn't have one yet.
+// It must be called before anything is written to w.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	// The cookie lasts until the browser is closed.
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+var errCSRF = errors.New("This form has expired or was posted from another site.  Please reload the page and try again.")
+
+// checkCSRF returns errCSRF unless token, as posted in a form, is the
+// token in r's cookie.
+func checkCSRF(r *http.Request, token string) error {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" ||
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		return errCSRF
+	}
+	return nil
+}
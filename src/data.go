@@ -32,14 +32,31 @@ type Package struct {
 	Author        string      `datastore:author`
 	Details       []byte      `datastore:requires`
 	Type          PackageType `datastore:type`
+	// Owners are the users who may upload new versions.
+	Owners []string
 }
 
 type Details struct {
-	Readme   string
-	Required []PackageRef
+	Readme     string       `json:"readme"`
+	Required   []PackageRef `json:"required"`
+	URL        string       `json:"url,omitempty"`
+	Keywords   []string     `json:"keywords,omitempty"`
+	Authors    []Person     `json:"authors,omitempty"`
+	Maintainer *Person      `json:"maintainer,omitempty"`
+	Commit     string       `json:"commit,omitempty"`
+	// ReadmeFormat is the format of Readme, "org", "markdown" or
+	// "text".  Empty means text.
+	ReadmeFormat string `json:"readme_format,omitempty"`
+}
+
+// Person is an author or maintainer of a package.  Either field may be
+// empty.
+type Person struct {
+	Name  string `json:"name"`
+	Email string `json:"email,omitempty"`
 }
 
 type PackageRef struct {
-	Name    string
-	Version string
+	Name    string `json:"name"`
+	Version string `json:"version"`
 }
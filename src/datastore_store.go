@@ -0,0 +1,459 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build appengine
+// +build appengine
+
+package elpa
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/blobstore"
+	"appengine/datastore"
+)
+
+// datastoreStore is the PackageStore used on App Engine.  Packages and
+// their versions are in the datastore, and files in the blobstore.
+type datastoreStore struct {
+	c appengine.Context
+}
+
+// contentsEntity is how Contents is stored in the datastore.  The
+// field names and tags must not change, or existing entities won't
+// load.
+type contentsEntity struct {
+	BlobKey           appengine.BlobKey `datastore:data`
+	Version           string            `datastore:version`
+	UploadTime        time.Time         `datastore:uploadtime`
+	Type              PackageType
+	Details           []byte
+	Description       string
+	Author            string
+	Signature         []byte
+	UploaderSignature []byte
+	SignedBy          string
+}
+
+func packageKey(c appengine.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, "Package", name, 0, nil)
+}
+
+// versionKey returns the key of a version of a package.  Versions are
+// keyed by their normalized form, which is what package.el asks for.
+// Versions uploaded before we normalized are keyed by the version
+// string as uploaded; GetVersion handles those.
+func versionKey(c appengine.Context, version Version, packageKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, "Contents", version.String(), 0, packageKey)
+}
+
+func fromEntity(e *contentsEntity) *Contents {
+	return &Contents{
+		BlobKey:           string(e.BlobKey),
+		Version:           e.Version,
+		UploadTime:        e.UploadTime,
+		Type:              e.Type,
+		Details:           e.Details,
+		Description:       e.Description,
+		Author:            e.Author,
+		Signature:         e.Signature,
+		UploaderSignature: e.UploaderSignature,
+		SignedBy:          e.SignedBy,
+	}
+}
+
+func notFound(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *datastoreStore) GetPackage(name string) (*Package, error) {
+	var p Package
+	if err := datastore.Get(s.c, packageKey(s.c, name), &p); err != nil {
+		return nil, notFound(err)
+	}
+	return &p, nil
+}
+
+func (s *datastoreStore) PutPackage(pkg *Package) error {
+	_, err := datastore.Put(s.c, packageKey(s.c, pkg.Name), pkg)
+	return err
+}
+
+func (s *datastoreStore) ListPackages() ([]*Package, error) {
+	var packages []*Package
+	_, err := datastore.NewQuery("Package").GetAll(s.c, &packages)
+	return packages, err
+}
+
+func (s *datastoreStore) DeletePackage(name string) error {
+	err := datastore.Delete(s.c, packageKey(s.c, name))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func (s *datastoreStore) GetVersion(name string, version Version) (*Contents, error) {
+	var e contentsEntity
+	err := datastore.Get(s.c, versionKey(s.c, version, packageKey(s.c, name)), &e)
+	if err == nil {
+		return fromEntity(&e), nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	versions, err := s.ListVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if parsed, err := ParseVersion(v.Version); err == nil && parsed.Compare(version) == 0 {
+			return v, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *datastoreStore) PutVersion(name string, version Version, contents *Contents) error {
+	e := contentsEntity{
+		BlobKey:           appengine.BlobKey(contents.BlobKey),
+		Version:           contents.Version,
+		UploadTime:        contents.UploadTime,
+		Type:              contents.Type,
+		Details:           contents.Details,
+		Description:       contents.Description,
+		Author:            contents.Author,
+		Signature:         contents.Signature,
+		UploaderSignature: contents.UploaderSignature,
+		SignedBy:          contents.SignedBy,
+	}
+	_, err := datastore.Put(s.c, versionKey(s.c, version, packageKey(s.c, name)), &e)
+	return err
+}
+
+func (s *datastoreStore) ListVersions(name string) ([]*Contents, error) {
+	var entities []*contentsEntity
+	_, err := datastore.NewQuery("Contents").Ancestor(packageKey(s.c, name)).GetAll(s.c, &entities)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*Contents, 0, len(entities))
+	for _, e := range entities {
+		versions = append(versions, fromEntity(e))
+	}
+	return versions, nil
+}
+
+// DeleteVersion finds the version by its version string, since
+// versions stored before versions were normalized have other keys.
+func (s *datastoreStore) DeleteVersion(name string, version Version) error {
+	var entities []*contentsEntity
+	keys, err := datastore.NewQuery("Contents").Ancestor(packageKey(s.c, name)).GetAll(s.c, &entities)
+	if err != nil {
+		return err
+	}
+	for i, e := range entities {
+		if parsed, err := ParseVersion(e.Version); err == nil && parsed.Compare(version) == 0 {
+			if err := datastore.Delete(s.c, keys[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *datastoreStore) PutBlob(r io.Reader) (string, error) {
+	w, err := blobstore.Create(s.c, "application/octet-stream")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	key, err := w.Key()
+	return string(key), err
+}
+
+func (s *datastoreStore) OpenBlob(key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(blobstore.NewReader(s.c, appengine.BlobKey(key))), nil
+}
+
+// DeleteBlob removes a blob, unless it is the archive-contents
+// snapshot's.
+func (s *datastoreStore) DeleteBlob(key string) error {
+	snapshot, err := s.GetArchiveContents()
+	if err == nil && snapshot.BlobKey == key {
+		return nil
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	return blobstore.Delete(s.c, appengine.BlobKey(key))
+}
+
+func (s *datastoreStore) SendBlob(w http.ResponseWriter, key string) {
+	blobstore.Send(w, appengine.BlobKey(key))
+}
+
+func tokenKey(c appengine.Context, hash string) *datastore.Key {
+	return datastore.NewKey(c, "APIToken", hash, 0, nil)
+}
+
+func (s *datastoreStore) GetToken(hash string) (*APIToken, error) {
+	var token APIToken
+	if err := datastore.Get(s.c, tokenKey(s.c, hash), &token); err != nil {
+		return nil, notFound(err)
+	}
+	return &token, nil
+}
+
+func (s *datastoreStore) PutToken(token *APIToken) error {
+	_, err := datastore.Put(s.c, tokenKey(s.c, token.Hash), token)
+	return err
+}
+
+func (s *datastoreStore) ListTokens(user string) ([]*APIToken, error) {
+	var tokens []*APIToken
+	_, err := datastore.NewQuery("APIToken").Filter("User =", user).GetAll(s.c, &tokens)
+	sort.Sort(byCreated(tokens))
+	return tokens, err
+}
+
+func (s *datastoreStore) DeleteToken(hash string) error {
+	err := datastore.Delete(s.c, tokenKey(s.c, hash))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+func publicKeyKey(c appengine.Context, fingerprint string) *datastore.Key {
+	return datastore.NewKey(c, "PublicKey", fingerprint, 0, nil)
+}
+
+func (s *datastoreStore) GetKey(fingerprint string) (*PublicKey, error) {
+	var key PublicKey
+	if err := datastore.Get(s.c, publicKeyKey(s.c, fingerprint), &key); err != nil {
+		return nil, notFound(err)
+	}
+	return &key, nil
+}
+
+func (s *datastoreStore) PutKey(key *PublicKey) error {
+	_, err := datastore.Put(s.c, publicKeyKey(s.c, key.Fingerprint), key)
+	return err
+}
+
+func (s *datastoreStore) ListKeys(user string) ([]*PublicKey, error) {
+	var keys []*PublicKey
+	_, err := datastore.NewQuery("PublicKey").Filter("User =", user).GetAll(s.c, &keys)
+	sort.Sort(byAdded(keys))
+	return keys, err
+}
+
+func (s *datastoreStore) DeleteKey(fingerprint string) error {
+	err := datastore.Delete(s.c, publicKeyKey(s.c, fingerprint))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// dependentsEntity is the packages that require a package, keyed by
+// the name of the package they require.
+type dependentsEntity struct {
+	Names    []string
+	Versions []string
+}
+
+func dependentsKey(c appengine.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, "Dependents", name, 0, nil)
+}
+
+func (s *datastoreStore) GetDependents(name string) ([]PackageRef, error) {
+	var e dependentsEntity
+	err := datastore.Get(s.c, dependentsKey(s.c, name), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dependents := make([]PackageRef, 0, len(e.Names))
+	for i, dep := range e.Names {
+		dependents = append(dependents, PackageRef{Name: dep, Version: e.Versions[i]})
+	}
+	return dependents, nil
+}
+
+func (s *datastoreStore) PutDependents(name string, dependents []PackageRef) error {
+	if len(dependents) == 0 {
+		err := datastore.Delete(s.c, dependentsKey(s.c, name))
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	var e dependentsEntity
+	for _, dep := range dependents {
+		e.Names = append(e.Names, dep.Name)
+		e.Versions = append(e.Versions, dep.Version)
+	}
+	_, err := datastore.Put(s.c, dependentsKey(s.c, name), &e)
+	return err
+}
+
+func (s *datastoreStore) ListDependents() ([]string, error) {
+	keys, err := datastore.NewQuery("Dependents").KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.StringID())
+	}
+	return names, nil
+}
+
+// postingsEntity is the packages that have a search term, keyed by the
+// term.
+type postingsEntity struct {
+	Names  []string
+	Fields []int64
+}
+
+func postingsKey(c appengine.Context, term string) *datastore.Key {
+	return datastore.NewKey(c, "SearchTerm", term, 0, nil)
+}
+
+func (s *datastoreStore) GetPostings(term string) ([]Posting, error) {
+	var e postingsEntity
+	err := datastore.Get(s.c, postingsKey(s.c, term), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	postings := make([]Posting, 0, len(e.Names))
+	for i, name := range e.Names {
+		postings = append(postings, Posting{Name: name, Fields: int(e.Fields[i])})
+	}
+	return postings, nil
+}
+
+func (s *datastoreStore) PutPostings(term string, postings []Posting) error {
+	if len(postings) == 0 {
+		err := datastore.Delete(s.c, postingsKey(s.c, term))
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	var e postingsEntity
+	for _, p := range postings {
+		e.Names = append(e.Names, p.Name)
+		e.Fields = append(e.Fields, int64(p.Fields))
+	}
+	_, err := datastore.Put(s.c, postingsKey(s.c, term), &e)
+	return err
+}
+
+func (s *datastoreStore) ListTerms() ([]string, error) {
+	keys, err := datastore.NewQuery("SearchTerm").KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		return nil, err
+	}
+	terms := make([]string, 0, len(keys))
+	for _, key := range keys {
+		terms = append(terms, key.StringID())
+	}
+	return terms, nil
+}
+
+// Download counts are keyed by their shards.  Each shard is its own
+// entity group, so that shards can be updated at the same time.
+func downloadsKey(c appengine.Context, count *DownloadCount) *datastore.Key {
+	return datastore.NewKey(c, "Downloads", count.key(), 0, nil)
+}
+
+func (s *datastoreStore) AddDownloads(count DownloadCount) error {
+	key := downloadsKey(s.c, &count)
+	var existing DownloadCount
+	err := datastore.Get(s.c, key, &existing)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	count.Count += existing.Count
+	if count.Count == 0 {
+		err := datastore.Delete(s.c, key)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		return err
+	}
+	_, err = datastore.Put(s.c, key, &count)
+	return err
+}
+
+func (s *datastoreStore) ListDownloads(name string) ([]DownloadCount, error) {
+	var counts []DownloadCount
+	_, err := datastore.NewQuery("Downloads").Filter("Name =", name).GetAll(s.c, &counts)
+	return counts, err
+}
+
+func (s *datastoreStore) ListDownloadsOn(day string) ([]DownloadCount, error) {
+	var counts []DownloadCount
+	_, err := datastore.NewQuery("Downloads").Filter("Day =", day).GetAll(s.c, &counts)
+	return counts, err
+}
+
+// The snapshot is a single entity, so that it can be replaced in a
+// transaction.
+func snapshotKey(c appengine.Context) *datastore.Key {
+	return datastore.NewKey(c, "ArchiveContents", "snapshot", 0, nil)
+}
+
+func (s *datastoreStore) GetArchiveContents() (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := datastore.Get(s.c, snapshotKey(s.c), &snapshot); err != nil {
+		return nil, notFound(err)
+	}
+	return &snapshot, nil
+}
+
+func (s *datastoreStore) PutArchiveContents(snapshot *Snapshot) error {
+	_, err := datastore.Put(s.c, snapshotKey(s.c), snapshot)
+	return err
+}
+
+// Transaction runs f in a cross-group transaction, since rolling up
+// download counts updates all the shards of a count at once.
+func (s *datastoreStore) Transaction(f func(PackageStore) error) error {
+	return datastore.RunInTransaction(s.c, func(c appengine.Context) error {
+		return f(&datastoreStore{c: c})
+	}, &datastore.TransactionOptions{XG: true})
+}
@@ -0,0 +1,253 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file lets owners delete a package, or yank one of its versions.
+// Packages that depend on it may then no longer install, so owners are
+// shown which ones first.
+
+package elpa
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// newestVersion returns the newest of versions, other than except.
+func newestVersion(versions []*Contents, except *Version) *Contents {
+	var newest *Contents
+	var newestVersion Version
+	for _, v := range versions {
+		parsed, err := ParseVersion(v.Version)
+		if err != nil || (except != nil && parsed.Compare(*except) == 0) {
+			continue
+		}
+		if newest == nil || parsed.Compare(newestVersion) > 0 {
+			newest, newestVersion = v, parsed
+		}
+	}
+	return newest
+}
+
+// findVersion returns the one of versions that is version, or nil.
+func findVersion(versions []*Contents, version Version) *Contents {
+	for _, v := range versions {
+		if parsed, err := ParseVersion(v.Version); err == nil && parsed.Compare(version) == 0 {
+			return v
+		}
+	}
+	return nil
+}
+
+// isLatest returns true if version is p's latest version.
+func isLatest(p *Package, version Version) bool {
+	latest, err := ParseVersion(p.LatestVersion)
+	return err == nil && latest.Compare(version) == 0
+}
+
+// breakingDependents returns the packages that require p that could no
+// longer be installed if version were yanked, or if version is nil, if
+// p were deleted.
+func breakingDependents(store PackageStore, p *Package, version *Version) ([]PackageRef, error) {
+	dependents, err := store.GetDependents(p.Name)
+	if err != nil || len(dependents) == 0 {
+		return nil, err
+	}
+	var remaining *Contents
+	if version != nil {
+		versions, err := store.ListVersions(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if findVersion(versions, *version) == nil {
+			return nil, ErrNotFound
+		}
+		if !isLatest(p, *version) {
+			return nil, nil
+		}
+		remaining = newestVersion(versions, version)
+	}
+	if remaining == nil {
+		return dependents, nil
+	}
+	available, _ := ParseVersion(remaining.Version)
+	var breaking []PackageRef
+	for _, dep := range dependents {
+		if required, err := ParseVersion(dep.Version); err == nil && required.Compare(available) > 0 {
+			breaking = append(breaking, dep)
+		}
+	}
+	return breaking, nil
+}
+
+// removeVersion yanks version of the named package, or if version is
+// nil, deletes the package.  Yanking the only version deletes the
+// package; yanking the latest makes the newest remaining version the
+// latest.
+func (s *Server) removeVersion(r *http.Request, store PackageStore, name string, version *Version,
+	user string, admin bool) error {
+	var blobs []string
+	var previous, required []PackageRef
+	var previousTerms, terms map[string]int
+	err := store.Transaction(func(store PackageStore) error {
+		blobs = nil
+		p, err := store.GetPackage(name)
+		if err != nil {
+			return err
+		}
+		if err := checkOwner(p, user, admin); err != nil {
+			return err
+		}
+		previous, required = requiredBy(p.Details), nil
+		previousTerms, terms = packageTerms(p), nil
+		versions, err := store.ListVersions(name)
+		if err != nil {
+			return err
+		}
+		var remove []*Contents
+		if version == nil {
+			remove = versions
+		} else if v := findVersion(versions, *version); v != nil {
+			remove = []*Contents{v}
+		} else {
+			return ErrNotFound
+		}
+		for _, v := range remove {
+			parsed, err := ParseVersion(v.Version)
+			if err != nil {
+				continue
+			}
+			if err := store.DeleteVersion(name, parsed); err != nil {
+				return err
+			}
+			blobs = append(blobs, v.BlobKey)
+		}
+		var newest *Contents
+		if version != nil {
+			if !isLatest(p, *version) {
+				required, terms = previous, previousTerms
+				return nil
+			}
+			newest = newestVersion(versions, version)
+		}
+		if newest == nil {
+			return store.DeletePackage(name)
+		}
+		p.LatestVersion = newest.Version
+		if newest.Details != nil {
+			p.Details, p.Type = newest.Details, newest.Type
+		}
+		// Versions uploaded before we kept these have neither.
+		if newest.Description != "" || newest.Author != "" {
+			p.Description, p.Author = newest.Description, newest.Author
+		}
+		required, terms = requiredBy(p.Details), packageTerms(p)
+		return store.PutPackage(p)
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range blobs {
+		if err := store.DeleteBlob(key); err != nil {
+			s.errorf(r, "Failed to delete a blob of %v: %v", name, err)
+		}
+	}
+	s.updateDependents(r, store, name, previous, required)
+	s.updateSearchIndex(r, store, name, previousTerms, terms)
+	s.archiveChanged(r, store)
+	return nil
+}
+
+// remove asks an owner to confirm deleting a package, or yanking the
+// version in the "version" form value, and does it when the form is
+// posted.  If packages that depend on it would break, it is only done
+// if "confirm" is set.
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	name, v := r.FormValue("package"), r.FormValue("version")
+	returnTo := "/delete.html?" + url.Values{"package": {name}, "version": {v}}.Encode()
+	user := s.requireUser(w, r, returnTo)
+	if user == "" {
+		return
+	}
+	store := s.Store(r)
+	p := getPackage(w, r, store, name)
+	if p == nil {
+		return
+	}
+	admin := s.isAdmin(r)
+	if err := checkOwner(p, user, admin); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	var version *Version
+	if v != "" {
+		parsed, err := ParseVersion(v)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		version = &parsed
+	}
+	breaking, err := breakingDependents(store, p, version)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		if err := checkCSRF(r, r.PostFormValue(csrfField)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if len(breaking) == 0 || r.FormValue("confirm") != "" {
+			err := s.removeVersion(r, store, name, version, user, admin)
+			if err == ErrNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), uploadStatus(err))
+				return
+			}
+			if version == nil {
+				http.Redirect(w, r, "/", http.StatusFound)
+			} else {
+				http.Redirect(w, r, "/versions.html?package="+url.QueryEscape(name), http.StatusFound)
+			}
+			return
+		}
+		status = http.StatusConflict
+	}
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateData := struct {
+		Pkg      *Package
+		Version  string
+		Breaking []PackageRef
+		Refused  bool
+		CSRF     string
+	}{p, v, breaking, status == http.StatusConflict, csrf}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	err = s.Templates.ExecuteTemplate(w, "delete", templateData)
+	if err != nil {
+		s.errorf(r, "Failed to render the delete page: %v", err)
+	}
+}
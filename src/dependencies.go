@@ -0,0 +1,219 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file checks that the packages an upload requires can be
+// installed, either from the archive or because they come with Emacs.
+
+package elpa
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// An EmacsRelease is a release of Emacs, and the versions of the
+// packages that come with it.  A package can require "emacs" itself at
+// the release's version.
+type EmacsRelease struct {
+	Version  string            `json:"version"`
+	Packages map[string]string `json:"packages"`
+}
+
+// DefaultBuiltins are the Emacs releases dependencies are checked
+// against, unless the Server is given its own.
+var DefaultBuiltins = []EmacsRelease{
+	{"24.1", map[string]string{}},
+	{"24.2", map[string]string{}},
+	{"24.3", map[string]string{"cl-lib": "1.0"}},
+	{"24.4", map[string]string{"cl-lib": "1.0", "nadvice": "1.0"}},
+	{"24.5", map[string]string{"cl-lib": "1.0", "nadvice": "1.0"}},
+	{"25.1", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.3"}},
+	{"25.2", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.3"}},
+	{"25.3", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.3"}},
+	{"26.1", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.20"}},
+	{"26.2", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.20"}},
+	{"26.3", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.20"}},
+	{"27.1", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.21"}},
+	{"27.2", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.21"}},
+	{"28.1", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.23"}},
+	{"28.2", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.23"}},
+	{"29.1", map[string]string{"cl-lib": "1.0", "nadvice": "1.0", "seq": "2.23"}},
+}
+
+// ReadBuiltins reads a list of Emacs releases as JSON, in the form
+// [{"version": "25.1", "packages": {"seq": "2.3"}}, ...].
+func ReadBuiltins(r io.Reader) ([]EmacsRelease, error) {
+	var releases []EmacsRelease
+	if err := json.NewDecoder(r).Decode(&releases); err != nil {
+		return nil, err
+	}
+	for _, release := range releases {
+		if _, err := ParseVersion(release.Version); err != nil {
+			return nil, errors.New(fmt.Sprintf("Bad Emacs version %q: %v", release.Version, err))
+		}
+	}
+	return releases, nil
+}
+
+// What a Resolution found.
+const (
+	// The archive has a new enough version.
+	resolvedArchive = "archive"
+	// Emacs comes with a new enough version.
+	resolvedBuiltin = "builtin"
+	// Nothing of that name is in the archive or comes with Emacs.
+	resolvedMissing = "missing"
+	// The package is known, but not at a new enough version.
+	resolvedUnavailable = "unavailable"
+	// The required version can't be parsed.
+	resolvedInvalid = "invalid"
+)
+
+// A Resolution says where a required package can be installed from.
+type Resolution struct {
+	PackageRef
+	Status string `json:"status"`
+	// Available is the newest version of the package that can be
+	// had, if there is one.
+	Available string `json:"available,omitempty"`
+	// Emacs is the first Emacs release that comes with a new enough
+	// version, for builtin packages.
+	Emacs string `json:"emacs,omitempty"`
+}
+
+// Resolved is true if the required package can be installed.
+func (r Resolution) Resolved() bool {
+	return r.Status == resolvedArchive || r.Status == resolvedBuiltin
+}
+
+func (r Resolution) String() string {
+	switch r.Status {
+	case resolvedMissing:
+		return fmt.Sprintf("%v %v is not in the archive", r.Name, r.Version)
+	case resolvedUnavailable:
+		return fmt.Sprintf("%v %v is required, but only %v is available", r.Name, r.Version, r.Available)
+	case resolvedInvalid:
+		return fmt.Sprintf("%v is required at %q, which is not a valid version", r.Name, r.Version)
+	case resolvedBuiltin:
+		return fmt.Sprintf("%v %v comes with Emacs %v", r.Name, r.Version, r.Emacs)
+	}
+	return fmt.Sprintf("%v %v is in the archive at %v", r.Name, r.Version, r.Available)
+}
+
+func (s *Server) builtins() []EmacsRelease {
+	if s.Builtins != nil {
+		return s.Builtins
+	}
+	return DefaultBuiltins
+}
+
+// resolveBuiltin finds the first Emacs release that comes with name at
+// version or newer.  If none is new enough, it returns the newest
+// version that comes with any release, if there is one.
+func resolveBuiltin(releases []EmacsRelease, name string, version Version) (emacs string, available string) {
+	var first, newest *Version
+	for _, release := range releases {
+		v := release.Version
+		if name != "emacs" {
+			v = release.Packages[name]
+		}
+		if v == "" {
+			continue
+		}
+		bundled, err := ParseVersion(v)
+		if err != nil {
+			continue
+		}
+		if bundled.Compare(version) < 0 {
+			if newest == nil || bundled.Compare(*newest) > 0 {
+				newest = &bundled
+			}
+			continue
+		}
+		r, err := ParseVersion(release.Version)
+		if err == nil && (first == nil || r.Compare(*first) < 0) {
+			first, emacs, available = &r, release.Version, v
+		}
+	}
+	if emacs == "" && newest != nil {
+		available = newest.String()
+	}
+	return emacs, available
+}
+
+// resolveDependencies works out where each of required can be
+// installed from.  The archive is preferred to Emacs, since package.el
+// installs a newer version from the archive of a package that comes
+// with Emacs when one is required.
+func (s *Server) resolveDependencies(store PackageStore, required []PackageRef) ([]Resolution, error) {
+	resolutions := make([]Resolution, 0, len(required))
+	for _, ref := range required {
+		resolution := Resolution{PackageRef: ref, Status: resolvedMissing}
+		version, err := ParseVersion(ref.Version)
+		if err != nil {
+			resolution.Status = resolvedInvalid
+			resolutions = append(resolutions, resolution)
+			continue
+		}
+		p, err := store.GetPackage(ref.Name)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if err == nil {
+			resolution.Status, resolution.Available = resolvedUnavailable, p.LatestVersion
+			if latest, err := ParseVersion(p.LatestVersion); err == nil && latest.Compare(version) >= 0 {
+				resolution.Status = resolvedArchive
+			}
+		}
+		if !resolution.Resolved() {
+			emacs, available := resolveBuiltin(s.builtins(), ref.Name, version)
+			if emacs != "" {
+				resolution.Status, resolution.Available, resolution.Emacs = resolvedBuiltin, available, emacs
+			} else if available != "" && resolution.Status == resolvedMissing {
+				resolution.Status, resolution.Available = resolvedUnavailable, available
+			}
+		}
+		resolutions = append(resolutions, resolution)
+	}
+	return resolutions, nil
+}
+
+// checkDependencies rejects an upload that requires packages that
+// can't be installed, if the Server is strict about dependencies.
+func (s *Server) checkDependencies(store PackageStore, pkg *Package) error {
+	if !s.StrictDependencies {
+		return nil
+	}
+	details, err := decodeDetails(&pkg.Details)
+	if err != nil {
+		return err
+	}
+	resolutions, err := s.resolveDependencies(store, details.Required)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, resolution := range resolutions {
+		if !resolution.Resolved() {
+			problems = append(problems, resolution.String())
+		}
+	}
+	if problems != nil {
+		return badUpload(errors.New("Unresolved dependencies: " + strings.Join(problems, "; ")))
+	}
+	return nil
+}
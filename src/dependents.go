@@ -0,0 +1,126 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file keeps the reverse dependency index: for each package, the
+// packages in the archive whose latest version requires it, and at
+// what version.
+
+package elpa
+
+import (
+	"net/http"
+	"sort"
+)
+
+type byRefName []PackageRef
+
+func (r byRefName) Len() int           { return len(r) }
+func (r byRefName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRefName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+// requiredBy returns what the package with the given details requires.
+// Details that can't be read require nothing.
+func requiredBy(details []byte) []PackageRef {
+	if details == nil {
+		return nil
+	}
+	d, err := decodeDetails(&details)
+	if err != nil {
+		return nil
+	}
+	return d.Required
+}
+
+// updateDependents records that name now requires required, where it
+// used to require previous.  The upload or deletion that changed this
+// has already been saved, so failures are only logged.
+func (s *Server) updateDependents(r *http.Request, store PackageStore, name string, previous, required []PackageRef) {
+	changed := make(map[string]bool)
+	for _, ref := range previous {
+		changed[ref.Name] = true
+	}
+	for _, ref := range required {
+		changed[ref.Name] = true
+	}
+	for dep := range changed {
+		err := store.Transaction(func(store PackageStore) error {
+			dependents, err := store.GetDependents(dep)
+			if err != nil {
+				return err
+			}
+			var updated []PackageRef
+			for _, ref := range dependents {
+				if ref.Name != name {
+					updated = append(updated, ref)
+				}
+			}
+			for _, ref := range required {
+				if ref.Name == dep {
+					updated = append(updated, PackageRef{Name: name, Version: ref.Version})
+					break
+				}
+			}
+			sort.Sort(byRefName(updated))
+			return store.PutDependents(dep, updated)
+		})
+		if err != nil {
+			s.errorf(r, "Failed to update the packages that depend on %v: %v", dep, err)
+		}
+	}
+}
+
+// rebuildDependents builds the index from scratch, for archives with
+// packages uploaded before it was kept.  Names that no longer have
+// dependents are cleared.
+func rebuildDependents(store PackageStore) error {
+	packages, err := store.ListPackages()
+	if err != nil {
+		return err
+	}
+	index := make(map[string][]PackageRef)
+	for _, p := range packages {
+		index[p.Name] = index[p.Name]
+		for _, ref := range requiredBy(p.Details) {
+			index[ref.Name] = append(index[ref.Name], PackageRef{Name: p.Name, Version: ref.Version})
+		}
+	}
+	old, err := store.ListDependents()
+	if err != nil {
+		return err
+	}
+	for _, name := range old {
+		if _, ok := index[name]; !ok {
+			if err := store.PutDependents(name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for name, dependents := range index {
+		sort.Sort(byRefName(dependents))
+		if err := store.PutDependents(name, dependents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getDependents returns the packages that require name, with empty
+// lists as [] rather than null in JSON.
+func getDependents(store PackageStore, name string) ([]PackageRef, error) {
+	dependents, err := store.GetDependents(name)
+	if dependents == nil {
+		dependents = make([]PackageRef, 0)
+	}
+	return dependents, err
+}
@@ -0,0 +1,343 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file counts downloads of package files.  Each version's
+// downloads are counted by day, in one of several shards picked at
+// random, so that downloads of a popular package don't all contend to
+// update one counter.  Once a day is over its shards are rolled up
+// into one, so that reading the counts stays cheap.
+
+package elpa
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// downloadShards is how many shards each day's count for a version is
+// split into.  It is kept below the 25 entity groups an App Engine
+// transaction can use, so that a rollup can be done in one.
+const downloadShards = 20
+
+// dayFormat is how days are written in download counts.
+const dayFormat = "2006-01-02"
+
+// A DownloadCount is one shard of the number of times a version of a
+// package was downloaded on a day.  Days are in UTC.
+type DownloadCount struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Day     string `json:"day"`
+	Shard   int    `json:"shard"`
+	Count   int64  `json:"count"`
+}
+
+// key identifies the shard a count is for.
+func (c *DownloadCount) key() string {
+	return fmt.Sprintf("%v/%v/%v/%d", c.Name, c.Version, c.Day, c.Shard)
+}
+
+type byShard []DownloadCount
+
+func (c byShard) Len() int      { return len(c) }
+func (c byShard) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byShard) Less(i, j int) bool {
+	if c[i].Name != c[j].Name {
+		return c[i].Name < c[j].Name
+	}
+	if c[i].Day != c[j].Day {
+		return c[i].Day < c[j].Day
+	}
+	if c[i].Version != c[j].Version {
+		return c[i].Version < c[j].Version
+	}
+	return c[i].Shard < c[j].Shard
+}
+
+// countDownload counts a download of a version of the named package.
+// The download goes ahead if it can't be counted.
+func (s *Server) countDownload(r *http.Request, store PackageStore, name, version string) {
+	count := DownloadCount{
+		Name:    name,
+		Version: version,
+		Day:     time.Now().UTC().Format(dayFormat),
+		Shard:   rand.Intn(downloadShards),
+		Count:   1,
+	}
+	err := store.Transaction(func(store PackageStore) error {
+		return store.AddDownloads(count)
+	})
+	if err != nil {
+		s.errorf(r, "Failed to count a download of %v %v: %v", name, version, err)
+	}
+}
+
+// rollUpDownloads adds the shards of each version's count on day into
+// shard 0.  Each version is rolled up in a transaction, so that if it
+// is interrupted nothing is counted twice or lost, and running it
+// again finishes the job.
+func rollUpDownloads(store PackageStore, day string) error {
+	counts, err := store.ListDownloadsOn(day)
+	if err != nil {
+		return err
+	}
+	shards := make(map[string][]DownloadCount)
+	var order []string
+	for _, c := range counts {
+		version := c.Name + "/" + c.Version
+		if shards[version] == nil {
+			order = append(order, version)
+		}
+		shards[version] = append(shards[version], c)
+	}
+	for _, version := range order {
+		var total int64
+		var moved []DownloadCount
+		for _, c := range shards[version] {
+			if c.Shard != 0 {
+				total += c.Count
+				moved = append(moved, c)
+			}
+		}
+		if moved == nil {
+			continue
+		}
+		err := store.Transaction(func(store PackageStore) error {
+			for _, c := range moved {
+				c.Count = -c.Count
+				if err := store.AddDownloads(c); err != nil {
+					return err
+				}
+			}
+			rolled := moved[0]
+			rolled.Shard, rolled.Count = 0, total
+			return store.AddDownloads(rolled)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadStats are a package's downloads.  Total and Versions are for
+// all time, and Days for the last few days, oldest first.
+type DownloadStats struct {
+	Name     string             `json:"name"`
+	Total    int64              `json:"total"`
+	Versions []VersionDownloads `json:"versions"`
+	Days     []DayDownloads     `json:"days"`
+}
+
+type VersionDownloads struct {
+	Version   string `json:"version"`
+	Downloads int64  `json:"downloads"`
+}
+
+type DayDownloads struct {
+	Day       string `json:"day"`
+	Downloads int64  `json:"downloads"`
+}
+
+// byNewestVersion sorts versions newest first.  Versions that can't
+// be parsed go last.
+type byNewestVersion []VersionDownloads
+
+func (v byNewestVersion) Len() int      { return len(v) }
+func (v byNewestVersion) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byNewestVersion) Less(i, j int) bool {
+	a, errA := ParseVersion(v[i].Version)
+	b, errB := ParseVersion(v[j].Version)
+	if errA != nil || errB != nil {
+		return errB != nil && errA == nil
+	}
+	return a.Compare(b) > 0
+}
+
+// The default and largest number of days downloads are shown for.
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+// daysParam returns the number of days of downloads asked for in the
+// "days" form value.
+func daysParam(r *http.Request) (int, error) {
+	days, err := intParam(r, "days", defaultStatsDays)
+	if err == nil && days > maxStatsDays {
+		err = errors.New(fmt.Sprintf("days must be at most %d", maxStatsDays))
+	}
+	return days, err
+}
+
+// downloadStats adds up the named package's download counts, showing
+// the days up to and including today.
+func downloadStats(name string, counts []DownloadCount, today time.Time, days int) *DownloadStats {
+	stats := &DownloadStats{Name: name, Versions: make([]VersionDownloads, 0)}
+	versions := make(map[string]int64)
+	byDay := make(map[string]int64)
+	for _, c := range counts {
+		stats.Total += c.Count
+		versions[c.Version] += c.Count
+		byDay[c.Day] += c.Count
+	}
+	for version, n := range versions {
+		stats.Versions = append(stats.Versions, VersionDownloads{version, n})
+	}
+	sort.Sort(byNewestVersion(stats.Versions))
+	stats.Days = make([]DayDownloads, 0, days)
+	for i := days - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i).Format(dayFormat)
+		stats.Days = append(stats.Days, DayDownloads{day, byDay[day]})
+	}
+	return stats
+}
+
+// getDownloadStats reads the named package's download stats for the
+// last days days.
+func getDownloadStats(store PackageStore, name string, days int) (*DownloadStats, error) {
+	counts, err := store.ListDownloads(name)
+	if err != nil {
+		return nil, err
+	}
+	return downloadStats(name, counts, time.Now().UTC(), days), nil
+}
+
+// PackageDownloads is how many times a package has been downloaded.
+type PackageDownloads struct {
+	Name      string `json:"name"`
+	Downloads int64  `json:"downloads"`
+}
+
+type byDownloads []PackageDownloads
+
+func (p byDownloads) Len() int      { return len(p) }
+func (p byDownloads) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byDownloads) Less(i, j int) bool {
+	if p[i].Downloads != p[j].Downloads {
+		return p[i].Downloads > p[j].Downloads
+	}
+	return p[i].Name < p[j].Name
+}
+
+// allDownloads returns the total downloads of every package, most
+// downloaded first.
+func allDownloads(store PackageStore) ([]PackageDownloads, error) {
+	packages, err := store.ListPackages()
+	if err != nil {
+		return nil, err
+	}
+	totals := make([]PackageDownloads, 0, len(packages))
+	for _, p := range packages {
+		counts, err := store.ListDownloads(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		total := PackageDownloads{Name: p.Name}
+		for _, c := range counts {
+			total.Downloads += c.Count
+		}
+		totals = append(totals, total)
+	}
+	sort.Sort(byDownloads(totals))
+	return totals, nil
+}
+
+// stats serves /stats.html, the downloads of the package in the
+// "package" form value for the number of days in "days", or the
+// downloads of every package if no package is given.
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	name := r.FormValue("package")
+	if name == "" {
+		totals, err := allDownloads(store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		if err := s.Templates.ExecuteTemplate(w, "stats_overview", totals); err != nil {
+			s.errorf(r, "Failed to render the stats page: %v", err)
+		}
+		return
+	}
+	p := getPackage(w, r, store, name)
+	if p == nil {
+		return
+	}
+	days, err := daysParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := getDownloadStats(store, p.Name, days)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	if err := s.Templates.ExecuteTemplate(w, "stats", stats); err != nil {
+		s.errorf(r, "Failed to render the stats page of %v: %v", p.Name, err)
+	}
+}
+
+// apiDownloads serves /api/downloads, the total downloads of every
+// package.
+func (s *Server) apiDownloads(w http.ResponseWriter, r *http.Request) {
+	totals, err := allDownloads(s.Store(r))
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.serveJSON(w, r, http.StatusOK, totals)
+}
+
+// rollUp serves /admin/rollup-downloads, which rolls up the download
+// counts of the day in the "day" form value, or yesterday.  It is run
+// daily by App Engine's cron, whose requests have an X-Appengine-Cron
+// header, or can be posted by an admin.  Rolling up never changes the
+// counts, so the header being forged elsewhere does no harm.
+func (s *Server) rollUp(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Rolling up downloads must be a POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if s.requireUser(w, r, "/") == "" {
+			return
+		}
+		if !s.isAdmin(r) {
+			http.Error(w, "Only admins can roll up downloads", http.StatusForbidden)
+			return
+		}
+	}
+	day := r.FormValue("day")
+	if day == "" {
+		day = time.Now().UTC().AddDate(0, 0, -1).Format(dayFormat)
+	} else if _, err := time.Parse(dayFormat, day); err != nil {
+		http.Error(w, "day must be written as "+dayFormat, http.StatusBadRequest)
+		return
+	}
+	if err := rollUpDownloads(s.Store(r), day); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "Rolled up the downloads of %v\n", day)
+}
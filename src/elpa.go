@@ -12,277 +12,125 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// This file sets up the archive on App Engine.  The handlers themselves
+// are in handlers.go.  If signing-key.asc is deployed with the app,
+// the archive is signed with it.
+
+//go:build appengine
+// +build appengine
+
 package elpa
 
 import (
-	"bufio"
-	"fmt"
 	"html/template"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/url"
-	"regexp"
-	"strings"
-	"time"
+	"os"
 
 	"appengine"
 	"appengine/blobstore"
-	"appengine/datastore"
+	"appengine/user"
 )
 
-type Contents struct {
-	BlobKey    appengine.BlobKey `datastore:data`
-	Version    string            `datastore:version`
-	UploadTime time.Time         `datastore:uploadtime`
-}
-
 func init() {
-	http.HandleFunc("/upload", upload)
-	http.HandleFunc("/packages/archive-contents", archivecontents)
-	http.HandleFunc("/packages/", packages)
-	http.HandleFunc("/upload.html", uploadInstructions)
-	http.HandleFunc("/upload_complete.html", uploadComplete)
-	http.HandleFunc("/", main)
-}
-
-func uploadInstructions(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	uploadURL, err := blobstore.UploadURL(c, "/upload", nil)
-	w.Header().Set("Content-Type", "text/html")
-	err = templates.ExecuteTemplate(w, "upload", uploadURL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	s := &Server{
+		Store: func(r *http.Request) PackageStore {
+			return &datastoreStore{c: appengine.NewContext(r)}
+		},
+		Templates: template.Must(template.ParseGlob("templates/*")),
+		Errorf: func(r *http.Request, format string, args ...interface{}) {
+			appengine.NewContext(r).Errorf(format, args...)
+		},
+		IsAdmin: func(r *http.Request) bool {
+			return user.IsAdmin(appengine.NewContext(r))
+		},
+		UploadURL: func(r *http.Request) (string, error) {
+			uploadURL, err := blobstore.UploadURL(appengine.NewContext(r), "/upload", nil)
+			if err != nil {
+				return "", err
+			}
+			return uploadURL.String(), nil
+		},
+		ReceiveUpload: receiveBlobstoreUpload,
+		Auth:          appengineAuth{},
+		Signer:        loadSigner("signing-key.asc"),
 	}
+	s.Register(http.DefaultServeMux)
 }
 
-func uploadComplete(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	name := r.FormValue("package")
-	var p Package
-	err := datastore.Get(c, packageKey(c, name), &p)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// loadSigner reads the signing key deployed with the app, or returns
+// nil if there isn't one.
+func loadSigner(path string) *Signer {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	details, err := decodeDetails(&p.Details)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if details.Required == nil {
-		details.Required = make([]PackageRef, 0)
+		panic(err)
 	}
-	templateData := struct {
-		Pkg     *Package
-		Details *Details
-	}{&p, details}
-
-	err = templates.ExecuteTemplate(w, "upload_complete", templateData)
+	defer f.Close()
+	signer, err := NewSigner(f, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		panic(err)
 	}
+	return signer
 }
 
-func upload(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	blobs, _, err := blobstore.ParseUpload(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	file := blobs["file"]
-	if len(file) == 0 {
-		c.Errorf("No file uploaded")
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-	reader := blobstore.NewReader(c, file[0].BlobKey)
-	var pkg *Package
-	switch file[0].ContentType {
-	case "application/x-tar":
-		pkg, err = parsePackageVarsFromTar(bufio.NewReader(reader))
-		if err == nil {
-			pkg.Type = TAR
-		}
-	case "application/octet-stream", "text/x-emacs-lisp":
-		pkg, err = parsePackageVarsFromFile(bufio.NewReader(reader))
-		if err == nil {
-			pkg.Type = SINGLE
-		}
-	default:
-		http.Error(w, "Unknown ContentType: "+file[0].ContentType, http.StatusBadRequest)
-	}
+// appengineAuth logs users in with their Google accounts.  Users are
+// known by their email address.
+type appengineAuth struct{}
 
-	if err != nil {
-		c.Errorf(fmt.Sprintf("Error reading from upload: %v", err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	key := packageKey(c, pkg.Name)
-	_, err = datastore.Put(c, key, pkg)
-	if err != nil {
-		c.Errorf(fmt.Sprintf("Failed to save package %v", pkg.Name))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func (appengineAuth) User(r *http.Request) string {
+	u := user.Current(appengine.NewContext(r))
+	if u == nil {
+		return ""
 	}
-	contents := Contents{
-		BlobKey:    file[0].BlobKey,
-		Version:    pkg.LatestVersion,
-		UploadTime: time.Now().UTC(),
-	}
-	_, err = datastore.Put(c, versionKey(c, pkg.LatestVersion, key), &contents)
-	if err != nil {
-		c.Errorf(
-			fmt.Sprintf(
-				"Failed to save contents for version %v, package %v",
-				pkg.LatestVersion, pkg.Name))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	http.Redirect(w, r, "/upload_complete.html?package="+
-		url.QueryEscape(pkg.Name), http.StatusFound)
+	return u.Email
 }
 
-func packageKey(c appengine.Context, name string) *datastore.Key {
-	return datastore.NewKey(c, "Package", name, 0, nil)
-}
-
-func versionKey(c appengine.Context, version string, packageKey *datastore.Key) *datastore.Key {
-	return datastore.NewKey(c, "Contents", version, 0, packageKey)
-}
-
-type PackageAndBlobKey struct {
-	Package Package
-	BlobKey string
-}
-
-func main(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	q := datastore.NewQuery("Package")
-	var packages []*Package
-	_, err := q.GetAll(c, &packages)
-	w.Header().Set("Content-Type", "text/html")
-	err = templates.ExecuteTemplate(w, "main", packages)
+func (appengineAuth) Login(w http.ResponseWriter, r *http.Request, returnTo string) {
+	loginURL, err := user.LoginURL(appengine.NewContext(r), returnTo)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	http.Redirect(w, r, loginURL, http.StatusFound)
 }
 
-func archivecontents(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	q := datastore.NewQuery("Package")
-	var packages []*Package
-	_, err := q.GetAll(c, &packages)
-	w.Header().Set("Content-Type", "text/plain")
-	err = archiveContentsTemplate.Execute(w, packages)
+// receiveBlobstoreUpload handles the callback from the blobstore after
+// the upload form has been posted to blobstore.UploadURL, by which time
+// the file is already stored.  The signature, if there is one, is
+// stored as a blob too, and is read and deleted here.
+func receiveBlobstoreUpload(r *http.Request, store PackageStore) (*Upload, error) {
+	blobs, vals, err := blobstore.ParseUpload(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
-var readmeRE = regexp.MustCompile("-readme.txt$")
-var nameVersionRE = regexp.MustCompile("([a-z\\-]+)([\\d\\.]+).(el|tar)")
-
-// Serves several package related urls that package.el expects.
-//
-// First are readmes, which are served from
-// /packages/<package-name>-readme.txt.
-//
-// Second are package contents, which exist for all uploaded versions
-// of a packages. They are servered from
-// /packages/<package-name>-<package-version>.el
-func packages(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-	w.Header().Set("Content-Type", "text/plain")
-	file := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
-	if readmeRE.MatchString(file) {
-		name := file[:strings.LastIndex(file, "-")]
-		var p Package
-		err := datastore.Get(c, packageKey(c, name), &p)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		details, err := decodeDetails(&p.Details)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if len(details.Readme) == 0 {
-			fmt.Fprintf(w, "%v", p.Description)
-		} else {
-			// These \r's will show up as "^M" in the emacs buffer.
-			// We don't want that, although hopefully package.el will
-			// eventually fix this.
-			fmt.Fprintf(w, "%v", strings.Replace(details.Readme, "\r", "", -1))
-		}
-	} else {
-		parts := nameVersionRE.FindStringSubmatch(file)
-		if len(parts) < 3 {
-			http.Error(w, "Invalid package name: "+file,
-				http.StatusInternalServerError)
-			return
-		}
-		name := parts[1][:len(parts[1])-1]
-		version := parts[2]
-		q := datastore.NewQuery("Contents").Filter("Version=", version).
-			Ancestor(packageKey(c, name))
-		for cursor := q.Run(c); ; {
-			var contents Contents
-			_, err := cursor.Next(&contents)
-			if err == datastore.Done {
-				break
-			}
-			if err != nil {
-				http.Error(w, err.Error(),
-					http.StatusInternalServerError)
-				return
+		return nil, err
+	}
+	var signature []byte
+	for _, sig := range blobs["signature"] {
+		if signature == nil && sig.Size > 0 {
+			var blob io.ReadCloser
+			if blob, err = store.OpenBlob(string(sig.BlobKey)); err == nil {
+				signature, err = ioutil.ReadAll(io.LimitReader(blob, 1<<16))
+				blob.Close()
 			}
-			blobstore.Send(w, appengine.BlobKey(contents.BlobKey))
 		}
+		store.DeleteBlob(string(sig.BlobKey))
 	}
-}
-
-func versionList(version string) string {
-	parts := strings.Split(version, ".")
-	return "(" + strings.Join(parts, " ") + ")"
-}
-
-func requiredList(b *[]byte) string {
-	details, err := decodeDetails(b)
-	if err != nil || len(details.Required) == 0 {
-		// TODO(ahyatt) Log an error here
-		return "nil"
-	}
-	parts := make([]string, 0)
-	for _, require := range details.Required {
-		parts = append(parts, "("+require.Name+" ("+
-			strings.Replace(require.Version, ".", " ", -1)+"))")
-	}
-	return "(" + strings.Join(parts, " ") + ")"
-}
-
-func getType(t PackageType) string {
-	switch t {
-	case TAR:
-		return "tar"
-	case SINGLE:
-		return "single"
+	file := blobs["file"]
+	if len(file) == 0 {
+		return nil, nil
 	}
-	// TODO(ahyatt) Log an error here
-	return "unknown"
+	if err != nil {
+		store.DeleteBlob(string(file[0].BlobKey))
+		return nil, err
+	}
+	return &Upload{
+		BlobKey:     string(file[0].BlobKey),
+		ContentType: file[0].ContentType,
+		Filename:    file[0].Filename,
+		Form:        vals,
+		Signature:   signature,
+	}, nil
 }
-
-var templates = template.Must(template.ParseGlob("templates/*"))
-var archiveContentsTemplate = template.Must(template.New("ArchiveContents").
-	Funcs(template.FuncMap{"versionList": versionList,
-	"requiredList": requiredList,
-	"getType":      getType}).
-	Parse(archiveContentsElisp))
-
-var archiveContentsElisp = `(1 {{range .}}
-({{.Name}} . [{{versionList .LatestVersion}} {{requiredList .Details}} "{{.Description}}" {{getType .Type}}]){{end}})
-`
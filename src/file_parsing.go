@@ -32,139 +32,268 @@ import (
 )
 
 var elParamRE = regexp.MustCompile("^;; ([\\w\\-]+): (.*)")
-var requiresRE = regexp.MustCompile("\\(([\\w\\-]+) \"([0-9\\.]+)\"\\)")
 var nameDescriptionRE = regexp.MustCompile("^;;; ([\\w-\\-]+)\\.el --- (.*)")
 var headingRe = regexp.MustCompile("^;;; (.*):")
 var textLineRe = regexp.MustCompile("^;; (.*)")
-var dirRe = regexp.MustCompile("^([\\w\\-]+)-([\\d\\.]+)")
+var dirRe = regexp.MustCompile("^([\\w\\-]+)-(\\d[^-]*)$")
 var pkgFileNameRe = regexp.MustCompile("^([\\w\\-]+)-pkg.el")
+var personRE = regexp.MustCompile("^(.*?)\\s*<([^>]*)>")
 
-func readPackageDefinition(cout chan *Token, cerr chan error, pkg *Package, details *Details) {
-	tok := <-cout
-	if tok.Type != OPEN_PAREN {
-		cerr <- errors.New("Package definition must start with a open paren")
-		return
-	}
-	tok = <-cout
-	if tok.Type != SYMBOL && tok.StringVal == "package-definition" {
-		cerr <- errors.New("Package definition must start with '(package-defintion...'")
-		return
-	}
-	tok = <-cout
-	if tok.Type != STRING {
-		cerr <- errors.New("Expected package name as first element in package definition")
-		return
-	}
-	if tok.StringVal != pkg.Name {
-		cerr <- errors.New(fmt.Sprintf("Package name in package definition (%s) didn't match directory name (%s)", tok.StringVal, pkg.Name))
-		return
-	}
-	tok = <-cout
-	if tok.Type != STRING {
-		cerr <- errors.New("Expected version number as second element in package definition")
-		return
-	}
-	if tok.StringVal != pkg.LatestVersion {
-		cerr <- errors.New(fmt.Sprintf("Package version in package definition (%s) didn't match directory name (%s)", tok.StringVal, pkg.LatestVersion))
-		return
-	}
-	tok = <-cout
-	if tok.Type != CLOSE_PAREN {
-		if tok.Type != STRING {
-			cerr <- errors.New("Expected description as third element in package definition")
-			return
+// pkgSymbolIs returns true if s is the symbol name, ignoring case.
+// Symbols are case-sensitive everywhere else, but the original -pkg.el
+// parser lowercased every symbol, so archives have -pkg.el files that
+// say (DEFINE-PACKAGE ... (QUOTE ...)).
+func pkgSymbolIs(s Sexp, name string) bool {
+	sym, ok := s.(Symbol)
+	return ok && strings.EqualFold(string(sym), name)
+}
+
+// pkgUnquote is unquote for -pkg.el files, where quote may be in any
+// case.
+func pkgUnquote(s Sexp) Sexp {
+	if list, ok := s.(*List); ok && len(list.Elems) == 2 && list.Dotted == nil &&
+		pkgSymbolIs(list.Elems[0], string(quoteSymbol)) {
+		return list.Elems[1]
+	}
+	return s
+}
+
+func readPackageDefinition(def Sexp, pkg *Package, details *Details) error {
+	list, ok := def.(*List)
+	if !ok || list.Dotted != nil {
+		return errors.New("Package definition must be a list")
+	}
+	if len(list.Elems) == 0 || !pkgSymbolIs(list.Elems[0], packageDefinitionString) {
+		return errors.New("Package definition must start with '(define-package...'")
+	}
+	args := list.Elems[1:]
+	if len(args) < 1 {
+		return errors.New("Expected package name as first element in package definition")
+	}
+	name, ok := args[0].(String)
+	if !ok {
+		return errors.New("Expected package name as first element in package definition")
+	}
+	if string(name) != pkg.Name {
+		return errors.New(fmt.Sprintf("Package name in package definition (%s) didn't match directory name (%s)", name, pkg.Name))
+	}
+	if len(args) < 2 {
+		return errors.New("Expected version number as second element in package definition")
+	}
+	version, ok := args[1].(String)
+	if !ok {
+		return errors.New("Expected version number as second element in package definition")
+	}
+	if string(version) != pkg.LatestVersion {
+		return errors.New(fmt.Sprintf("Package version in package definition (%s) didn't match directory name (%s)", version, pkg.LatestVersion))
+	}
+	if len(args) < 3 {
+		return nil
+	}
+	description, ok := args[2].(String)
+	if !ok {
+		return errors.New("Expected description as third element in package definition")
+	}
+	pkg.Description = string(description)
+	if len(args) < 4 {
+		return nil
+	}
+	required, err := readRequirements(pkgUnquote(args[3]))
+	if err != nil {
+		return err
+	}
+	details.Required = required
+	return readPackageProperties(args[4:], details)
+}
+
+// readPackageProperties reads the keyword arguments that can follow
+// the dependency list, such as :url "..." :keywords '("a" "b").
+// Unknown keywords are ignored, since package.el adds new ones from
+// time to time.
+func readPackageProperties(plist []Sexp, details *Details) error {
+	if len(plist)%2 != 0 {
+		return errors.New("Keyword arguments in package definition must come in pairs")
+	}
+	for i := 0; i < len(plist); i += 2 {
+		key, ok := plist[i].(Symbol)
+		if !ok || !strings.HasPrefix(string(key), ":") {
+			return errors.New("Expected a keyword argument after the dependency list in package definition")
 		}
-		pkg.Description = tok.StringVal
-		tok = <-cout
-		if tok.Type != CLOSE_PAREN {
-			if tok.Type != SYMBOL || tok.StringVal != "nil" {
-				if tok.Type != OPEN_PAREN {
-					cerr <- errors.New("Unexpected tokens at the fourth element in package definition, expected a quote form")
-					return
-				}
-				tok = <-cout
-				if tok.Type != SYMBOL && tok.StringVal != "quote" {
-					cerr <- errors.New("Unexpected tokens at the fourth element in package definition, expected a quote form")
-					return
-				}
-				tok = <-cout
-				if tok.Type != OPEN_PAREN {
-					cerr <- errors.New("Expected a list of lists at the fourth element in package definition")
-					return
-				}
-				tok = <-cout
-				for tok.Type == OPEN_PAREN {
-					tok = <-cout
-					if tok.Type != SYMBOL {
-						cerr <- errors.New("Expected a symbol as the required package name")
-						return
-					}
-					reqPackageName := tok.StringVal
-					tok = <-cout
-					if tok.Type != STRING {
-						cerr <- errors.New("Expected a string as the required package version")
-						return
-					}
-					reqPackageVersion := tok.StringVal
-					details.Required = append(details.Required, PackageRef{Name: reqPackageName, Version: reqPackageVersion})
-					tok = <-cout
-					if tok.Type != CLOSE_PAREN {
-						cerr <- errors.New("Required package should just be a 2-element list")
-						return
-					}
-					tok = <-cout
-				}
-				tok = <-cout
-				if tok.Type != CLOSE_PAREN {
-					cerr <- errors.New("Expected closing paren after required package list")
-					return
-				}
-				if tok.Type != CLOSE_PAREN {
-					cerr <- errors.New("Missing closing parenthesis for required versions ")
-					return
-				}
-			}
-			if tok.Type != CLOSE_PAREN {
-				cerr <- errors.New("Missing closing parenthesis for required versions ")
-				return
+		value := pkgUnquote(plist[i+1])
+		var err error
+		switch string(key) {
+		case ":url":
+			details.URL, err = readStringProperty(key, value)
+		case ":keywords":
+			details.Keywords, err = readKeywords(value)
+		case ":authors":
+			details.Authors, err = readPeople(value)
+		case ":commit":
+			details.Commit, err = readStringProperty(key, value)
+		case ":maintainer":
+			if !isNil(value) {
+				var maintainer Person
+				maintainer, err = readPerson(value)
+				details.Maintainer = &maintainer
 			}
 		}
+		if err != nil {
+			return err
+		}
 	}
-	tok = <-cout
-	if tok.Type != CLOSE_PAREN {
-		cerr <- errors.New("Missing closing parenthesis for package definition")
+	return nil
+}
+
+func readStringProperty(key Symbol, value Sexp) (string, error) {
+	if isNil(value) {
+		return "", nil
+	}
+	s, ok := value.(String)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Expected a string for %s in package definition", key))
 	}
-	cerr <- nil
+	return string(s), nil
 }
 
-func parsePackageDefinition(reader *tar.Reader, pkg *Package, details *Details) error {
-	cin := make(chan int)
-	cout := make(chan *Token)
-	cerr := make(chan error)
-	cdone := make(chan bool)
-	go parseSimpleSexp(cin, cout, cdone)
-	go readPackageDefinition(cout, cerr, pkg, details)
-	bytes := make([]byte, 256)
-	for {
-		n, err := reader.Read(bytes)
-		if err == io.EOF {
-			cdone <- true
-			break
+// readKeywords reads a list of keywords, which may be either strings
+// or symbols.
+func readKeywords(value Sexp) ([]string, error) {
+	if isNil(value) {
+		return nil, nil
+	}
+	list, ok := value.(*List)
+	if !ok || list.Dotted != nil {
+		return nil, errors.New("Expected a list for :keywords in package definition")
+	}
+	keywords := make([]string, 0)
+	for _, elem := range list.Elems {
+		switch kw := elem.(type) {
+		case String:
+			keywords = append(keywords, string(kw))
+		case Symbol:
+			keywords = append(keywords, string(kw))
+		default:
+			return nil, errors.New("Expected strings in :keywords in package definition")
+		}
+	}
+	return keywords, nil
+}
+
+// parseKeywords splits a Keywords: header, which may be separated by
+// commas, spaces or both.
+func parseKeywords(s string) []string {
+	keywords := make([]string, 0)
+	for _, keyword := range listSeparatorRE.Split(s, -1) {
+		if len(keyword) > 0 {
+			keywords = append(keywords, keyword)
 		}
+	}
+	return keywords
+}
+
+func readPeople(value Sexp) ([]Person, error) {
+	if isNil(value) {
+		return nil, nil
+	}
+	list, ok := value.(*List)
+	if !ok || list.Dotted != nil {
+		return nil, errors.New("Expected a list for :authors in package definition")
+	}
+	people := make([]Person, 0)
+	for _, elem := range list.Elems {
+		person, err := readPerson(elem)
 		if err != nil {
-			cdone <- true
-			return err
+			return nil, err
+		}
+		people = append(people, person)
+	}
+	return people, nil
+}
+
+// readPerson reads a person, normally of the form ("Name" . "email").
+// A bare "Name <email>" string is also accepted.
+func readPerson(value Sexp) (Person, error) {
+	switch p := value.(type) {
+	case String:
+		return parsePerson(string(p)), nil
+	case *List:
+		name, ok := p.Elems[0].(String)
+		if !ok {
+			break
 		}
-		for _, b := range bytes[:n] {
-			select {
-			case err = <-cerr:
-				return err
-			default:
-				cin <- int(b)
+		email := p.Dotted
+		if email == nil && len(p.Elems) == 2 {
+			email = p.Elems[1]
+		} else if len(p.Elems) != 1 {
+			break
+		}
+		if email == nil || isNil(email) {
+			return Person{Name: string(name)}, nil
+		}
+		if e, ok := email.(String); ok {
+			return Person{Name: string(name), Email: string(e)}, nil
+		}
+	}
+	return Person{}, errors.New("Expected (\"Name\" . \"email\") for a person in package definition")
+}
+
+// parsePerson splits a "Name <email>" string.
+func parsePerson(s string) Person {
+	if parts := personRE.FindStringSubmatch(s); len(parts) > 0 {
+		return Person{Name: strings.TrimSpace(parts[1]), Email: parts[2]}
+	}
+	return Person{Name: strings.TrimSpace(s)}
+}
+
+// readRequirements reads a dependency list of the form
+// ((name "version") ...).  As in package.el, the version may be left
+// out, in which case any version will do.
+func readRequirements(reqs Sexp) ([]PackageRef, error) {
+	if isNil(reqs) {
+		return nil, nil
+	}
+	list, ok := reqs.(*List)
+	if !ok || list.Dotted != nil {
+		return nil, errors.New("Expected a list of lists for the required packages")
+	}
+	refs := make([]PackageRef, 0)
+	for _, req := range list.Elems {
+		reqList, ok := req.(*List)
+		if !ok || reqList.Dotted != nil || len(reqList.Elems) > 2 {
+			return nil, errors.New("Required package should just be a 2-element list")
+		}
+		reqName, ok := reqList.Elems[0].(Symbol)
+		if !ok {
+			return nil, errors.New("Expected a symbol as the required package name")
+		}
+		reqVersion := String("0")
+		if len(reqList.Elems) == 2 {
+			reqVersion, ok = reqList.Elems[1].(String)
+			if !ok {
+				return nil, errors.New("Expected a string as the required package version")
 			}
 		}
+		if _, err := ParseVersion(string(reqVersion)); err != nil {
+			return nil, errors.New(fmt.Sprintf("Required package %s: %v", reqName, err))
+		}
+		refs = append(refs, PackageRef{
+			Name:    string(reqName),
+			Version: string(reqVersion),
+		})
 	}
-	return <-cerr
+	return refs, nil
+}
+
+func parsePackageDefinition(reader io.Reader, pkg *Package, details *Details) error {
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	def, err := readSexp(string(b))
+	if err != nil {
+		return err
+	}
+	return readPackageDefinition(def, pkg, details)
 }
 
 func parsePackageVarsFromTar(reader *bufio.Reader) (*Package, error) {
@@ -172,6 +301,7 @@ func parsePackageVarsFromTar(reader *bufio.Reader) (*Package, error) {
 	pkg := Package{}
 	details := Details{}
 	var dir *string = nil
+	readme := -1
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -199,14 +329,18 @@ func parsePackageVarsFromTar(reader *bufio.Reader) (*Package, error) {
 			}
 		}
 		if match := pkgFileNameRe.FindStringSubmatch(filepath.Base(hdr.Name)); len(match) > 0 && match[1] == pkg.Name {
-			parsePackageDefinition(tr, &pkg, &details)
+			if err := parsePackageDefinition(tr, &pkg, &details); err != nil {
+				return nil, err
+			}
 		}
-		if filepath.Base(hdr.Name) == "README" {
+		if rank := readmeRank(filepath.Base(hdr.Name)); rank >= 0 && (readme < 0 || rank < readme) {
 			b, err := ioutil.ReadAll(tr)
 			if err != nil {
 				return nil, err
 			}
 			details.Readme = string(b)
+			details.ReadmeFormat = readmeFiles[rank].Format
+			readme = rank
 		}
 	}
 	bytes, err := encodeDetails(&details)
@@ -238,6 +372,24 @@ func parsePackageVarsFromFile(reader *bufio.Reader) (*Package, error) {
 			case "author":
 				{
 					pkg.Author = value
+					details.Authors = append(details.Authors, parsePerson(value))
+				}
+			case "maintainer":
+				{
+					maintainer := parsePerson(value)
+					details.Maintainer = &maintainer
+				}
+			case "url", "homepage":
+				{
+					details.URL = strings.TrimSpace(value)
+				}
+			case "keywords":
+				{
+					details.Keywords = parseKeywords(value)
+				}
+			case "package-commit":
+				{
+					details.Commit = strings.TrimSpace(value)
 				}
 			case "version":
 				{
@@ -245,15 +397,15 @@ func parsePackageVarsFromFile(reader *bufio.Reader) (*Package, error) {
 				}
 			case "package-requires":
 				{
-					details.Required = make([]PackageRef, 0)
-					for _, require := range requiresRE.FindAllStringSubmatch(value, -1) {
-						if len(require) > 0 {
-							details.Required = append(details.Required,
-								PackageRef{
-									Name:    require[1],
-									Version: require[2],
-								})
-						}
+					requires, err := readSexp(value)
+					if err == nil {
+						details.Required, err = readRequirements(requires)
+					}
+					if err != nil {
+						return nil, errors.New(fmt.Sprintf("Could not read Package-Requires: %v", err))
+					}
+					if details.Required == nil {
+						details.Required = make([]PackageRef, 0)
 					}
 				}
 			}
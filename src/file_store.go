@@ -0,0 +1,658 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileStore is a PackageStore that keeps everything in a directory on
+// local disk:
+//
+//	<dir>/packages/<package-name>.json
+//	<dir>/versions/<package-name>/<version>.json
+//	<dir>/blobs/<first two digits of hash>/<sha256 of contents>
+//	<dir>/tokens/<sha256 of token>.json
+//	<dir>/keys/<key fingerprint>.json
+//	<dir>/dependents/<package-name>.json
+//	<dir>/search/<term>.json
+//	<dir>/downloads/<day>/<package-name>.json
+//	<dir>/archive-contents.json
+//
+// Only one process should use a directory at a time.
+type FileStore struct {
+	dir  string
+	txMu sync.Mutex
+
+	// blobMu guards holds and doomed, and is held while a blob is
+	// checked and removed.
+	blobMu sync.Mutex
+	holds  int
+	doomed map[string]bool
+}
+
+// NewFileStore returns a FileStore for dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	for _, sub := range []string{"packages", "versions", "blobs", "tokens", "keys", "dependents"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+var errInvalidName = errors.New("Invalid name")
+
+// checkName makes sure a name is safe to use as a file name.
+func checkName(name string) error {
+	if len(name) == 0 || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, "/\\\x00") {
+		return errInvalidName
+	}
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file and renames it into place,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func readJSON(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+func (s *FileStore) packagePath(name string) string {
+	return filepath.Join(s.dir, "packages", name+".json")
+}
+
+func (s *FileStore) versionPath(name string, version Version) string {
+	return filepath.Join(s.dir, "versions", name, version.String()+".json")
+}
+
+func (s *FileStore) blobPath(key string) string {
+	return filepath.Join(s.dir, "blobs", key[:2], key)
+}
+
+func (s *FileStore) GetPackage(name string) (*Package, error) {
+	if checkName(name) != nil {
+		return nil, ErrNotFound
+	}
+	var pkg Package
+	if err := readJSON(s.packagePath(name), &pkg); err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+func (s *FileStore) PutPackage(pkg *Package) error {
+	if err := checkName(pkg.Name); err != nil {
+		return err
+	}
+	return writeJSON(s.packagePath(pkg.Name), pkg)
+}
+
+func (s *FileStore) ListPackages() ([]*Package, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "packages", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	packages := make([]*Package, 0, len(files))
+	for _, file := range files {
+		var pkg Package
+		if err := readJSON(file, &pkg); err != nil {
+			return nil, err
+		}
+		packages = append(packages, &pkg)
+	}
+	sort.Sort(byName(packages))
+	return packages, nil
+}
+
+func (s *FileStore) DeletePackage(name string) error {
+	if checkName(name) != nil {
+		return nil
+	}
+	return removeFile(s.packagePath(name))
+}
+
+// removeFile removes path, if it exists.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) GetVersion(name string, version Version) (*Contents, error) {
+	if checkName(name) != nil {
+		return nil, ErrNotFound
+	}
+	var contents Contents
+	if err := readJSON(s.versionPath(name, version), &contents); err != nil {
+		return nil, err
+	}
+	return &contents, nil
+}
+
+func (s *FileStore) PutVersion(name string, version Version, contents *Contents) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	return writeJSON(s.versionPath(name, version), contents)
+}
+
+func (s *FileStore) ListVersions(name string) ([]*Contents, error) {
+	if checkName(name) != nil {
+		return nil, ErrNotFound
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "versions", name, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*Contents, 0, len(files))
+	for _, file := range files {
+		var contents Contents
+		if err := readJSON(file, &contents); err != nil {
+			return nil, err
+		}
+		versions = append(versions, &contents)
+	}
+	return versions, nil
+}
+
+func (s *FileStore) DeleteVersion(name string, version Version) error {
+	if checkName(name) != nil {
+		return nil
+	}
+	return removeFile(s.versionPath(name, version))
+}
+
+// PutBlob stores blobs under the hash of their contents, so uploading
+// the same file twice stores it once.
+func (s *FileStore) PutBlob(r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "blobs"), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+	if err := os.MkdirAll(filepath.Dir(s.blobPath(key)), 0755); err != nil {
+		return "", err
+	}
+	return key, os.Rename(tmp.Name(), s.blobPath(key))
+}
+
+func (s *FileStore) OpenBlob(key string) (io.ReadCloser, error) {
+	if len(key) < 2 || checkName(key) != nil {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.blobPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// DeleteBlob removes a blob.  Since blobs are shared between identical
+// uploads, it leaves blobs that are still used by a version or by the
+// archive-contents snapshot.  While blobs are held, it only marks the
+// blob, and it's removed once the last hold is released.
+func (s *FileStore) DeleteBlob(key string) error {
+	if len(key) < 2 || checkName(key) != nil {
+		return nil
+	}
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	if s.holds > 0 {
+		if s.doomed == nil {
+			s.doomed = make(map[string]bool)
+		}
+		s.doomed[key] = true
+		return nil
+	}
+	return s.deleteBlob(key)
+}
+
+// holdBlobs keeps DeleteBlob from removing blobs until the returned
+// function is called.  An upload holds blobs from before it stores its
+// blob until its version is saved, so a refused upload of the same file
+// can't remove the blob in between.
+func (s *FileStore) holdBlobs() (release func()) {
+	s.blobMu.Lock()
+	s.holds++
+	s.blobMu.Unlock()
+	var once sync.Once
+	return func() { once.Do(s.releaseBlobs) }
+}
+
+func (s *FileStore) releaseBlobs() {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	s.holds--
+	if s.holds > 0 {
+		return
+	}
+	for key := range s.doomed {
+		// A blob that can't be removed now is left behind, which only
+		// wastes space.
+		s.deleteBlob(key)
+	}
+	s.doomed = nil
+}
+
+// deleteBlob removes a blob that isn't in use.  The caller holds blobMu.
+func (s *FileStore) deleteBlob(key string) error {
+	inUse, err := s.blobInUse(key)
+	if err != nil || inUse {
+		return err
+	}
+	err = os.Remove(s.blobPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) blobInUse(key string) (bool, error) {
+	snapshot, err := s.GetArchiveContents()
+	if err == nil && snapshot.BlobKey == key {
+		return true, nil
+	}
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "versions", "*", "*.json"))
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		var contents Contents
+		if err := readJSON(file, &contents); err != nil {
+			return false, err
+		}
+		if contents.BlobKey == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *FileStore) tokenPath(hash string) string {
+	return filepath.Join(s.dir, "tokens", hash+".json")
+}
+
+func (s *FileStore) GetToken(hash string) (*APIToken, error) {
+	if checkName(hash) != nil {
+		return nil, ErrNotFound
+	}
+	var token APIToken
+	if err := readJSON(s.tokenPath(hash), &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *FileStore) PutToken(token *APIToken) error {
+	if err := checkName(token.Hash); err != nil {
+		return err
+	}
+	return writeJSON(s.tokenPath(token.Hash), token)
+}
+
+func (s *FileStore) ListTokens(user string) ([]*APIToken, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "tokens", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*APIToken
+	for _, file := range files {
+		var token APIToken
+		if err := readJSON(file, &token); err != nil {
+			return nil, err
+		}
+		if token.User == user {
+			tokens = append(tokens, &token)
+		}
+	}
+	sort.Sort(byCreated(tokens))
+	return tokens, nil
+}
+
+func (s *FileStore) DeleteToken(hash string) error {
+	if checkName(hash) != nil {
+		return nil
+	}
+	err := os.Remove(s.tokenPath(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) keyPath(fingerprint string) string {
+	return filepath.Join(s.dir, "keys", fingerprint+".json")
+}
+
+func (s *FileStore) GetKey(fingerprint string) (*PublicKey, error) {
+	if checkName(fingerprint) != nil {
+		return nil, ErrNotFound
+	}
+	var key PublicKey
+	if err := readJSON(s.keyPath(fingerprint), &key); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *FileStore) PutKey(key *PublicKey) error {
+	if err := checkName(key.Fingerprint); err != nil {
+		return err
+	}
+	return writeJSON(s.keyPath(key.Fingerprint), key)
+}
+
+func (s *FileStore) ListKeys(user string) ([]*PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "keys", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*PublicKey
+	for _, file := range files {
+		var key PublicKey
+		if err := readJSON(file, &key); err != nil {
+			return nil, err
+		}
+		if key.User == user {
+			keys = append(keys, &key)
+		}
+	}
+	sort.Sort(byAdded(keys))
+	return keys, nil
+}
+
+func (s *FileStore) DeleteKey(fingerprint string) error {
+	if checkName(fingerprint) != nil {
+		return nil
+	}
+	err := os.Remove(s.keyPath(fingerprint))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) dependentsPath(name string) string {
+	return filepath.Join(s.dir, "dependents", name+".json")
+}
+
+func (s *FileStore) GetDependents(name string) ([]PackageRef, error) {
+	if checkName(name) != nil {
+		return nil, nil
+	}
+	var dependents []PackageRef
+	err := readJSON(s.dependentsPath(name), &dependents)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return dependents, err
+}
+
+func (s *FileStore) PutDependents(name string, dependents []PackageRef) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if len(dependents) == 0 {
+		return removeFile(s.dependentsPath(name))
+	}
+	return writeJSON(s.dependentsPath(name), dependents)
+}
+
+func (s *FileStore) ListDependents() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "dependents"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(info.Name(), ".json"))
+		}
+	}
+	return names, nil
+}
+
+func (s *FileStore) postingsPath(term string) string {
+	return filepath.Join(s.dir, "search", term+".json")
+}
+
+func (s *FileStore) GetPostings(term string) ([]Posting, error) {
+	if checkName(term) != nil {
+		return nil, nil
+	}
+	var postings []Posting
+	err := readJSON(s.postingsPath(term), &postings)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return postings, err
+}
+
+func (s *FileStore) PutPostings(term string, postings []Posting) error {
+	if err := checkName(term); err != nil {
+		return err
+	}
+	if len(postings) == 0 {
+		return removeFile(s.postingsPath(term))
+	}
+	return writeJSON(s.postingsPath(term), postings)
+}
+
+func (s *FileStore) ListTerms() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "search"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var terms []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			terms = append(terms, strings.TrimSuffix(info.Name(), ".json"))
+		}
+	}
+	return terms, nil
+}
+
+// Downloads are kept in a file for each day and package, so counting
+// a download only rewrites that day's counts.
+func (s *FileStore) downloadsPath(day, name string) string {
+	return filepath.Join(s.dir, "downloads", day, name+".json")
+}
+
+// downloadDays lists the days with download counts, oldest first.
+func (s *FileStore) downloadDays() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "downloads"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, info := range infos {
+		if info.IsDir() && checkName(info.Name()) == nil {
+			days = append(days, info.Name())
+		}
+	}
+	return days, nil
+}
+
+// readDownloads reads the named package's counts on day.
+func (s *FileStore) readDownloads(day, name string) ([]DownloadCount, error) {
+	var counts []DownloadCount
+	err := readJSON(s.downloadsPath(day, name), &counts)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return counts, err
+}
+
+// AddDownloads rewrites the package's counts for the day, so it must
+// be called in a transaction.
+func (s *FileStore) AddDownloads(count DownloadCount) error {
+	if err := checkName(count.Name); err != nil {
+		return err
+	}
+	if err := checkName(count.Day); err != nil {
+		return err
+	}
+	counts, err := s.readDownloads(count.Day, count.Name)
+	if err != nil {
+		return err
+	}
+	updated := make([]DownloadCount, 0, len(counts)+1)
+	for _, c := range counts {
+		if c.key() == count.key() {
+			count.Count += c.Count
+		} else {
+			updated = append(updated, c)
+		}
+	}
+	if count.Count != 0 {
+		updated = append(updated, count)
+	}
+	if len(updated) == 0 {
+		return removeFile(s.downloadsPath(count.Day, count.Name))
+	}
+	sort.Sort(byShard(updated))
+	return writeJSON(s.downloadsPath(count.Day, count.Name), updated)
+}
+
+func (s *FileStore) ListDownloads(name string) ([]DownloadCount, error) {
+	if checkName(name) != nil {
+		return nil, nil
+	}
+	days, err := s.downloadDays()
+	if err != nil {
+		return nil, err
+	}
+	var counts []DownloadCount
+	for _, day := range days {
+		onDay, err := s.readDownloads(day, name)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, onDay...)
+	}
+	return counts, nil
+}
+
+func (s *FileStore) ListDownloadsOn(day string) ([]DownloadCount, error) {
+	if checkName(day) != nil {
+		return nil, nil
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "downloads", day))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var counts []DownloadCount
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		onDay, err := s.readDownloads(day, strings.TrimSuffix(info.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, onDay...)
+	}
+	return counts, nil
+}
+
+func (s *FileStore) GetArchiveContents() (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := readJSON(filepath.Join(s.dir, "archive-contents.json"), &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (s *FileStore) PutArchiveContents(snapshot *Snapshot) error {
+	return writeJSON(filepath.Join(s.dir, "archive-contents.json"), snapshot)
+}
+
+// Transaction serializes f with other transactions in this process.
+// Writes made before f returns an error are not rolled back.
+func (s *FileStore) Transaction(f func(PackageStore) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return f(s)
+}
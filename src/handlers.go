@@ -0,0 +1,562 @@
+// Copyright 2012 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has the HTTP handlers for the archive.  They only talk to
+// a PackageStore, so they can run on App Engine or anywhere else.
+
+package elpa
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Server serves the archive.  Only Store and Templates are required;
+// the other fields let App Engine plug in its own services.
+type Server struct {
+	// Store returns the store to use for a request.
+	Store     func(r *http.Request) PackageStore
+	Templates *template.Template
+
+	// Errorf logs an error for a request.  It defaults to log.Printf.
+	Errorf func(r *http.Request, format string, args ...interface{})
+	// IsAdmin reports whether the user making a request is an admin.
+	// Admins can upload to, and change the owners of, any package.  It
+	// defaults to nobody being an admin.
+	IsAdmin func(r *http.Request) bool
+	// Auth identifies users.  Only logged in users can upload, so if
+	// it is nil the archive is read-only.
+	Auth Authenticator
+	// UploadURL returns the URL the upload form posts to.  It defaults
+	// to /upload.
+	UploadURL func(r *http.Request) (string, error)
+	// ReceiveUpload stores the file posted to /upload as a blob.  It
+	// defaults to streaming the file from a multipart form.  PUTs to
+	// /upload are always handled that way.
+	ReceiveUpload func(r *http.Request, store PackageStore) (*Upload, error)
+	// MaxUploadSize is the largest upload, in bytes, that we accept
+	// directly.  It defaults to defaultMaxUploadSize.
+	MaxUploadSize int64
+	// MaxUnpackedSize is the largest a compressed tar file may be once
+	// decompressed.  It defaults to defaultMaxUnpackedSize.
+	MaxUnpackedSize int64
+	// Signer signs archive-contents and package files.  If it is nil,
+	// nothing is signed.
+	Signer *Signer
+	// Builtins are the Emacs releases, and the packages that come with
+	// them, that dependencies are checked against as well as the
+	// archive.  They default to DefaultBuiltins.
+	Builtins []EmacsRelease
+	// StrictDependencies rejects uploads that require packages that
+	// can't be installed, instead of only warning about them.
+	StrictDependencies bool
+}
+
+// An Upload is a file that has been posted to /upload and stored as a
+// blob.
+type Upload struct {
+	BlobKey string
+	// ContentType and Filename are as given by the uploader, and are
+	// not to be trusted.
+	ContentType string
+	Filename    string
+	Form        url.Values
+	// Signature is the uploader's detached signature of the file, if
+	// they gave one.  For a compressed tar file, it is the signature
+	// of the tar file before it was compressed, since that is what is
+	// served.
+	Signature []byte
+	// Decompressed is set once a compressed tar file has been replaced
+	// by the tar file it held.
+	Decompressed bool
+}
+
+// blobSender is implemented by stores that can serve a blob more
+// efficiently than by copying it through OpenBlob.
+type blobSender interface {
+	SendBlob(w http.ResponseWriter, key string)
+}
+
+// blobHolder is implemented by stores that keep one blob for identical
+// uploads, and so must not delete a blob that a request has stored but
+// not yet referenced.
+type blobHolder interface {
+	holdBlobs() (release func())
+}
+
+// holdBlobs keeps store from deleting blobs until the returned function
+// is called.
+func holdBlobs(store PackageStore) (release func()) {
+	if h, ok := store.(blobHolder); ok {
+		return h.holdBlobs()
+	}
+	return func() {}
+}
+
+// Register adds the archive's handlers to mux.
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/upload", s.upload)
+	mux.HandleFunc("/packages/archive-contents", s.archivecontents)
+	mux.HandleFunc("/packages/archive-contents.sig", s.archiveContentsSignature)
+	mux.HandleFunc("/signing-key.asc", s.publicKey)
+	mux.HandleFunc("/packages/", s.packages)
+	mux.HandleFunc("/upload.html", s.uploadInstructions)
+	mux.HandleFunc("/upload_complete.html", s.uploadComplete)
+	mux.HandleFunc("/versions.html", s.versions)
+	mux.HandleFunc("/package/", s.packagePage)
+	mux.HandleFunc("/search.html", s.searchPage)
+	mux.HandleFunc("/keywords/", s.keywordPages)
+	mux.HandleFunc("/stats.html", s.stats)
+	mux.HandleFunc("/owners.html", s.owners)
+	mux.HandleFunc("/owners", s.changeOwners)
+	mux.HandleFunc("/tokens.html", s.tokens)
+	mux.HandleFunc("/keys.html", s.keys)
+	mux.HandleFunc("/delete.html", s.remove)
+	mux.HandleFunc("/admin/reindex", s.reindex)
+	mux.HandleFunc("/admin/rollup-downloads", s.rollUp)
+	mux.HandleFunc("/api/upload", s.apiUpload)
+	mux.HandleFunc("/api/packages", s.apiPackageList)
+	mux.HandleFunc("/api/packages/", s.apiPackages)
+	mux.HandleFunc("/api/search", s.apiSearch)
+	mux.HandleFunc("/api/downloads", s.apiDownloads)
+	mux.HandleFunc("/", s.main)
+	if h, ok := s.Auth.(loginHandler); ok {
+		h.register(s, mux)
+	} else {
+		mux.HandleFunc("/login", s.login)
+	}
+}
+
+func (s *Server) errorf(r *http.Request, format string, args ...interface{}) {
+	if s.Errorf != nil {
+		s.Errorf(r, format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (s *Server) isAdmin(r *http.Request) bool {
+	return s.IsAdmin != nil && s.IsAdmin(r)
+}
+
+// getPackage fetches a package, writing a 404 or 500 and returning nil
+// if it can't.
+func getPackage(w http.ResponseWriter, r *http.Request, store PackageStore, name string) *Package {
+	p, err := store.GetPackage(name)
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return p
+}
+
+func (s *Server) uploadInstructions(w http.ResponseWriter, r *http.Request) {
+	user := s.requireUser(w, r, "/upload.html")
+	if user == "" {
+		return
+	}
+	uploadURL := "/upload"
+	if s.UploadURL != nil {
+		var err error
+		uploadURL, err = s.UploadURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Users who logged in with a form can log out with one.
+	_, logout := s.Auth.(loginHandler)
+	w.Header().Set("Content-Type", "text/html")
+	templateData := struct {
+		UploadURL string
+		User      string
+		CSRF      string
+		Logout    bool
+	}{uploadURL, user, csrf, logout}
+	err = s.Templates.ExecuteTemplate(w, "upload", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) uploadComplete(w http.ResponseWriter, r *http.Request) {
+	p := getPackage(w, r, s.Store(r), r.FormValue("package"))
+	if p == nil {
+		return
+	}
+	details, err := decodeDetails(&p.Details)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if details.Required == nil {
+		details.Required = make([]PackageRef, 0)
+	}
+	resolutions, err := s.resolveDependencies(s.Store(r), details.Required)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateData := struct {
+		Pkg          *Package
+		Details      *Details
+		Dependencies []Resolution
+	}{p, details, resolutions}
+
+	err = s.Templates.ExecuteTemplate(w, "upload_complete", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Uploads must be a POST or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	store := s.Store(r)
+	// Keep the uploaded blob until its version is saved.
+	defer holdBlobs(store)()
+	receive := s.ReceiveUpload
+	direct := receive == nil || r.Method == "PUT"
+	if direct {
+		receive = s.receiveDirect
+	}
+	var user string
+	if direct {
+		// Nothing is stored for users who haven't logged in.
+		if user = s.requireUser(w, r, "/upload.html"); user == "" {
+			return
+		}
+	}
+	file, err := receive(r, store)
+	if err == errUploadTooLarge {
+		http.Error(w, fmt.Sprintf("%v (%d bytes)", err, s.maxUploadSize()),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if file == nil {
+		s.errorf(r, "No file uploaded")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if !direct {
+		// On App Engine the file has already been stored by the time
+		// we can check who uploaded it.
+		if user = s.requireUser(w, r, "/upload.html"); user == "" {
+			store.DeleteBlob(file.BlobKey)
+			return
+		}
+	}
+	// PUTs can't be made from other sites' forms, so only posts need
+	// the form's CSRF token.
+	if r.Method == "POST" {
+		if err := checkCSRF(r, file.Form.Get(csrfField)); err != nil {
+			store.DeleteBlob(file.BlobKey)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	pkg, err := s.storeUpload(r, store, file, user, s.isAdmin(r), nil)
+	if err != nil {
+		http.Error(w, err.Error(), uploadStatus(err))
+		return
+	}
+	completeURL := "/upload_complete.html?package=" + url.QueryEscape(pkg.Name)
+	if r.Method == "PUT" {
+		w.Header().Set("Location", completeURL)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Uploaded %v %v\n", pkg.Name, pkg.LatestVersion)
+		return
+	}
+	http.Redirect(w, r, completeURL, http.StatusFound)
+}
+
+func (s *Server) versions(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	p := getPackage(w, r, store, r.FormValue("package"))
+	if p == nil {
+		return
+	}
+	versions, err := getVersions(store, p.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dependents, err := store.GetDependents(p.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateData := struct {
+		Pkg        *Package
+		Versions   []VersionInfo
+		Dependents []PackageRef
+	}{p, versionInfos(p, versions), dependents}
+	w.Header().Set("Content-Type", "text/html")
+	err = s.Templates.ExecuteTemplate(w, "versions", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// packagePage serves /package/<name>, everything we know about a
+// package on one page.
+func (s *Server) packagePage(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	name := strings.TrimPrefix(r.URL.Path, "/package/")
+	if strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	p := getPackage(w, r, store, name)
+	if p == nil {
+		return
+	}
+	details, err := decodeDetails(&p.Details)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dependencies, err := s.resolveDependencies(store, details.Required)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	versions, err := getVersions(store, p.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dependents, err := store.GetDependents(p.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	downloads, err := getDownloadStats(store, p.Name, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readme, format := details.Readme, details.ReadmeFormat
+	if readme == "" {
+		readme, format = p.Description, readmeText
+	}
+	templateData := struct {
+		Pkg          *Package
+		Details      *Details
+		Dependencies []Resolution
+		Versions     []VersionInfo
+		Dependents   []PackageRef
+		Readme       template.HTML
+		Downloads    int64
+	}{p, details, dependencies, versionInfos(p, versions), dependents, renderReadme(readme, format),
+		downloads.Total}
+	w.Header().Set("Content-Type", "text/html")
+	err = s.Templates.ExecuteTemplate(w, "package", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// VersionInfo describes an uploaded version, for the version list
+// page and the JSON API.
+type VersionInfo struct {
+	Version    string    `json:"version"`
+	UploadTime time.Time `json:"upload_time"`
+	Type       string    `json:"type"`
+	File       string    `json:"file"`
+	// SignedBy is the fingerprint of the key the uploader signed the
+	// file with, if they did.
+	SignedBy string `json:"signed_by,omitempty"`
+}
+
+func versionInfos(p *Package, versions []*Contents) []VersionInfo {
+	infos := make([]VersionInfo, 0, len(versions))
+	for _, v := range versions {
+		t := v.Type
+		if v.Details == nil {
+			// Versions uploaded before we recorded the type on
+			// Contents.
+			t = p.Type
+		}
+		infos = append(infos, VersionInfo{
+			Version:    v.Version,
+			UploadTime: v.UploadTime,
+			Type:       getType(t),
+			File:       packageFileName(p.Name, v.Version, t),
+			SignedBy:   v.SignedBy,
+		})
+	}
+	return infos
+}
+
+func (s *Server) main(w http.ResponseWriter, r *http.Request) {
+	packages, err := s.Store(r).ListPackages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	err = s.Templates.ExecuteTemplate(w, "main", packages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) archivecontents(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	snapshot, err := s.archiveContentsSnapshot(r, store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.serveSnapshot(w, r, store, snapshot)
+}
+
+// archiveContentsBytes builds archive-contents from the packages in
+// store.
+func (s *Server) archiveContentsBytes(r *http.Request, store PackageStore) ([]byte, error) {
+	packages, err := store.ListPackages()
+	if err != nil {
+		return nil, err
+	}
+	contents, errs := archiveContents(packages)
+	for _, err := range errs {
+		s.errorf(r, "%v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeArchiveContents(&buf, contents); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var readmeRE = regexp.MustCompile("-readme.txt$")
+var nameVersionRE = regexp.MustCompile("^(.+)-(\\d[^-]*)\\.(el|tar)$")
+
+// Serves several package related urls that package.el expects.
+//
+// First are readmes, which are served from
+// /packages/<package-name>-readme.txt.
+//
+// Second are package contents, which exist for all uploaded versions
+// of a packages. They are servered from
+// /packages/<package-name>-<package-version>.el or .tar, depending on
+// the type of that version.  The archive's signatures of them are at
+// the same path with .sig added, and their uploaders' signatures with
+// .asc added.  Downloads of the files themselves are counted.
+func (s *Server) packages(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	w.Header().Set("Content-Type", "text/plain")
+	file := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if readmeRE.MatchString(file) {
+		p := getPackage(w, r, store, file[:strings.LastIndex(file, "-")])
+		if p == nil {
+			return
+		}
+		details, err := decodeDetails(&p.Details)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(details.Readme) == 0 {
+			fmt.Fprintf(w, "%v", p.Description)
+		} else {
+			// These \r's will show up as "^M" in the emacs buffer.
+			// We don't want that, although hopefully package.el will
+			// eventually fix this.
+			fmt.Fprintf(w, "%v", strings.Replace(details.Readme, "\r", "", -1))
+		}
+	} else {
+		var suffix string
+		for _, ext := range []string{".sig", ".asc"} {
+			if strings.HasSuffix(file, ext) {
+				file, suffix = strings.TrimSuffix(file, ext), ext
+			}
+		}
+		parts := nameVersionRE.FindStringSubmatch(file)
+		if len(parts) < 3 {
+			http.Error(w, "Invalid package name: "+file,
+				http.StatusInternalServerError)
+			return
+		}
+		name := parts[1]
+		version, err := ParseVersion(parts[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		contents, err := store.GetVersion(name, version)
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch suffix {
+		case ".sig":
+			s.packageSignature(w, r, store, name, version, contents)
+			return
+		case ".asc":
+			s.uploaderSignature(w, r, contents)
+			return
+		}
+		if r.Method != "HEAD" {
+			s.countDownload(r, store, name, contents.Version)
+		}
+		if sender, ok := store.(blobSender); ok {
+			sender.SendBlob(w, contents.BlobKey)
+			return
+		}
+		blob, err := store.OpenBlob(contents.BlobKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer blob.Close()
+		if _, err := io.Copy(w, blob); err != nil {
+			s.errorf(r, "Failed to send %v: %v", file, err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has uploaders' own signatures.  Users register their
+// OpenPGP public keys, and can then upload a detached signature with a
+// package, which is checked against the keys of the package's owners
+// and served next to the package as <file>.asc.
+
+package elpa
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// A PublicKey is an OpenPGP key a user has registered to sign their
+// uploads with.
+type PublicKey struct {
+	// Fingerprint is the key's fingerprint, in upper case hex.  A key
+	// can only belong to one user, who has shown they hold it by
+	// signing keyChallenge.
+	Fingerprint string
+	User        string
+	// Identity is the first of the key's user IDs, to help tell keys
+	// apart.
+	Identity string
+	// Key is the armored public key.
+	Key   []byte
+	Added time.Time
+}
+
+// ShortID is the last 8 hex digits of the fingerprint, as most OpenPGP
+// tools show it.
+func (k *PublicKey) ShortID() string {
+	return k.Fingerprint[len(k.Fingerprint)-8:]
+}
+
+// readPublicKeys reads the keys in an armored public key block.
+func readPublicKeys(armored string, user string) ([]*PublicKey, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*PublicKey
+	for _, entity := range keyring {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := entity.Serialize(w); err != nil {
+			return nil, err
+		}
+		w.Close()
+		key := &PublicKey{
+			Fingerprint: strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])),
+			User:        user,
+			Key:         buf.Bytes(),
+			Added:       time.Now().UTC(),
+		}
+		for name := range entity.Identities {
+			if key.Identity == "" || name < key.Identity {
+				key.Identity = name
+			}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// keyChallenge is what a user signs to show that they hold the key
+// they are adding, so that no one can claim someone else's key.  It
+// names the user and the archive, so the signature can't be used to
+// add the key for anyone else.
+func keyChallenge(user, host string) string {
+	return fmt.Sprintf("I am %v on %v, and this key is mine.", user, host)
+}
+
+// provenKey returns the one of keys, from the armored block armored,
+// that made sig, an armored signature of challenge.  Signatures made
+// with or without a trailing newline are accepted, since that is easy
+// to get wrong at a shell.
+func provenKey(keys []*PublicKey, armored, challenge, sig string) (*PublicKey, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	var signer *openpgp.Entity
+	for _, signed := range []string{challenge, challenge + "\n"} {
+		if signer, err = openpgp.CheckArmoredDetachedSignature(keyring,
+			strings.NewReader(signed), strings.NewReader(sig)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+	for _, key := range keys {
+		if key.Fingerprint == fingerprint {
+			return key, nil
+		}
+	}
+	return nil, errors.New("the signing key is not in the block")
+}
+
+// ownersKeyring returns the keys registered by all of owners.
+func ownersKeyring(store PackageStore, owners []string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, owner := range owners {
+		keys, err := store.ListKeys(owner)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key.Key))
+			if err != nil {
+				return nil, err
+			}
+			keyring = append(keyring, entities...)
+		}
+	}
+	return keyring, nil
+}
+
+// signatureHeader carries the uploader's signature when the package is
+// the body of the request, base64 encoded.
+const signatureHeader = "X-Package-Signature"
+
+// headerSignature returns the signature sent in signatureHeader, if
+// any.
+func headerSignature(r *http.Request) ([]byte, error) {
+	value := r.Header.Get(signatureHeader)
+	if value == "" {
+		return nil, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, badUpload(errors.New(signatureHeader + " must be base64 encoded: " + err.Error()))
+	}
+	return sig, nil
+}
+
+// checkUploaderSignature checks that sig is a signature of the blob
+// with key made by one of owners, and returns the signature armored,
+// and the fingerprint of the key that made it.  signed describes the
+// blob to the uploader if the signature doesn't match.
+func checkUploaderSignature(store PackageStore, name string, owners []string,
+	key, signed string, sig []byte) ([]byte, string, error) {
+	keyring, err := ownersKeyring(store, owners)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keyring) == 0 {
+		return nil, "", badUpload(errors.New(fmt.Sprintf(
+			"The upload is signed, but no owner of %v has registered a public key", name)))
+	}
+	armored := bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN"))
+	if armored {
+		block, err := armor.Decode(bytes.NewReader(sig))
+		if err != nil {
+			return nil, "", badUpload(errors.New("Could not read the signature: " + err.Error()))
+		}
+		var binary bytes.Buffer
+		if _, err := binary.ReadFrom(block.Body); err != nil {
+			return nil, "", badUpload(errors.New("Could not read the signature: " + err.Error()))
+		}
+		sig = binary.Bytes()
+	}
+	blob, err := store.OpenBlob(key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer blob.Close()
+	signer, err := openpgp.CheckDetachedSignature(keyring, blob, bytes.NewReader(sig))
+	if err != nil {
+		return nil, "", badUpload(errors.New(fmt.Sprintf(
+			"The signature is not a signature of %v by an owner of %v: %v", signed, name, err)))
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.SignatureType, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	w.Write(sig)
+	w.Close()
+	return buf.Bytes(), strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:])), nil
+}
+
+// uploaderSignature serves the signature the uploader of a version
+// gave, if they gave one.
+func (s *Server) uploaderSignature(w http.ResponseWriter, r *http.Request, contents *Contents) {
+	if contents.UploaderSignature == nil {
+		http.NotFound(w, r)
+		return
+	}
+	serveSignature(w, contents.UploaderSignature)
+}
+
+// keys lists the logged in user's public keys, and lets them add and
+// remove them.
+func (s *Server) keys(w http.ResponseWriter, r *http.Request) {
+	user := s.requireUser(w, r, "/keys.html")
+	if user == "" {
+		return
+	}
+	store := s.Store(r)
+	if r.Method == "POST" {
+		if err := checkCSRF(r, r.PostFormValue(csrfField)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if remove := r.FormValue("remove"); remove != "" {
+			key, err := store.GetKey(remove)
+			if err == nil && key.User == user {
+				err = store.DeleteKey(remove)
+			}
+			if err != nil && err != ErrNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/keys.html", http.StatusFound)
+			return
+		}
+		keys, err := readPublicKeys(r.FormValue("key"), user)
+		if err != nil || len(keys) == 0 {
+			http.Error(w, "Could not read an armored public key", http.StatusBadRequest)
+			return
+		}
+		key, err := provenKey(keys, r.FormValue("key"), keyChallenge(user, r.Host), r.FormValue("signature"))
+		if err != nil {
+			http.Error(w, "The signature is not a signature of the statement by the key: "+err.Error(),
+				http.StatusBadRequest)
+			return
+		}
+		existing, err := store.GetKey(key.Fingerprint)
+		if err == nil && existing.User != user {
+			http.Error(w, fmt.Sprintf("Key %v belongs to another user", key.Fingerprint),
+				http.StatusConflict)
+			return
+		} else if err != nil && err != ErrNotFound {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := store.PutKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/keys.html", http.StatusFound)
+		return
+	}
+	keys, err := store.ListKeys(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateData := struct {
+		User      string
+		Keys      []*PublicKey
+		CSRF      string
+		Challenge string
+	}{user, keys, csrf, keyChallenge(user, r.Host)}
+	w.Header().Set("Content-Type", "text/html")
+	err = s.Templates.ExecuteTemplate(w, "keys", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file lets users browse packages by their keywords, which come
+// from a Keywords: header or the :keywords of a -pkg.el file.
+// Keywords are compared ignoring case.
+
+package elpa
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// packageKeywords returns p's keywords, in lower case.
+func packageKeywords(p *Package) []string {
+	if p.Details == nil {
+		return nil
+	}
+	details, err := decodeDetails(&p.Details)
+	if err != nil {
+		return nil
+	}
+	keywords := make([]string, 0, len(details.Keywords))
+	for _, keyword := range details.Keywords {
+		keywords = append(keywords, strings.ToLower(keyword))
+	}
+	return keywords
+}
+
+func hasKeyword(p *Package, keyword string) bool {
+	for _, k := range packageKeywords(p) {
+		if k == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// A KeywordCount is a keyword and how many packages have it.
+type KeywordCount struct {
+	Keyword  string
+	Packages int
+}
+
+type byKeyword []KeywordCount
+
+func (k byKeyword) Len() int           { return len(k) }
+func (k byKeyword) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byKeyword) Less(i, j int) bool { return k[i].Keyword < k[j].Keyword }
+
+// allKeywords returns every keyword a package in the archive has.
+func allKeywords(store PackageStore) ([]KeywordCount, error) {
+	packages, err := store.ListPackages()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, p := range packages {
+		for _, keyword := range packageKeywords(p) {
+			counts[keyword]++
+		}
+	}
+	keywords := make([]KeywordCount, 0, len(counts))
+	for keyword, n := range counts {
+		keywords = append(keywords, KeywordCount{keyword, n})
+	}
+	sort.Sort(byKeyword(keywords))
+	return keywords, nil
+}
+
+// keywordPackages returns the packages with keyword.  Their candidates
+// come from the search index, unless the keyword has no terms that are
+// indexed, when every package is checked.
+func keywordPackages(store PackageStore, keyword string) ([]*Package, error) {
+	keyword = strings.ToLower(keyword)
+	terms := searchTerms(keyword)
+	if len(terms) == 0 {
+		packages, err := store.ListPackages()
+		if err != nil {
+			return nil, err
+		}
+		var matching []*Package
+		for _, p := range packages {
+			if hasKeyword(p, keyword) {
+				matching = append(matching, p)
+			}
+		}
+		return matching, nil
+	}
+	postings, err := store.GetPostings(terms[0])
+	if err != nil {
+		return nil, err
+	}
+	var matching []*Package
+	for _, posting := range postings {
+		if posting.Fields&fieldKeywords == 0 {
+			continue
+		}
+		p, err := store.GetPackage(posting.Name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hasKeyword(p, keyword) {
+			matching = append(matching, p)
+		}
+	}
+	sort.Sort(byName(matching))
+	return matching, nil
+}
+
+// keywordPages serves a list of every keyword at /keywords/, and the
+// packages with a keyword at /keywords/<keyword>.
+func (s *Server) keywordPages(w http.ResponseWriter, r *http.Request) {
+	store := s.Store(r)
+	keyword := strings.TrimPrefix(r.URL.Path, "/keywords/")
+	w.Header().Set("Content-Type", "text/html")
+	if keyword == "" {
+		keywords, err := allKeywords(store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = s.Templates.ExecuteTemplate(w, "keywords", keywords)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	packages, err := keywordPackages(store, keyword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(packages) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	templateData := struct {
+		Keyword  string
+		Packages []*Package
+	}{strings.ToLower(keyword), packages}
+	err = s.Templates.ExecuteTemplate(w, "keyword", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
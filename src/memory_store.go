@@ -0,0 +1,355 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// MemoryStore is a PackageStore that keeps everything in memory.  It
+// is meant for tests.
+type MemoryStore struct {
+	// txMu serializes transactions; mu guards the maps.
+	txMu       sync.Mutex
+	mu         sync.Mutex
+	packages   map[string]Package
+	versions   map[string]map[string]Contents
+	blobs      map[string][]byte
+	nextBlob   int
+	tokens     map[string]APIToken
+	keys       map[string]PublicKey
+	snapshot   *Snapshot
+	dependents map[string][]PackageRef
+	postings   map[string][]Posting
+	downloads  map[string]DownloadCount
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		packages:   make(map[string]Package),
+		versions:   make(map[string]map[string]Contents),
+		blobs:      make(map[string][]byte),
+		tokens:     make(map[string]APIToken),
+		keys:       make(map[string]PublicKey),
+		dependents: make(map[string][]PackageRef),
+		postings:   make(map[string][]Posting),
+		downloads:  make(map[string]DownloadCount),
+	}
+}
+
+func (s *MemoryStore) GetPackage(name string) (*Package, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pkg, ok := s.packages[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &pkg, nil
+}
+
+func (s *MemoryStore) PutPackage(pkg *Package) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packages[pkg.Name] = *pkg
+	return nil
+}
+
+func (s *MemoryStore) ListPackages() ([]*Package, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	packages := make([]*Package, 0, len(s.packages))
+	for _, pkg := range s.packages {
+		p := pkg
+		packages = append(packages, &p)
+	}
+	sort.Sort(byName(packages))
+	return packages, nil
+}
+
+func (s *MemoryStore) DeletePackage(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.packages, name)
+	return nil
+}
+
+func (s *MemoryStore) GetVersion(name string, version Version) (*Contents, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contents, ok := s.versions[name][version.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &contents, nil
+}
+
+func (s *MemoryStore) PutVersion(name string, version Version, contents *Contents) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions[name] == nil {
+		s.versions[name] = make(map[string]Contents)
+	}
+	s.versions[name][version.String()] = *contents
+	return nil
+}
+
+func (s *MemoryStore) ListVersions(name string) ([]*Contents, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := make([]*Contents, 0, len(s.versions[name]))
+	for _, contents := range s.versions[name] {
+		c := contents
+		versions = append(versions, &c)
+	}
+	return versions, nil
+}
+
+func (s *MemoryStore) DeleteVersion(name string, version Version) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.versions[name], version.String())
+	return nil
+}
+
+func (s *MemoryStore) PutBlob(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextBlob++
+	key := strconv.Itoa(s.nextBlob)
+	s.blobs[key] = b
+	return key, nil
+}
+
+func (s *MemoryStore) OpenBlob(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// DeleteBlob removes a blob, unless it is the archive-contents
+// snapshot's.
+func (s *MemoryStore) DeleteBlob(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot != nil && s.snapshot.BlobKey == key {
+		return nil
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryStore) GetToken(hash string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (s *MemoryStore) PutToken(token *APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Hash] = *token
+	return nil
+}
+
+func (s *MemoryStore) ListTokens(user string) ([]*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []*APIToken
+	for _, token := range s.tokens {
+		if token.User == user {
+			t := token
+			tokens = append(tokens, &t)
+		}
+	}
+	sort.Sort(byCreated(tokens))
+	return tokens, nil
+}
+
+func (s *MemoryStore) DeleteToken(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, hash)
+	return nil
+}
+
+func (s *MemoryStore) GetKey(fingerprint string) (*PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[fingerprint]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &key, nil
+}
+
+func (s *MemoryStore) PutKey(key *PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.Fingerprint] = *key
+	return nil
+}
+
+func (s *MemoryStore) ListKeys(user string) ([]*PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []*PublicKey
+	for _, key := range s.keys {
+		if key.User == user {
+			k := key
+			keys = append(keys, &k)
+		}
+	}
+	sort.Sort(byAdded(keys))
+	return keys, nil
+}
+
+func (s *MemoryStore) DeleteKey(fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, fingerprint)
+	return nil
+}
+
+func (s *MemoryStore) GetDependents(name string) ([]PackageRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PackageRef(nil), s.dependents[name]...), nil
+}
+
+func (s *MemoryStore) PutDependents(name string, dependents []PackageRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(dependents) == 0 {
+		delete(s.dependents, name)
+		return nil
+	}
+	s.dependents[name] = append([]PackageRef(nil), dependents...)
+	return nil
+}
+
+func (s *MemoryStore) ListDependents() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.dependents))
+	for name := range s.dependents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemoryStore) GetPostings(term string) ([]Posting, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Posting(nil), s.postings[term]...), nil
+}
+
+func (s *MemoryStore) PutPostings(term string, postings []Posting) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(postings) == 0 {
+		delete(s.postings, term)
+		return nil
+	}
+	s.postings[term] = append([]Posting(nil), postings...)
+	return nil
+}
+
+func (s *MemoryStore) ListTerms() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	terms := make([]string, 0, len(s.postings))
+	for term := range s.postings {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	return terms, nil
+}
+
+func (s *MemoryStore) AddDownloads(count DownloadCount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := count.key()
+	count.Count += s.downloads[key].Count
+	if count.Count == 0 {
+		delete(s.downloads, key)
+		return nil
+	}
+	s.downloads[key] = count
+	return nil
+}
+
+// listDownloads returns the counts matching match.
+func (s *MemoryStore) listDownloads(match func(c *DownloadCount) bool) []DownloadCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts []DownloadCount
+	for _, c := range s.downloads {
+		if match(&c) {
+			counts = append(counts, c)
+		}
+	}
+	sort.Sort(byShard(counts))
+	return counts
+}
+
+func (s *MemoryStore) ListDownloads(name string) ([]DownloadCount, error) {
+	return s.listDownloads(func(c *DownloadCount) bool { return c.Name == name }), nil
+}
+
+func (s *MemoryStore) ListDownloadsOn(day string) ([]DownloadCount, error) {
+	return s.listDownloads(func(c *DownloadCount) bool { return c.Day == day }), nil
+}
+
+func (s *MemoryStore) GetArchiveContents() (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot == nil {
+		return nil, ErrNotFound
+	}
+	snapshot := *s.snapshot
+	return &snapshot, nil
+}
+
+func (s *MemoryStore) PutArchiveContents(snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *snapshot
+	s.snapshot = &stored
+	return nil
+}
+
+func (s *MemoryStore) Transaction(f func(PackageStore) error) error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return f(s)
+}
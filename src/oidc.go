@@ -0,0 +1,392 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file logs users in with an OpenID Connect identity provider,
+// using the authorization code flow.
+
+package elpa
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcStateCookie holds the state of a login while the user is away at
+// the identity provider.
+const oidcStateCookie = "elpa-oidc-state"
+
+// OIDCAuth logs users in with an OpenID Connect provider.  ID tokens
+// signed with RS256 are checked against the provider's public keys,
+// and ones signed with HS256 against the client secret.  Users are
+// known by their email address if the provider has verified it, and
+// otherwise by the issuer and their subject identifier, as in
+// "https://issuer#1234", since anyone could claim an unverified email
+// address.
+type OIDCAuth struct {
+	// Issuer is the provider's issuer identifier, which ID tokens
+	// must match.
+	Issuer string
+	// AuthURL and TokenURL are the provider's authorization and
+	// token endpoints.
+	AuthURL  string
+	TokenURL string
+	// JWKSURL is the provider's JSON Web Key Set, which RS256 ID
+	// tokens are checked against.  Without it, only HS256 ID tokens
+	// are accepted.
+	JWKSURL string
+
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the URL the provider sends users back to.  Its
+	// path is served by us.
+	RedirectURL string
+
+	Sessions *Sessions
+	// Client makes requests to the provider.  It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	mu sync.Mutex
+	// keys are the provider's public keys, by key ID.  They are
+	// fetched again when a token is signed with a key we don't know,
+	// as providers change keys from time to time.
+	keys map[string]*rsa.PublicKey
+}
+
+func (a *OIDCAuth) User(r *http.Request) string {
+	return a.Sessions.User(r)
+}
+
+func (a *OIDCAuth) Login(w http.ResponseWriter, r *http.Request, returnTo string) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(nonce)
+	// The state cookie is signed like a session, so the return path
+	// can't be tampered with.
+	value := state + "." + base64.RawURLEncoding.EncodeToString([]byte(localPath(returnTo)))
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value + "." + a.Sessions.sign(value),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   true,
+		// The provider sends the user back with a top level GET,
+		// which Lax cookies are sent with.
+		SameSite: http.SameSiteLaxMode,
+	})
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.ClientID},
+		"redirect_uri":  {a.RedirectURL},
+		"scope":         {"openid email"},
+		"state":         {state},
+		"nonce":         {state},
+	}
+	sep := "?"
+	if strings.Contains(a.AuthURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, a.AuthURL+sep+params.Encode(), http.StatusFound)
+}
+
+func (a *OIDCAuth) register(s *Server, mux *http.ServeMux) {
+	callback := "/login/callback"
+	if u, err := url.Parse(a.RedirectURL); err == nil && u.Path != "" {
+		callback = u.Path
+	}
+	mux.HandleFunc(callback, func(w http.ResponseWriter, r *http.Request) {
+		user, returnTo, err := a.finishLogin(r)
+		if err != nil {
+			s.errorf(r, "OpenID Connect login failed: %v", err)
+			http.Error(w, "Login failed: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+		a.Sessions.Set(w, user)
+		http.Redirect(w, r, returnTo, http.StatusFound)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		a.Login(w, r, r.FormValue("return"))
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		logout(w, r, a.Sessions)
+	})
+}
+
+// finishLogin handles the provider sending the user back to us,
+// returning who they are and where they were going.
+func (a *OIDCAuth) finishLogin(r *http.Request) (string, string, error) {
+	if e := r.FormValue("error"); e != "" {
+		return "", "", errors.New(e)
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return "", "", errors.New("Login was not started here, or took too long")
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(a.Sessions.sign(parts[0]+"."+parts[1]))) {
+		return "", "", errors.New("Invalid login state")
+	}
+	state := parts[0]
+	if r.FormValue("state") != state {
+		return "", "", errors.New("Login state does not match")
+	}
+	returnTo, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", err
+	}
+	token, err := a.exchangeCode(r.FormValue("code"))
+	if err != nil {
+		return "", "", err
+	}
+	claims, err := a.verifyIDToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	if claims.Nonce != state {
+		return "", "", errors.New("ID token nonce does not match")
+	}
+	if claims.Email != "" && claims.emailVerified() {
+		return claims.Email, localPath(string(returnTo)), nil
+	}
+	return claims.Issuer + "#" + claims.Subject, localPath(string(returnTo)), nil
+}
+
+func (a *OIDCAuth) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return http.DefaultClient
+}
+
+// exchangeCode asks the provider for the ID token for an authorization
+// code.
+func (a *OIDCAuth) exchangeCode(code string) (string, error) {
+	resp, err := a.client().PostForm(a.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.RedirectURL},
+		"client_id":     {a.ClientID},
+		"client_secret": {a.ClientSecret},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.New(fmt.Sprintf("Bad response from token endpoint (%v): %v", resp.Status, err))
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", errors.New(fmt.Sprintf("Token endpoint returned %v %v", resp.Status, token.Error))
+	}
+	return token.IDToken, nil
+}
+
+// idTokenClaims are the claims in an ID token that we use.  The
+// audience may be a string or a list of strings.
+type idTokenClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expires  int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+	Email    string          `json:"email"`
+	// EmailVerified is a boolean, but some providers send it as a
+	// string.
+	EmailVerified json.RawMessage `json:"email_verified"`
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	var verified bool
+	if json.Unmarshal(c.EmailVerified, &verified) == nil {
+		return verified
+	}
+	var s string
+	return json.Unmarshal(c.EmailVerified, &s) == nil && s == "true"
+}
+
+func (c *idTokenClaims) hasAudience(clientID string) bool {
+	var aud string
+	if json.Unmarshal(c.Audience, &aud) == nil {
+		return aud == clientID
+	}
+	var auds []string
+	if json.Unmarshal(c.Audience, &auds) == nil {
+		for _, aud := range auds {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyIDToken checks the signature and claims of an ID token.
+func (a *OIDCAuth) verifyIDToken(token string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed ID token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid ID token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case h.Alg == "HS256":
+		mac := hmac.New(sha256.New, []byte(a.ClientSecret))
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("Invalid ID token signature")
+		}
+	case h.Alg == "RS256" && a.JWKSURL != "":
+		key, err := a.publicKey(h.Kid)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+			return nil, errors.New("Invalid ID token signature")
+		}
+	default:
+		return nil, errors.New("Unsupported ID token algorithm " + h.Alg)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	switch {
+	case claims.Issuer != a.Issuer:
+		return nil, errors.New("ID token is from the wrong issuer " + claims.Issuer)
+	case !claims.hasAudience(a.ClientID):
+		return nil, errors.New("ID token is not for this client")
+	case time.Now().Unix() > claims.Expires:
+		return nil, errors.New("ID token has expired")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// publicKey returns the provider's public key with the given ID.
+func (a *OIDCAuth) publicKey(kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := a.findKey(kid)
+	if key == nil {
+		keys, err := a.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+		key = a.findKey(kid)
+	}
+	if key == nil {
+		return nil, errors.New("ID token is signed with an unknown key " + kid)
+	}
+	return key, nil
+}
+
+// findKey looks for a key we already have.  A token without a key ID
+// can be checked if the provider has only one key.
+func (a *OIDCAuth) findKey(kid string) *rsa.PublicKey {
+	if key, ok := a.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+// fetchKeys reads the RSA signing keys from the provider's JSON Web
+// Key Set.
+func (a *OIDCAuth) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := a.client().Get(a.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("JWKS endpoint returned %v", resp.Status))
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad response from JWKS endpoint: %v", err))
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	}
+	return keys, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has package ownership: only a package's owners can upload
+// new versions of it, or change who its owners are.
+
+package elpa
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NotOwnerError is returned when someone tries to change a package they
+// don't own.
+type NotOwnerError struct {
+	Name string
+	User string
+}
+
+func (e *NotOwnerError) Error() string {
+	return fmt.Sprintf("%v is not an owner of %v", e.User, e.Name)
+}
+
+// isOwner returns true if user is one of p's owners.
+func isOwner(p *Package, user string) bool {
+	for _, owner := range p.Owners {
+		if owner == user {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOwner returns a NotOwnerError unless user may change existing,
+// which is nil for a package that hasn't been uploaded yet.  Packages
+// uploaded before we recorded owners have none, so only admins can
+// change them until an admin adds an owner.
+func checkOwner(existing *Package, user string, admin bool) error {
+	if existing == nil || admin || isOwner(existing, user) {
+		return nil
+	}
+	return &NotOwnerError{existing.Name, user}
+}
+
+// currentUser returns who is making r, or "" if they haven't logged
+// in, or there is no way to log in.
+func (s *Server) currentUser(r *http.Request) string {
+	if s.Auth == nil {
+		return ""
+	}
+	return s.Auth.User(r)
+}
+
+// requireUser returns who is making r.  If they haven't logged in, it
+// asks them to, and returns "".
+func (s *Server) requireUser(w http.ResponseWriter, r *http.Request, returnTo string) string {
+	user := s.currentUser(r)
+	if user != "" {
+		return user
+	}
+	if s.Auth == nil {
+		http.Error(w, "This archive does not allow logging in", http.StatusForbidden)
+		return ""
+	}
+	s.Auth.Login(w, r, returnTo)
+	return ""
+}
+
+// login asks the user to log in, for Authenticators that don't have
+// their own login page, and then sends them to the "return" path.
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	returnTo := localPath(r.FormValue("return"))
+	if s.requireUser(w, r, returnTo) != "" {
+		http.Redirect(w, r, returnTo, http.StatusFound)
+	}
+}
+
+// owners shows who owns a package, and lets its owners change that.
+func (s *Server) owners(w http.ResponseWriter, r *http.Request) {
+	p := getPackage(w, r, s.Store(r), r.FormValue("package"))
+	if p == nil {
+		return
+	}
+	user := s.currentUser(r)
+	canChange := user != "" && checkOwner(p, user, s.isAdmin(r)) == nil
+	var csrf string
+	if canChange {
+		var err error
+		if csrf, err = csrfToken(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	templateData := struct {
+		Pkg       *Package
+		User      string
+		CanChange bool
+		CSRF      string
+	}{p, user, canChange, csrf}
+	w.Header().Set("Content-Type", "text/html")
+	err := s.Templates.ExecuteTemplate(w, "owners", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// changeOwners adds the "add" user to, or removes the "remove" user
+// from, the owners of a package.  A package must always have an owner.
+func (s *Server) changeOwners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Changing owners must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("package")
+	ownersURL := "/owners.html?package=" + url.QueryEscape(name)
+	user := s.requireUser(w, r, ownersURL)
+	if user == "" {
+		return
+	}
+	if err := checkCSRF(r, r.PostFormValue(csrfField)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	add := strings.TrimSpace(r.FormValue("add"))
+	remove := r.FormValue("remove")
+	admin := s.isAdmin(r)
+	err := s.Store(r).Transaction(func(store PackageStore) error {
+		p, err := store.GetPackage(name)
+		if err != nil {
+			return err
+		}
+		if err := checkOwner(p, user, admin); err != nil {
+			return err
+		}
+		if add != "" && !isOwner(p, add) {
+			p.Owners = append(p.Owners, add)
+		}
+		if remove != "" {
+			var owners []string
+			for _, owner := range p.Owners {
+				if owner != remove {
+					owners = append(owners, owner)
+				}
+			}
+			if len(owners) == 0 {
+				return errLastOwner
+			}
+			p.Owners = owners
+		}
+		return store.PutPackage(p)
+	})
+	if _, ok := err.(*NotOwnerError); ok {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch err {
+	case nil:
+		http.Redirect(w, r, ownersURL, http.StatusFound)
+	case ErrNotFound:
+		http.NotFound(w, r)
+	case errLastOwner:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var errLastOwner = errors.New("A package must have at least one owner")
@@ -0,0 +1,84 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file renders READMEs for the web UI.  package.el is always
+// sent them as they were uploaded.
+
+package elpa
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/niklasfasching/go-org/org"
+	"github.com/yuin/goldmark"
+)
+
+// The formats a README can be in.  READMEs without a format are plain
+// text.
+const (
+	readmeText     = "text"
+	readmeOrg      = "org"
+	readmeMarkdown = "markdown"
+)
+
+// readmeFiles are the READMEs we look for in tar files, most preferred
+// first.
+var readmeFiles = []struct {
+	Name   string
+	Format string
+}{
+	{"README.org", readmeOrg},
+	{"README.md", readmeMarkdown},
+	{"README", readmeText},
+	{"README.txt", readmeText},
+}
+
+// readmeRank returns how preferred a file named name is as the
+// README, with 0 the most preferred, and -1 if it isn't one.
+func readmeRank(name string) int {
+	for i, f := range readmeFiles {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+var readmePolicy = bluemonday.UGCPolicy()
+
+// renderReadme renders a README as sanitized HTML.  If it can't be
+// rendered in its format it is shown as plain text.
+func renderReadme(readme, format string) template.HTML {
+	var rendered string
+	switch format {
+	case readmeOrg:
+		doc := org.New().Parse(strings.NewReader(readme), "")
+		if out, err := doc.Write(org.NewHTMLWriter()); err == nil {
+			rendered = out
+		}
+	case readmeMarkdown:
+		var buf bytes.Buffer
+		if err := goldmark.Convert([]byte(readme), &buf); err == nil {
+			rendered = buf.String()
+		}
+	}
+	if rendered == "" {
+		rendered = "<pre>" + html.EscapeString(readme) + "</pre>"
+	}
+	return template.HTML(readmePolicy.Sanitize(rendered))
+}
@@ -0,0 +1,357 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file searches packages by the words in their names,
+// descriptions, keywords, authors and READMEs.  The search index maps
+// each word to the packages that have it, and is updated as packages
+// are uploaded and deleted.
+
+package elpa
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The fields of a package a term can be in.  Higher fields rank a
+// package higher when they match.
+const (
+	fieldReadme = 1 << iota
+	fieldAuthor
+	fieldDescription
+	fieldKeywords
+	fieldName
+)
+
+// A Posting says which fields of the named package have a term.
+type Posting struct {
+	Name   string `json:"name"`
+	Fields int    `json:"fields"`
+}
+
+type byPostingName []Posting
+
+func (p byPostingName) Len() int           { return len(p) }
+func (p byPostingName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPostingName) Less(i, j int) bool { return p[i].Name < p[j].Name }
+
+// maxTermLength is the longest term we index.  Longer words are
+// unlikely to be searched for.
+const maxTermLength = 64
+
+// stopWords are too common to be worth indexing.
+var stopWords = func() map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.Fields(`
+		an and are as at be but by can for from has have if in into is
+		it its no not of on or so such that the their then there these
+		they this to was will with you your`) {
+		words[word] = true
+	}
+	return words
+}()
+
+// maxPackageTerms is the most terms a package is indexed under, so
+// that a long README can't make an upload update thousands of terms.
+// Terms outside the README are always indexed.
+const maxPackageTerms = 500
+
+// searchTerms splits text into lower case words of two or more letters
+// and digits, leaving out stop words.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) >= 2 && len(word) <= maxTermLength && !stopWords[word] {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// packageTerms returns the terms p is indexed under, and which of its
+// fields each is in.
+func packageTerms(p *Package) map[string]int {
+	if p == nil {
+		return nil
+	}
+	terms := make(map[string]int)
+	add := func(text string, field int) {
+		for _, term := range searchTerms(text) {
+			terms[term] |= field
+		}
+	}
+	add(p.Name, fieldName)
+	add(p.Description, fieldDescription)
+	add(p.Author, fieldAuthor)
+	details, err := decodeDetails(&p.Details)
+	if p.Details == nil || err != nil {
+		return terms
+	}
+	for _, keyword := range details.Keywords {
+		add(keyword, fieldKeywords)
+	}
+	for _, author := range details.Authors {
+		add(author.Name, fieldAuthor)
+	}
+	if details.Maintainer != nil {
+		add(details.Maintainer.Name, fieldAuthor)
+	}
+	// The README's first words are the likeliest to say what the
+	// package is for.
+	for _, term := range searchTerms(details.Readme) {
+		if _, ok := terms[term]; !ok && len(terms) >= maxPackageTerms {
+			continue
+		}
+		terms[term] |= fieldReadme
+	}
+	return terms
+}
+
+// termsPerTransaction is how many terms' postings are updated in one
+// transaction.  App Engine's cross-group transactions can use at most
+// 25 entity groups, and each term is one.
+const termsPerTransaction = 20
+
+// updateSearchIndex records that the named package now has terms,
+// where it used to have previous.  Like updateDependents, failures are
+// only logged.
+func (s *Server) updateSearchIndex(r *http.Request, store PackageStore, name string, previous, terms map[string]int) {
+	changed := make(map[string]int)
+	for term, fields := range previous {
+		if terms[term] != fields {
+			changed[term] = terms[term]
+		}
+	}
+	for term, fields := range terms {
+		if _, ok := previous[term]; !ok {
+			changed[term] = fields
+		}
+	}
+	batch := make([]string, 0, len(changed))
+	for term := range changed {
+		batch = append(batch, term)
+	}
+	sort.Strings(batch)
+	for len(batch) > 0 {
+		n := termsPerTransaction
+		if n > len(batch) {
+			n = len(batch)
+		}
+		s.updatePostings(r, store, batch[:n], name, changed)
+		batch = batch[n:]
+	}
+}
+
+// updatePostings sets the fields the named package has each of terms
+// in, with no fields removing it, in one transaction.
+func (s *Server) updatePostings(r *http.Request, store PackageStore, terms []string, name string, fields map[string]int) {
+	err := store.Transaction(func(store PackageStore) error {
+		for _, term := range terms {
+			postings, err := store.GetPostings(term)
+			if err != nil {
+				return err
+			}
+			var updated []Posting
+			for _, p := range postings {
+				if p.Name != name {
+					updated = append(updated, p)
+				}
+			}
+			if fields[term] != 0 {
+				updated = append(updated, Posting{Name: name, Fields: fields[term]})
+			}
+			sort.Sort(byPostingName(updated))
+			if err := store.PutPostings(term, updated); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.errorf(r, "Failed to update the search index for %q to %q: %v", terms[0], terms[len(terms)-1], err)
+	}
+}
+
+// rebuildSearchIndex builds the index from scratch, for archives with
+// packages uploaded before it was kept.
+func rebuildSearchIndex(store PackageStore) error {
+	packages, err := store.ListPackages()
+	if err != nil {
+		return err
+	}
+	index := make(map[string][]Posting)
+	for _, p := range packages {
+		for term, fields := range packageTerms(p) {
+			index[term] = append(index[term], Posting{Name: p.Name, Fields: fields})
+		}
+	}
+	old, err := store.ListTerms()
+	if err != nil {
+		return err
+	}
+	for _, term := range old {
+		if _, ok := index[term]; !ok {
+			if err := store.PutPostings(term, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for term, postings := range index {
+		sort.Sort(byPostingName(postings))
+		if err := store.PutPostings(term, postings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxSearchResults is the most packages a search returns.
+const maxSearchResults = 100
+
+// A SearchResult is a package that matched a search.  Score is higher
+// the more important the fields that matched.
+type SearchResult struct {
+	Package PackageJSON `json:"package"`
+	Score   int         `json:"score"`
+	// NameMatch is true if every term of the query is in the name.
+	NameMatch bool `json:"name_match"`
+}
+
+type byRank []SearchResult
+
+func (r byRank) Len() int      { return len(r) }
+func (r byRank) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRank) Less(i, j int) bool {
+	if r[i].NameMatch != r[j].NameMatch {
+		return r[i].NameMatch
+	}
+	if r[i].Score != r[j].Score {
+		return r[i].Score > r[j].Score
+	}
+	return r[i].Package.Name < r[j].Package.Name
+}
+
+var errEmptyQuery = errors.New("Search for at least one word of two or more letters, other than common words like \"the\"")
+
+// search finds the packages that have every term in query, with
+// packages whose names match first.
+func search(store PackageStore, query string) ([]SearchResult, error) {
+	terms := make(map[string]bool)
+	for _, term := range searchTerms(query) {
+		terms[term] = true
+	}
+	if len(terms) == 0 {
+		return nil, errEmptyQuery
+	}
+	type match struct {
+		terms, score int
+		name         bool
+	}
+	matches := make(map[string]*match)
+	first := true
+	for term := range terms {
+		postings, err := store.GetPostings(term)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range postings {
+			m := matches[p.Name]
+			if m == nil {
+				if !first {
+					continue
+				}
+				m = &match{name: true}
+				matches[p.Name] = m
+			}
+			m.terms++
+			m.score += p.Fields
+			m.name = m.name && p.Fields&fieldName != 0
+		}
+		first = false
+	}
+	exact := strings.TrimSpace(query)
+	results := make([]SearchResult, 0)
+	for name, m := range matches {
+		if m.terms < len(terms) {
+			continue
+		}
+		p, err := store.GetPackage(name)
+		if err == ErrNotFound {
+			// Deleted since it was indexed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		score := m.score
+		if strings.EqualFold(name, exact) {
+			score += 2 * fieldName
+		}
+		results = append(results, SearchResult{packageJSON(p), score, m.name})
+	}
+	sort.Sort(byRank(results))
+	if len(results) > maxSearchResults {
+		results = results[:maxSearchResults]
+	}
+	return results, nil
+}
+
+// searchPage serves /search.html, the results of searching for the "q"
+// form value.
+func (s *Server) searchPage(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	var results []SearchResult
+	var message string
+	if strings.TrimSpace(query) != "" {
+		var err error
+		results, err = search(s.Store(r), query)
+		if err == errEmptyQuery {
+			message = err.Error()
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	templateData := struct {
+		Query   string
+		Results []SearchResult
+		Message string
+	}{query, results, message}
+	w.Header().Set("Content-Type", "text/html")
+	err := s.Templates.ExecuteTemplate(w, "search", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// apiSearch serves /api/search, the results of searching for the "q"
+// query parameter as JSON.
+func (s *Server) apiSearch(w http.ResponseWriter, r *http.Request) {
+	results, err := search(s.Store(r), r.FormValue("q"))
+	if err == errEmptyQuery {
+		s.apiError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		s.apiError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.serveJSON(w, r, http.StatusOK, results)
+}
@@ -12,87 +12,695 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// This file implements a simplified sexp parser, suitable for reading
-// package definitions.
+// This file implements an Emacs Lisp reader, suitable for reading
+// package definitions and any other metadata we need from uploaded
+// packages.  It reads text into a tree of typed nodes, following the
+// syntax described in the "Lisp Data Types" chapter of the Emacs Lisp
+// manual.
 
 package elpa
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
+// Sexp is a node in the tree returned by the reader.  It is one of
+// *List, Vector, Symbol, String, Integer, Float or Char.
+type Sexp interface {
+	sexp()
+}
+
+// List is a chain of cons cells.  Elems holds the cars of the chain.
+// Dotted is the cdr of the last cell, which is nil for a proper list
+// and set for forms such as (a . b).  The empty list reads as the
+// symbol nil, just as it does in Emacs.
+type List struct {
+	Elems  []Sexp
+	Dotted Sexp
+}
+
+type Vector []Sexp
+type Symbol string
+type String string
+type Integer int64
+type Float float64
+
+// Char is a character literal such as ?a or ?\C-x.  Modifier bits are
+// kept in the value, as in Emacs.
+type Char rune
+
+func (*List) sexp()   {}
+func (Vector) sexp()  {}
+func (Symbol) sexp()  {}
+func (String) sexp()  {}
+func (Integer) sexp() {}
+func (Float) sexp()   {}
+func (Char) sexp()    {}
+
+const nilSymbol Symbol = "nil"
+
+// Reader macros expand to two-element lists headed by these symbols,
+// the same way the Emacs reader expands them.
 const (
-	OPEN_PAREN = iota
-	CLOSE_PAREN
-	SYMBOL
-	STRING
-	EOF
+	quoteSymbol      Symbol = "quote"
+	functionSymbol   Symbol = "function"
+	backquoteSymbol  Symbol = "`"
+	commaSymbol      Symbol = ","
+	commaSplicSymbol Symbol = ",@"
 )
 
-type Token struct {
-	Type      int
-	StringVal string
-}
+// Modifier bits for character literals, from src/lisp.h in Emacs.
+const (
+	charAlt   = 0x0400000
+	charSuper = 0x0800000
+	charHyper = 0x1000000
+	charShift = 0x2000000
+	charCtl   = 0x4000000
+	charMeta  = 0x8000000
+)
 
 var packageDefinitionString string = "define-package"
 
-func parseSimpleSexp(cin chan int, cout chan *Token, cquit chan bool) {
-	parenCount := 0
-	endActions := map[int]func(){}
+var integerRE = regexp.MustCompile(`^[+-]?[0-9]+\.?$`)
+var floatRE = regexp.MustCompile(`^[+-]?(([0-9]*\.[0-9]+|[0-9]+\.?)(e[+-]?[0-9]+)?|[0-9]+(\.[0-9]*)?e\+(INF|NaN))$`)
+
+// errCloseParen is returned internally when a closing delimiter is
+// found where a form was expected.
+var errCloseParen = errors.New("unexpected ')'")
+var errCloseBracket = errors.New("unexpected ']'")
+var errDot = errors.New("unexpected '.'")
+
+// maxSexpDepth is how deeply forms and character escapes may nest.
+// Reading recurses, so without a limit a long run of "(" would
+// overflow the stack, which can't be recovered from.
+const maxSexpDepth = 100
+
+// SexpReader reads successive forms from an underlying reader.
+type SexpReader struct {
+	r     *bufio.Reader
+	line  int
+	depth int
+}
+
+func NewSexpReader(r io.Reader) *SexpReader {
+	return &SexpReader{r: bufio.NewReader(r), line: 1}
+}
+
+// Read returns the next form.  It returns io.EOF if there are no more
+// forms, and io.ErrUnexpectedEOF if the input ends inside a form.
+func (sr *SexpReader) Read() (Sexp, error) {
+	s, err := sr.read()
+	switch err {
+	case nil, io.EOF:
+		return s, err
+	case errCloseParen, errCloseBracket, errDot:
+		return nil, sr.errorf("%v", err)
+	}
+	return nil, err
+}
+
+// readSexp reads exactly one form from a string, and fails if there is
+// anything other than whitespace or comments after it.
+func readSexp(s string) (Sexp, error) {
+	sr := NewSexpReader(strings.NewReader(s))
+	form, err := sr.Read()
+	if err == io.EOF {
+		return nil, errors.New("No form found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sr.Read(); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, sr.errorf("unexpected text after form")
+	}
+	return form, nil
+}
+
+func (sr *SexpReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", sr.line, fmt.Sprintf(format, args...))
+}
+
+func (sr *SexpReader) readRune() (rune, error) {
+	r, _, err := sr.r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if r == '\n' {
+		sr.line++
+	}
+	return r, nil
+}
+
+func (sr *SexpReader) unreadRune(r rune) {
+	sr.r.UnreadRune()
+	if r == '\n' {
+		sr.line--
+	}
+}
+
+// mustReadRune is readRune for places where the input is not allowed
+// to end.
+func (sr *SexpReader) mustReadRune() (rune, error) {
+	r, err := sr.readRune()
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return r, err
+}
+
+// skipSpace skips whitespace and comments, returning the first rune
+// of the next token.
+func (sr *SexpReader) skipSpace() (rune, error) {
 	for {
-		var b int
-		select {
-		case b = <-cin:
-			// Proceed...
-		case <-cquit:
-			// Got quit signal, return.
-			cout <- &Token{Type: EOF}
-			return
+		r, err := sr.readRune()
+		if err != nil {
+			return 0, err
 		}
 		switch {
-		case b == '\'':
-			cout <- &Token{Type: OPEN_PAREN}
-			cout <- &Token{Type: SYMBOL, StringVal: "quote"}
-			endActions[parenCount] = func() { cout <- &Token{Type: CLOSE_PAREN} }
-			parenCount++
-		case b == '(':
-			cout <- &Token{Type: OPEN_PAREN}
-			parenCount++
-		case b == ')':
-			cout <- &Token{Type: CLOSE_PAREN}
-			if action, ok := endActions[parenCount]; ok {
-				action()
-				delete(endActions, parenCount)
-			}
-			parenCount--
-		case (b >= 'A' && b <= 'Z') ||
-			(b >= 'a' && b <= 'z') ||
-			b == '-':
-			sym := make([]byte, 1)
-			sym[0] = byte(b)
-			for {
-				b = <-cin
-				if b == ' ' || b == '\n' {
-					// We've reached the end of the symbol
-					break
+		case r == ';':
+			for r != '\n' {
+				if r, err = sr.readRune(); err != nil {
+					return 0, err
 				}
-				sym = append(sym, byte(b))
 			}
-			cout <- &Token{Type: SYMBOL, StringVal: strings.ToLower(string(sym))}
-		case b == '"':
-			s := make([]byte, 0)
-			for {
-				b = <-cin
-				if b == '"' {
-					// We've reached the end of the string
-					break
-				}
-				if b == '\\' {
-					b = <-cin
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f':
+			// Keep going.
+		default:
+			return r, nil
+		}
+	}
+}
+
+// enter is called on the way into each level of nesting, and returns
+// an error if there are too many.  The caller must call leave.
+func (sr *SexpReader) enter() error {
+	sr.depth++
+	if sr.depth > maxSexpDepth {
+		return sr.errorf("nested more than %d deep", maxSexpDepth)
+	}
+	return nil
+}
+
+func (sr *SexpReader) leave() {
+	sr.depth--
+}
+
+func (sr *SexpReader) read() (Sexp, error) {
+	defer sr.leave()
+	if err := sr.enter(); err != nil {
+		return nil, err
+	}
+	r, err := sr.skipSpace()
+	if err != nil {
+		return nil, err
+	}
+	switch r {
+	case '(':
+		return sr.readList()
+	case ')':
+		return nil, errCloseParen
+	case '[':
+		return sr.readVector()
+	case ']':
+		return nil, errCloseBracket
+	case '"':
+		return sr.readString()
+	case '?':
+		return sr.readChar()
+	case '\'':
+		return sr.readQuoted(quoteSymbol)
+	case '`':
+		return sr.readQuoted(backquoteSymbol)
+	case ',':
+		next, err := sr.mustReadRune()
+		if err != nil {
+			return nil, err
+		}
+		if next == '@' {
+			return sr.readQuoted(commaSplicSymbol)
+		}
+		sr.unreadRune(next)
+		return sr.readQuoted(commaSymbol)
+	case '#':
+		return sr.readHash()
+	}
+	sr.unreadRune(r)
+	return sr.readAtom()
+}
+
+func (sr *SexpReader) readQuoted(sym Symbol) (Sexp, error) {
+	form, err := sr.read()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &List{Elems: []Sexp{sym, form}}, nil
+}
+
+func (sr *SexpReader) readList() (Sexp, error) {
+	list := &List{}
+	for {
+		form, err := sr.read()
+		switch err {
+		case nil:
+			list.Elems = append(list.Elems, form)
+			continue
+		case errCloseParen:
+			if len(list.Elems) == 0 {
+				return nilSymbol, nil
+			}
+			return list, nil
+		case errDot:
+			if len(list.Elems) == 0 {
+				return nil, sr.errorf("'.' at start of list")
+			}
+			if list.Dotted, err = sr.read(); err != nil {
+				if err == io.EOF {
+					return nil, io.ErrUnexpectedEOF
 				}
-				s = append(s, byte(b))
+				return nil, sr.errorf("bad dotted pair: %v", err)
 			}
-			cout <- &Token{Type: STRING, StringVal: string(s)}
+			if _, err = sr.read(); err != errCloseParen {
+				return nil, sr.errorf("expected ')' after dotted pair")
+			}
+			return list, nil
+		case io.EOF:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (sr *SexpReader) readVector() (Sexp, error) {
+	vec := Vector{}
+	for {
+		form, err := sr.read()
+		switch err {
+		case nil:
+			vec = append(vec, form)
+		case errCloseBracket:
+			return vec, nil
+		case io.EOF:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (sr *SexpReader) readString() (Sexp, error) {
+	var s []rune
+	for {
+		r, err := sr.mustReadRune()
+		if err != nil {
+			return nil, err
+		}
+		switch r {
+		case '"':
+			return String(s), nil
+		case '\\':
+			r, err = sr.mustReadRune()
+			if err != nil {
+				return nil, err
+			}
+			// A backslash-newline or backslash-space is ignored inside
+			// strings.
+			if r == '\n' || r == ' ' {
+				continue
+			}
+			c, err := sr.readEscape(r, true)
+			if err != nil {
+				return nil, err
+			}
+			// Modifiers cannot be represented in a string, except meta
+			// on ASCII, which Emacs also strips when it does not make a
+			// unibyte string.
+			s = append(s, c&^(charMeta|charShift|charAlt|charSuper|charHyper))
+		default:
+			s = append(s, r)
+		}
+	}
+}
+
+func (sr *SexpReader) readChar() (Sexp, error) {
+	r, err := sr.mustReadRune()
+	if err != nil {
+		return nil, err
+	}
+	if r == '\\' {
+		if r, err = sr.mustReadRune(); err != nil {
+			return nil, err
+		}
+		c, err := sr.readEscape(r, false)
+		if err != nil {
+			return nil, err
+		}
+		return Char(c), nil
+	}
+	return Char(r), nil
+}
+
+// readEscape decodes the escape sequence whose first character after
+// the backslash is r.
+func (sr *SexpReader) readEscape(r rune, inString bool) (rune, error) {
+	switch r {
+	case 'a':
+		return 7, nil
+	case 'b':
+		return '\b', nil
+	case 'd':
+		return 127, nil
+	case 'e':
+		return 27, nil
+	case 'f':
+		return '\f', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'v':
+		return '\v', nil
+	case 'x':
+		return sr.readCodepoint(16, 1, 0)
+	case 'u':
+		return sr.readCodepoint(16, 4, 4)
+	case 'U':
+		return sr.readCodepoint(16, 8, 8)
+	case 'N':
+		return sr.readNamedChar()
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		sr.unreadRune(r)
+		return sr.readCodepoint(8, 1, 3)
+	case '^':
+		c, err := sr.readModified()
+		if err != nil {
+			return 0, err
+		}
+		return control(c), nil
+	case 's':
+		if inString {
+			// In strings, "\s" is always a space.
+			return ' ', nil
+		}
+		fallthrough
+	case 'C', 'M', 'S', 'H', 'A':
+		next, err := sr.readRune()
+		if err != nil || next != '-' {
+			if err == nil {
+				sr.unreadRune(next)
+			}
+			if r == 's' {
+				return ' ', nil
+			}
+			return r, nil
+		}
+		c, err := sr.readModified()
+		if err != nil {
+			return 0, err
+		}
+		switch r {
+		case 'C':
+			return control(c), nil
+		case 'M':
+			return c | charMeta, nil
+		case 'S':
+			return c | charShift, nil
+		case 'H':
+			return c | charHyper, nil
+		case 'A':
+			return c | charAlt, nil
+		case 's':
+			return c | charSuper, nil
+		}
+	}
+	return r, nil
+}
+
+// readModified reads the character following a modifier prefix such
+// as \C- or \^, which may itself be an escape sequence.
+func (sr *SexpReader) readModified() (rune, error) {
+	defer sr.leave()
+	if err := sr.enter(); err != nil {
+		return 0, err
+	}
+	r, err := sr.mustReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if r == '\\' {
+		if r, err = sr.mustReadRune(); err != nil {
+			return 0, err
+		}
+		return sr.readEscape(r, false)
+	}
+	return r, nil
+}
+
+// control applies the control modifier the way Emacs does: ASCII
+// letters and @[\]^_ map onto the control characters, ? maps onto DEL,
+// and everything else gets the control bit.
+func control(c rune) rune {
+	mods := c & (charMeta | charShift | charAlt | charSuper | charHyper)
+	base := c &^ mods
+	switch {
+	case base == '?':
+		return 127 | mods
+	case base >= '@' && base <= '_':
+		return (base - '@') | mods
+	case base >= 'a' && base <= 'z':
+		return (base - 'a' + 1) | mods
+	}
+	return c | charCtl
+}
+
+// readCodepoint reads between min and max digits in the given base,
+// where a max of zero means there is no upper limit.
+func (sr *SexpReader) readCodepoint(base, min, max int) (rune, error) {
+	var digits []rune
+	for max == 0 || len(digits) < max {
+		r, err := sr.readRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !isDigit(r, base) {
+			sr.unreadRune(r)
+			break
+		}
+		digits = append(digits, r)
+	}
+	if len(digits) < min {
+		return 0, sr.errorf("malformed character escape")
+	}
+	n, err := strconv.ParseInt(string(digits), base, 32)
+	if err != nil || n > 0x3FFFFF {
+		return 0, sr.errorf("character escape out of range: %s", string(digits))
+	}
+	return rune(n), nil
+}
+
+// readNamedChar reads the {U+XXXX} form of a \N escape.  Character
+// names from the Unicode database are not supported.
+func (sr *SexpReader) readNamedChar() (rune, error) {
+	var name []rune
+	r, err := sr.mustReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if r != '{' {
+		return 0, sr.errorf("expected '{' after \\N")
+	}
+	for {
+		if r, err = sr.mustReadRune(); err != nil {
+			return 0, err
+		}
+		if r == '}' {
+			break
+		}
+		name = append(name, r)
+	}
+	if len(name) > 2 && name[0] == 'U' && name[1] == '+' {
+		n, err := strconv.ParseInt(string(name[2:]), 16, 32)
+		if err == nil && n <= utf8.MaxRune {
+			return rune(n), nil
+		}
+	}
+	return 0, sr.errorf("unsupported character name: %s", string(name))
+}
+
+func isDigit(r rune, base int) bool {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r-'0') < base
+	case r >= 'a' && r <= 'z':
+		return int(r-'a'+10) < base
+	case r >= 'A' && r <= 'Z':
+		return int(r-'A'+10) < base
+	}
+	return false
+}
+
+// isDelimiter returns true for characters that end a symbol or number.
+func isDelimiter(r rune) bool {
+	switch r {
+	case ' ', '\t', '\n', '\r', '\f', '(', ')', '[', ']', '"', '\'', ';', '`', ',':
+		return true
+	}
+	return false
+}
+
+// readToken reads the text of a symbol or number.  The second return
+// value is true if any character was escaped with a backslash, in
+// which case the token is always a symbol.
+func (sr *SexpReader) readToken() (string, bool, error) {
+	var tok []rune
+	escaped := false
+	for {
+		r, err := sr.readRune()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if isDelimiter(r) {
+			sr.unreadRune(r)
+			break
+		}
+		if r == '\\' {
+			if r, err = sr.mustReadRune(); err != nil {
+				return "", false, err
+			}
+			escaped = true
+		}
+		tok = append(tok, r)
+	}
+	return string(tok), escaped, nil
+}
+
+func (sr *SexpReader) readAtom() (Sexp, error) {
+	tok, escaped, err := sr.readToken()
+	if err != nil {
+		return nil, err
+	}
+	if escaped {
+		return Symbol(tok), nil
+	}
+	if tok == "." {
+		return nil, errDot
+	}
+	if integerRE.MatchString(tok) {
+		n, err := strconv.ParseInt(strings.TrimSuffix(tok, "."), 10, 64)
+		if err != nil {
+			return nil, sr.errorf("integer out of range: %s", tok)
+		}
+		return Integer(n), nil
+	}
+	if floatRE.MatchString(tok) {
+		return parseFloat(tok), nil
+	}
+	return Symbol(tok), nil
+}
+
+func parseFloat(tok string) Float {
+	switch {
+	case strings.HasSuffix(tok, "e+INF"):
+		if strings.HasPrefix(tok, "-") {
+			return Float(math.Inf(-1))
+		}
+		return Float(math.Inf(1))
+	case strings.HasSuffix(tok, "e+NaN"):
+		return Float(math.NaN())
+	}
+	f, _ := strconv.ParseFloat(tok, 64)
+	return Float(f)
+}
+
+// readHash handles the forms that start with '#'.
+func (sr *SexpReader) readHash() (Sexp, error) {
+	r, err := sr.mustReadRune()
+	if err != nil {
+		return nil, err
+	}
+	switch r {
+	case '\'':
+		return sr.readQuoted(functionSymbol)
+	case ':':
+		// Uninterned symbols are read as plain symbols.
+		return sr.readAtom()
+	case '#':
+		return Symbol(""), nil
+	case 'x', 'X':
+		return sr.readRadix(16)
+	case 'o', 'O':
+		return sr.readRadix(8)
+	case 'b', 'B':
+		return sr.readRadix(2)
+	}
+	if r >= '0' && r <= '9' {
+		digits := []rune{r}
+		for {
+			if r, err = sr.mustReadRune(); err != nil {
+				return nil, err
+			}
+			if r < '0' || r > '9' {
+				break
+			}
+			digits = append(digits, r)
+		}
+		if r == 'r' {
+			base, _ := strconv.Atoi(string(digits))
+			if base < 2 || base > 36 {
+				return nil, sr.errorf("invalid radix %d", base)
+			}
+			return sr.readRadix(base)
+		}
+	}
+	return nil, sr.errorf("unsupported syntax: #%c", r)
+}
+
+func (sr *SexpReader) readRadix(base int) (Sexp, error) {
+	tok, _, err := sr.readToken()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(tok, base, 64)
+	if err != nil {
+		return nil, sr.errorf("invalid base %d integer: %s", base, tok)
+	}
+	return Integer(n), nil
+}
+
+// isNil returns true if the form reads as nil.
+func isNil(s Sexp) bool {
+	sym, ok := s.(Symbol)
+	return ok && sym == nilSymbol
+}
+
+// unquote strips a (quote ...) wrapper from a form, if present.
+func unquote(s Sexp) Sexp {
+	if list, ok := s.(*List); ok && list.Dotted == nil && len(list.Elems) == 2 {
+		if sym, ok := list.Elems[0].(Symbol); ok && sym == quoteSymbol {
+			return list.Elems[1]
 		}
 	}
+	return s
 }
@@ -0,0 +1,162 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file implements a printer for the nodes produced by the reader
+// in sexp.go.  Everything it prints reads back as the same tree, both
+// with our reader and with Emacs's, so all elisp we serve should be
+// built as a tree and printed here rather than assembled from strings.
+
+package elpa
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// printSexp writes the printed representation of s to w.
+func printSexp(w io.Writer, s Sexp) error {
+	bw := bufio.NewWriter(w)
+	writeSexp(bw, s)
+	return bw.Flush()
+}
+
+// sexpString returns the printed representation of s.
+func sexpString(s Sexp) string {
+	var b strings.Builder
+	printSexp(&b, s)
+	return b.String()
+}
+
+func writeSexp(w *bufio.Writer, s Sexp) {
+	switch v := s.(type) {
+	case nil:
+		w.WriteString(string(nilSymbol))
+	case *List:
+		if len(v.Elems) == 0 {
+			writeSexp(w, v.Dotted)
+			return
+		}
+		w.WriteByte('(')
+		for i, elem := range v.Elems {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			writeSexp(w, elem)
+		}
+		// A list in the cdr of the last cell continues this list, so
+		// (a . (b c)) prints as (a b c).
+		tail := v.Dotted
+		for {
+			next, ok := tail.(*List)
+			if !ok || len(next.Elems) == 0 {
+				break
+			}
+			for _, elem := range next.Elems {
+				w.WriteByte(' ')
+				writeSexp(w, elem)
+			}
+			tail = next.Dotted
+		}
+		if tail != nil && !isNil(tail) {
+			w.WriteString(" . ")
+			writeSexp(w, tail)
+		}
+		w.WriteByte(')')
+	case Vector:
+		w.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			writeSexp(w, elem)
+		}
+		w.WriteByte(']')
+	case Symbol:
+		writeSymbol(w, string(v))
+	case String:
+		writeString(w, string(v))
+	case Integer:
+		w.WriteString(strconv.FormatInt(int64(v), 10))
+	case Float:
+		w.WriteString(formatFloat(float64(v)))
+	case Char:
+		// Emacs prints characters as integers, so we do the same.
+		w.WriteString(strconv.FormatInt(int64(v), 10))
+	}
+}
+
+func writeString(w *bufio.Writer, s string) {
+	w.WriteByte('"')
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			w.WriteByte('\\')
+		}
+		w.WriteRune(r)
+	}
+	w.WriteByte('"')
+}
+
+// writeSymbol escapes any character that would otherwise end the
+// symbol or make it read as something else.
+func writeSymbol(w *bufio.Writer, s string) {
+	if len(s) == 0 {
+		w.WriteString("##")
+		return
+	}
+	// Symbols that would read as numbers, or as the dot of a dotted
+	// pair, need their first character escaped.
+	if integerRE.MatchString(s) || floatRE.MatchString(s) || s == "." {
+		w.WriteByte('\\')
+	}
+	for i, r := range s {
+		if isDelimiter(r) || r == '\\' || ((r == '?' || r == '#') && i == 0) {
+			w.WriteByte('\\')
+		}
+		w.WriteRune(r)
+	}
+}
+
+// formatFloat formats f so that it reads back as a float, using the
+// same syntax as Emacs for infinities and NaN.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "1.0e+INF"
+	case math.IsInf(f, -1):
+		return "-1.0e+INF"
+	case math.IsNaN(f):
+		return "0.0e+NaN"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// Helpers for building trees to print.
+
+func sexpList(elems ...Sexp) Sexp {
+	if len(elems) == 0 {
+		return nilSymbol
+	}
+	return &List{Elems: elems}
+}
+
+func sexpCons(car, cdr Sexp) Sexp {
+	return &List{Elems: []Sexp{car}, Dotted: cdr}
+}
@@ -0,0 +1,171 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file signs archive-contents and package files, so that
+// package.el can check them when package-check-signature is set.
+// package.el looks for the signature of a file at the file's URL with
+// ".sig" added.
+
+package elpa
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// A Signer makes detached OpenPGP signatures with the archive's key.
+type Signer struct {
+	entity *openpgp.Entity
+}
+
+// NewSigner reads the archive's private key, armored or not.  If the
+// key is encrypted, passphrase decrypts it.
+func NewSigner(r io.Reader, passphrase []byte) (*Signer, error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(buf.Bytes()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, err
+			}
+		}
+		return &Signer{entity}, nil
+	}
+	return nil, errors.New("No private key found to sign with")
+}
+
+// Sign returns an armored detached signature of the contents of r.
+func (s *Signer) Sign(r io.Reader) ([]byte, error) {
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, s.entity, r, nil); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
+// WritePublicKey writes the armored public key that signatures can be
+// checked with.
+func (s *Signer) WritePublicKey(w io.Writer) error {
+	aw, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.entity.Serialize(aw); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// signBlob signs an uploaded file.
+func (s *Server) signBlob(store PackageStore, key string) ([]byte, error) {
+	blob, err := store.OpenBlob(key)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return s.Signer.Sign(blob)
+}
+
+func serveSignature(w http.ResponseWriter, sig []byte) {
+	w.Header().Set("Content-Type", "application/pgp-signature")
+	w.Write(sig)
+}
+
+// archiveContentsSignature serves /packages/archive-contents.sig.
+func (s *Server) archiveContentsSignature(w http.ResponseWriter, r *http.Request) {
+	if s.Signer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	store := s.Store(r)
+	snapshot, err := s.archiveContentsSnapshot(r, store)
+	if err == nil && snapshot.Signature == nil {
+		// The snapshot was made before the archive had a key.
+		snapshot, err = s.updateArchiveContents(r, store)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveSignature(w, snapshot.Signature)
+}
+
+// packageSignature serves the signature of a version of a package.
+// Versions uploaded before the archive had a key are signed the first
+// time their signature is asked for.
+func (s *Server) packageSignature(w http.ResponseWriter, r *http.Request, store PackageStore,
+	name string, version Version, contents *Contents) {
+	if s.Signer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if contents.Signature == nil {
+		sig, err := s.signBlob(store, contents.BlobKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := saveSignature(store, name, version, contents.BlobKey, sig); err != nil {
+			s.errorf(r, "Failed to save the signature of %v %v: %v", name, contents.Version, err)
+		}
+		contents.Signature = sig
+	}
+	serveSignature(w, contents.Signature)
+}
+
+// saveSignature saves sig as the signature of a version, unless the
+// version has been uploaded again since blobKey was signed.
+func saveSignature(store PackageStore, name string, version Version, blobKey string, sig []byte) error {
+	return store.Transaction(func(store PackageStore) error {
+		contents, err := store.GetVersion(name, version)
+		if err != nil {
+			return err
+		}
+		if contents.BlobKey != blobKey || contents.Signature != nil {
+			return nil
+		}
+		contents.Signature = sig
+		return store.PutVersion(name, version, contents)
+	})
+}
+
+// publicKey serves the key that signatures can be checked with, to be
+// imported into package-gnupghome-dir.
+func (s *Server) publicKey(w http.ResponseWriter, r *http.Request) {
+	if s.Signer == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pgp-keys")
+	if err := s.Signer.WritePublicKey(w); err != nil {
+		s.errorf(r, "Failed to write the public key: %v", err)
+	}
+}
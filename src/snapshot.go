@@ -0,0 +1,170 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file keeps archive-contents as a stored snapshot.  Every Emacs
+// that uses the archive fetches archive-contents on each refresh, but
+// it only changes when a package does, so it is built once after each
+// change instead of on every request.
+
+package elpa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A Snapshot is a stored copy of archive-contents.  The blob it points
+// to is never changed; a new snapshot is stored with a new blob.
+type Snapshot struct {
+	BlobKey string
+	// ETag is the SHA-256 of the contents, in hex.
+	ETag string
+	// Generated is when the packages in the snapshot were listed, and
+	// Modified is when its contents last changed.
+	Generated time.Time
+	Modified  time.Time
+	// Signature is the archive's signature of the contents, if the
+	// archive has a signing key.
+	Signature []byte
+}
+
+// updateArchiveContents stores a new snapshot of archive-contents.  It
+// must be called after anything that changes archive-contents.
+func (s *Server) updateArchiveContents(r *http.Request, store PackageStore) (*Snapshot, error) {
+	defer holdBlobs(store)()
+	generated := time.Now().UTC()
+	contents, err := s.archiveContentsBytes(r, store)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(contents)
+	snapshot := &Snapshot{
+		ETag:      hex.EncodeToString(sum[:]),
+		Generated: generated,
+		Modified:  generated,
+	}
+	if s.Signer != nil {
+		if snapshot.Signature, err = s.Signer.Sign(bytes.NewReader(contents)); err != nil {
+			return nil, err
+		}
+	}
+	if snapshot.BlobKey, err = store.PutBlob(bytes.NewReader(contents)); err != nil {
+		return nil, err
+	}
+	// Another request may have listed the packages after we did, and
+	// stored its snapshot first; if so, it is the newer one.
+	var unused string
+	err = store.Transaction(func(store PackageStore) error {
+		current, err := store.GetArchiveContents()
+		if err == ErrNotFound {
+			return store.PutArchiveContents(snapshot)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case current.Generated.After(generated):
+			unused, snapshot = snapshot.BlobKey, current
+			return nil
+		case current.ETag == snapshot.ETag:
+			snapshot.Modified = current.Modified
+		}
+		unused = current.BlobKey
+		return store.PutArchiveContents(snapshot)
+	})
+	if err != nil {
+		store.DeleteBlob(snapshot.BlobKey)
+		return nil, err
+	}
+	// The file store keeps blobs by their contents, so an unchanged
+	// snapshot may share its blob with the one it replaces.
+	if unused != "" && unused != snapshot.BlobKey {
+		if err := store.DeleteBlob(unused); err != nil {
+			s.errorf(r, "Failed to delete old archive-contents: %v", err)
+		}
+	}
+	return snapshot, nil
+}
+
+// archiveChanged updates the snapshot after a change that has already
+// been saved, so a failure is only logged.  The next change will try
+// again.
+func (s *Server) archiveChanged(r *http.Request, store PackageStore) {
+	if _, err := s.updateArchiveContents(r, store); err != nil {
+		s.errorf(r, "Failed to update archive-contents: %v", err)
+	}
+}
+
+// archiveContentsSnapshot returns the current snapshot, making the
+// first one if there isn't one yet.
+func (s *Server) archiveContentsSnapshot(r *http.Request, store PackageStore) (*Snapshot, error) {
+	snapshot, err := store.GetArchiveContents()
+	if err == ErrNotFound {
+		return s.updateArchiveContents(r, store)
+	}
+	return snapshot, err
+}
+
+// notModified returns true if the client making r already has the
+// version of a resource with the given ETag and modification time.
+// As in RFC 7232, If-None-Match takes precedence over
+// If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// serveSnapshot serves a stored snapshot, or tells the client that the
+// one it has is current.
+func (s *Server) serveSnapshot(w http.ResponseWriter, r *http.Request, store PackageStore, snapshot *Snapshot) {
+	etag := `"` + snapshot.ETag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", snapshot.Modified.UTC().Format(http.TimeFormat))
+	if notModified(r, etag, snapshot.Modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method == "HEAD" {
+		return
+	}
+	if sender, ok := store.(blobSender); ok {
+		sender.SendBlob(w, snapshot.BlobKey)
+		return
+	}
+	blob, err := store.OpenBlob(snapshot.BlobKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+	io.Copy(w, blob)
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file defines the storage interface the handlers use, so that
+// the archive can run on App Engine, on local disk, or in memory for
+// tests.
+
+package elpa
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// ErrNotFound is returned by a PackageStore when the requested package,
+// version or blob does not exist.
+var ErrNotFound = errors.New("Not found")
+
+// Contents is a single uploaded version of a package, stored as a child
+// of the Package.  Every version is kept, so that users can install
+// any version that was ever uploaded.
+type Contents struct {
+	BlobKey    string
+	Version    string
+	UploadTime time.Time
+	Type       PackageType
+	Details    []byte
+	// Description and Author are the package's as of this version, so
+	// they can be restored if a newer version is yanked.
+	Description string
+	Author      string
+	// Signature is the archive's detached signature of the blob, if
+	// it has been signed.
+	Signature []byte
+	// UploaderSignature is the armored signature the uploader gave,
+	// and SignedBy the fingerprint of the key that made it.
+	UploaderSignature []byte
+	SignedBy          string
+}
+
+// PackageStore holds packages, their versions, and the uploaded files
+// (blobs) for each version.
+type PackageStore interface {
+	GetPackage(name string) (*Package, error)
+	PutPackage(pkg *Package) error
+	ListPackages() ([]*Package, error)
+	// DeletePackage deletes a package, but not its versions.
+	DeletePackage(name string) error
+
+	// Versions are stored under their normalized form, so that a
+	// version can be found however its number was written.
+	GetVersion(name string, version Version) (*Contents, error)
+	PutVersion(name string, version Version, contents *Contents) error
+	ListVersions(name string) ([]*Contents, error)
+	// DeleteVersion deletes a version, but not its blob.
+	DeleteVersion(name string, version Version) error
+
+	// PutBlob stores the contents of r and returns a key that can be
+	// used to open it later.
+	PutBlob(r io.Reader) (string, error)
+	OpenBlob(key string) (io.ReadCloser, error)
+	DeleteBlob(key string) error
+
+	// API tokens are stored by the hash of the token, so that the
+	// tokens themselves are never stored.
+	GetToken(hash string) (*APIToken, error)
+	PutToken(token *APIToken) error
+	ListTokens(user string) ([]*APIToken, error)
+	DeleteToken(hash string) error
+
+	// Users' public keys are stored by their fingerprints.
+	GetKey(fingerprint string) (*PublicKey, error)
+	PutKey(key *PublicKey) error
+	ListKeys(user string) ([]*PublicKey, error)
+	DeleteKey(fingerprint string) error
+
+	// GetDependents returns the packages that require name, or nil if
+	// there are none.  PutDependents replaces them.  ListDependents
+	// returns every name that has dependents.
+	GetDependents(name string) ([]PackageRef, error)
+	PutDependents(name string, dependents []PackageRef) error
+	ListDependents() ([]string, error)
+
+	// GetPostings returns the packages that have a search term, or nil
+	// if none do.  PutPostings replaces them.  ListTerms returns every
+	// term that has postings.
+	GetPostings(term string) ([]Posting, error)
+	PutPostings(term string, postings []Posting) error
+	ListTerms() ([]string, error)
+
+	// Downloads are counted for each version each day, in shards.
+	// AddDownloads adds count.Count to the shard count is for, which
+	// is removed if that leaves it at zero.  ListDownloads returns
+	// every shard of a package's counts, and ListDownloadsOn every
+	// shard of the counts for a day.
+	AddDownloads(count DownloadCount) error
+	ListDownloads(name string) ([]DownloadCount, error)
+	ListDownloadsOn(day string) ([]DownloadCount, error)
+
+	// There is one archive-contents snapshot, which is replaced each
+	// time the packages change.
+	GetArchiveContents() (*Snapshot, error)
+	PutArchiveContents(snapshot *Snapshot) error
+
+	// Transaction runs f so that the reads and writes it makes
+	// through the store it is passed are not interleaved with any
+	// other transaction.
+	Transaction(f func(PackageStore) error) error
+}
+
+// getVersions returns every uploaded version of the named package,
+// newest first.
+func getVersions(store PackageStore, name string) ([]*Contents, error) {
+	versions, err := store.ListVersions(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byUploadTime(versions))
+	return versions, nil
+}
+
+type byUploadTime []*Contents
+
+func (v byUploadTime) Len() int           { return len(v) }
+func (v byUploadTime) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byUploadTime) Less(i, j int) bool { return v[i].UploadTime.After(v[j].UploadTime) }
+
+type byCreated []*APIToken
+
+func (t byCreated) Len() int           { return len(t) }
+func (t byCreated) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byCreated) Less(i, j int) bool { return t[i].Created.Before(t[j].Created) }
+
+type byAdded []*PublicKey
+
+func (k byAdded) Len() int           { return len(k) }
+func (k byAdded) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byAdded) Less(i, j int) bool { return k[i].Added.Before(k[j].Added) }
+
+type byName []*Package
+
+func (p byName) Len() int           { return len(p) }
+func (p byName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byName) Less(i, j int) bool { return p[i].Name < p[j].Name }
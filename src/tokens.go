@@ -0,0 +1,168 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file has API tokens, which let scripts such as CI jobs upload
+// packages without a browser.
+
+package elpa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// An APIToken lets a script upload packages as a user, without the
+// user's password.  Each token can only upload the packages it names.
+type APIToken struct {
+	// Hash is the SHA-256 of the token, in hex.  The token itself is
+	// only shown to the user when it is created.
+	Hash        string
+	User        string
+	Description string
+	Packages    []string
+	Created     time.Time
+}
+
+// ID identifies a token to its user without giving the token away.
+func (t *APIToken) ID() string {
+	return t.Hash[:12]
+}
+
+// tokenPrefix starts every token, to make them easy to recognize, for
+// instance by secret scanners.
+const tokenPrefix = "elpa_"
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken makes a new random token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var errNoToken = errors.New("An API token is required, as \"Authorization: Bearer <token>\"")
+var errBadToken = errors.New("Unknown or revoked API token")
+
+// requestToken returns the token r was made with.
+func requestToken(store PackageStore, r *http.Request) (*APIToken, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return nil, errNoToken
+	}
+	token, err := store.GetToken(hashToken(strings.TrimSpace(auth[7:])))
+	if err == ErrNotFound {
+		return nil, errBadToken
+	}
+	return token, err
+}
+
+// listSeparatorRE splits lists separated by commas, spaces or both.
+var listSeparatorRE = regexp.MustCompile("[\\s,]+")
+
+// tokens lists the logged in user's tokens, and lets them create and
+// revoke them.  A new token is shown only once, on the page returned
+// when it is created.
+func (s *Server) tokens(w http.ResponseWriter, r *http.Request) {
+	user := s.requireUser(w, r, "/tokens.html")
+	if user == "" {
+		return
+	}
+	store := s.Store(r)
+	var created string
+	if r.Method == "POST" {
+		if err := checkCSRF(r, r.PostFormValue(csrfField)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if revoke := r.FormValue("revoke"); revoke != "" {
+			if err := s.revokeToken(store, user, revoke); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/tokens.html", http.StatusFound)
+			return
+		}
+		packages := listSeparatorRE.Split(strings.TrimSpace(r.FormValue("packages")), -1)
+		if len(packages) == 0 || packages[0] == "" {
+			http.Error(w, "A token must be for at least one package", http.StatusBadRequest)
+			return
+		}
+		var err error
+		created, err = newToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = store.PutToken(&APIToken{
+			Hash:        hashToken(created),
+			User:        user,
+			Description: r.FormValue("description"),
+			Packages:    packages,
+			Created:     time.Now().UTC(),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	tokens, err := store.ListTokens(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	csrf, err := csrfToken(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	templateData := struct {
+		User    string
+		Tokens  []*APIToken
+		Created string
+		CSRF    string
+	}{user, tokens, created, csrf}
+	w.Header().Set("Content-Type", "text/html")
+	err = s.Templates.ExecuteTemplate(w, "tokens", templateData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeToken deletes the token of user's with the given ID.
+func (s *Server) revokeToken(store PackageStore, user, id string) error {
+	tokens, err := store.ListTokens(user)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.ID() == id {
+			return store.DeleteToken(token.Hash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,648 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file receives uploaded files without the App Engine blobstore,
+// streaming them straight into the PackageStore.
+
+package elpa
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// defaultMaxUploadSize is used when Server.MaxUploadSize is not set.
+const defaultMaxUploadSize = 32 << 20
+
+// defaultMaxUnpackedSize is used when Server.MaxUnpackedSize is not
+// set.
+const defaultMaxUnpackedSize = 128 << 20
+
+var errUploadTooLarge = errors.New("Upload is larger than the maximum allowed size")
+var errUnpackedTooLarge = errors.New("Upload is larger than the maximum allowed size once decompressed")
+
+// limitedReader is like io.LimitedReader, but returns err instead of
+// io.EOF when the limit is passed.
+type limitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, l.err
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+func (s *Server) maxUploadSize() int64 {
+	if s.MaxUploadSize > 0 {
+		return s.MaxUploadSize
+	}
+	return defaultMaxUploadSize
+}
+
+func (s *Server) maxUnpackedSize() int64 {
+	if s.MaxUnpackedSize > 0 {
+		return s.MaxUnpackedSize
+	}
+	return defaultMaxUnpackedSize
+}
+
+// receiveDirect stores an upload sent straight to us, either as a
+// multipart/form-data POST with the file in the "file" field and its
+// signature, if any, in the "signature" field, or as the raw body of a
+// PUT.  For a PUT, form values such as "force" and "filename" are taken
+// from the query string.
+func (s *Server) receiveDirect(r *http.Request, store PackageStore) (*Upload, error) {
+	if r.Method == "PUT" {
+		return s.receiveBody(r, store)
+	}
+	body := &limitedReader{r: r.Body, n: s.maxUploadSize(), err: errUploadTooLarge}
+	r.Body = ioutil.NopCloser(body)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	var upload *Upload
+	var signature []byte
+	form := url.Values{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if upload != nil {
+				store.DeleteBlob(upload.BlobKey)
+			}
+			return nil, err
+		}
+		if part.FormName() == "file" && upload == nil {
+			key, err := store.PutBlob(part)
+			if err != nil {
+				return nil, err
+			}
+			upload = &Upload{
+				BlobKey:     key,
+				ContentType: part.Header.Get("Content-Type"),
+				Filename:    part.FileName(),
+			}
+			continue
+		}
+		// Other fields are small, but are still counted against the
+		// limit on the whole request.
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			if upload != nil {
+				store.DeleteBlob(upload.BlobKey)
+			}
+			return nil, err
+		}
+		if part.FormName() == "signature" {
+			signature = value
+			continue
+		}
+		form.Add(part.FormName(), string(value))
+	}
+	if upload != nil {
+		upload.Form = form
+		if len(signature) > 0 {
+			upload.Signature = signature
+		}
+	}
+	return upload, nil
+}
+
+// The formats that sniffContentType recognizes.
+const (
+	tarContentType   = "application/x-tar"
+	elispContentType = "text/x-emacs-lisp"
+)
+
+// compressedFormats are the compressions a tar file can be uploaded
+// with.  suffixes are the file names a compressed tar file may have.
+var compressedFormats = []struct {
+	contentType string
+	magic       string
+	suffixes    []string
+	newReader   func(io.Reader) (io.Reader, error)
+}{
+	{"application/gzip", "\x1f\x8b", []string{".tar.gz", ".tgz"},
+		func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	{"application/x-bzip2", "BZh", []string{".tar.bz2", ".tbz2", ".tbz"},
+		func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }},
+	{"application/x-xz", "\xfd7zXZ\x00", []string{".tar.xz", ".txz"},
+		newXZReader},
+}
+
+// maxXZDictionary is the largest dictionary an xz upload may use.  The
+// xz reader allocates the dictionary each block's header asks for, up
+// to 4 GiB, however small the file.
+const maxXZDictionary = 64 << 20
+
+// newXZReader reads the first stream of an xz file, after checking that
+// none of its blocks need a dictionary larger than maxXZDictionary.
+func newXZReader(r io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkXZDictionaries(data); err != nil {
+		return nil, err
+	}
+	return xz.ReaderConfig{SingleStream: true}.NewReader(bytes.NewReader(data))
+}
+
+var errBadXZ = errors.New("Invalid xz file")
+
+// checkXZDictionaries walks the blocks of the first stream of an xz
+// file, skipping the LZMA2 chunks in each, and returns an error if any
+// block's LZMA2 filter asks for a dictionary larger than
+// maxXZDictionary.  It also refuses anything it can't walk, since the
+// blocks after it would go unchecked.
+func checkXZDictionaries(data []byte) error {
+	const streamHeaderLen = 12
+	if len(data) < streamHeaderLen {
+		return errBadXZ
+	}
+	var checkLen int
+	switch data[7] & 0x0f {
+	case 0x00:
+		checkLen = 0
+	case 0x01:
+		checkLen = 4
+	case 0x04:
+		checkLen = 8
+	case 0x0a:
+		checkLen = 32
+	default:
+		return errBadXZ
+	}
+	p := streamHeaderLen
+	for {
+		if p >= len(data) {
+			return errBadXZ
+		}
+		if data[p] == 0 {
+			// The index follows the last block.
+			return nil
+		}
+		headerLen := (int(data[p]) + 1) * 4
+		if p+headerLen > len(data) {
+			return errBadXZ
+		}
+		if err := checkXZBlockHeader(data[p : p+headerLen]); err != nil {
+			return err
+		}
+		start := p
+		p += headerLen
+	chunks:
+		for {
+			if p >= len(data) {
+				return errBadXZ
+			}
+			switch control := data[p]; {
+			case control == 0x00:
+				p++
+				break chunks
+			case control == 0x01 || control == 0x02:
+				// Uncompressed chunk.
+				if p+3 > len(data) {
+					return errBadXZ
+				}
+				p += 3 + (int(data[p+1])<<8 | int(data[p+2])) + 1
+			case control >= 0x80:
+				// LZMA chunk, with new properties from 0xc0.
+				if p+5 > len(data) {
+					return errBadXZ
+				}
+				size := (int(data[p+3])<<8 | int(data[p+4])) + 1
+				p += 5 + size
+				if control >= 0xc0 {
+					p++
+				}
+			default:
+				return errBadXZ
+			}
+		}
+		p += (4-(p-start)%4)%4 + checkLen
+	}
+}
+
+// checkXZBlockHeader checks the filters in an xz block header.
+func checkXZBlockHeader(header []byte) error {
+	const lzma2Filter = 0x21
+	varint := func(p int) (uint64, int, error) {
+		var n uint64
+		for i := 0; i < 9 && p < len(header); i++ {
+			b := header[p]
+			p++
+			n |= uint64(b&0x7f) << (7 * uint(i))
+			if b&0x80 == 0 {
+				return n, p, nil
+			}
+		}
+		return 0, p, errBadXZ
+	}
+	if len(header) < 2 {
+		return errBadXZ
+	}
+	flags := header[1]
+	p := 2
+	var err error
+	for _, present := range []bool{flags&0x40 != 0, flags&0x80 != 0} {
+		if present {
+			if _, p, err = varint(p); err != nil {
+				return err
+			}
+		}
+	}
+	for i := 0; i <= int(flags&0x03); i++ {
+		var id, propsLen uint64
+		if id, p, err = varint(p); err != nil {
+			return err
+		}
+		if propsLen, p, err = varint(p); err != nil {
+			return err
+		}
+		if propsLen > uint64(len(header)-p) {
+			return errBadXZ
+		}
+		if id == lzma2Filter && propsLen == 1 {
+			size, err := lzma.DecodeDictCap(header[p])
+			if err != nil {
+				return errBadXZ
+			}
+			if size > maxXZDictionary {
+				return fmt.Errorf("The xz dictionary (%d bytes) is larger than the maximum allowed size (%d bytes)", size, maxXZDictionary)
+			}
+		}
+		p += int(propsLen)
+	}
+	return nil
+}
+
+// isCompressed returns true if contentType is one of compressedFormats.
+func isCompressed(contentType string) bool {
+	for _, format := range compressedFormats {
+		if format.contentType == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// receiveBody stores the body of r as an upload, taking form values
+// from the query string, and the signature from signatureHeader.
+func (s *Server) receiveBody(r *http.Request, store PackageStore) (*Upload, error) {
+	signature, err := headerSignature(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.PutBlob(&limitedReader{r: r.Body, n: s.maxUploadSize(), err: errUploadTooLarge})
+	if err != nil {
+		return nil, err
+	}
+	form := r.URL.Query()
+	return &Upload{
+		BlobKey:     key,
+		ContentType: r.Header.Get("Content-Type"),
+		Filename:    form.Get("filename"),
+		Form:        form,
+		Signature:   signature,
+	}, nil
+}
+
+// sniffContentType works out what kind of file an upload is from its
+// first bytes and its file name, rather than trusting the Content-Type
+// the browser sent, which is often wrong or missing.  filename may be
+// empty.  It returns an error describing the problem if the upload is
+// not a tar, compressed tar, or Emacs Lisp file.
+func sniffContentType(r *bufio.Reader, filename string) (string, error) {
+	head, _ := r.Peek(512)
+	if len(head) == 0 {
+		return "", errors.New("The uploaded file is empty")
+	}
+	filename = strings.ToLower(filename)
+	if len(head) >= 262 && string(head[257:262]) == "ustar" {
+		return tarContentType, nil
+	}
+	for _, format := range compressedFormats {
+		if !bytes.HasPrefix(head, []byte(format.magic)) {
+			continue
+		}
+		// Only complain about names with the wrong extension; whether
+		// it really holds a tar file is checked once decompressed.
+		if strings.Contains(filename, ".") && !hasAnySuffix(filename, format.suffixes) {
+			return "", errors.New(fmt.Sprintf(
+				"%v is compressed, but only compressed tar files (%v) can be uploaded",
+				filename, strings.Join(format.suffixes, ", ")))
+		}
+		return format.contentType, nil
+	}
+	detected := http.DetectContentType(head)
+	if !strings.HasPrefix(detected, "text/plain") {
+		return "", errors.New(fmt.Sprintf(
+			"Unrecognized file format %v: upload an Emacs Lisp file or a tar file", detected))
+	}
+	if strings.HasSuffix(filename, ".tar") {
+		return "", errors.New(fmt.Sprintf(
+			"%v is named like a tar file, but is not a tar archive", filename))
+	}
+	if strings.HasSuffix(filename, ".el") ||
+		bytes.HasPrefix(bytes.TrimLeft(head, " \t\r\n"), []byte(";")) {
+		return elispContentType, nil
+	}
+	return "", errors.New(
+		"Unrecognized file format: text files must be Emacs Lisp, with a name ending in .el or starting with a ;;; header line")
+}
+
+// decompressUpload stores the decompressed contents of a compressed tar
+// file as a new blob, and returns its key, since package.el can only
+// install plain tar files.  It gives up with errUnpackedTooLarge if the
+// decompressed file would be larger than MaxUnpackedSize, so that a
+// small upload can't fill the store.
+func (s *Server) decompressUpload(store PackageStore, contentType string, r io.Reader) (string, error) {
+	for _, format := range compressedFormats {
+		if format.contentType != contentType {
+			continue
+		}
+		zr, err := format.newReader(r)
+		if err != nil {
+			return "", err
+		}
+		return store.PutBlob(&limitedReader{r: zr, n: s.maxUnpackedSize(), err: errUnpackedTooLarge})
+	}
+	return "", errors.New("Unknown compression " + contentType)
+}
+
+// An uploadError is a reason an upload was refused, with the HTTP
+// status to report it with.
+type uploadError struct {
+	status int
+	err    error
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+func badUpload(err error) error {
+	return &uploadError{http.StatusBadRequest, err}
+}
+
+// uploadStatus returns the HTTP status to report an error from
+// storeUpload with.
+func uploadStatus(err error) int {
+	if err == errUploadTooLarge || err == errUnpackedTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	switch e := err.(type) {
+	case *uploadError:
+		return e.status
+	case *VersionConflictError:
+		return http.StatusConflict
+	case *NotOwnerError:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// storeUpload parses an uploaded file, and saves it as a new version of
+// its package on behalf of user.  If scope isn't nil, only the packages
+// it names can be uploaded.  If the upload is refused the uploaded blob
+// is deleted.
+func (s *Server) storeUpload(r *http.Request, store PackageStore, file *Upload,
+	user string, admin bool, scope []string) (*Package, error) {
+	pkg, err := s.parseUpload(store, file)
+	if err != nil {
+		store.DeleteBlob(file.BlobKey)
+		return nil, err
+	}
+	if scope != nil && !containsString(scope, pkg.Name) {
+		store.DeleteBlob(file.BlobKey)
+		return nil, &uploadError{http.StatusForbidden,
+			errors.New(fmt.Sprintf("Not allowed to upload %v", pkg.Name))}
+	}
+	version, err := ParseVersion(pkg.LatestVersion)
+	if err != nil {
+		store.DeleteBlob(file.BlobKey)
+		return nil, badUpload(err)
+	}
+	if err := s.checkDependencies(store, pkg); err != nil {
+		store.DeleteBlob(file.BlobKey)
+		return nil, err
+	}
+	var uploaderSignature []byte
+	var signedBy string
+	if file.Signature != nil {
+		owners := []string{user}
+		existing, err := store.GetPackage(pkg.Name)
+		if err == nil {
+			owners = existing.Owners
+		} else if err != ErrNotFound {
+			store.DeleteBlob(file.BlobKey)
+			return nil, err
+		}
+		signed := "this file"
+		if file.Decompressed {
+			signed = "the uncompressed tar file"
+		}
+		uploaderSignature, signedBy, err = checkUploaderSignature(store, pkg.Name, owners,
+			file.BlobKey, signed, file.Signature)
+		if err != nil {
+			store.DeleteBlob(file.BlobKey)
+			return nil, err
+		}
+	}
+	var signature []byte
+	if s.Signer != nil {
+		// If this fails the file is signed when its signature is
+		// first asked for.
+		if signature, err = s.signBlob(store, file.BlobKey); err != nil {
+			s.errorf(r, "Failed to sign %v %v: %v", pkg.Name, pkg.LatestVersion, err)
+		}
+	}
+	// Admins can replace an existing version, or roll back to an older
+	// one, by checking "force" on the upload form.
+	override := file.Form.Get("force") != "" && admin
+	var replacedBlob string
+	var previous []PackageRef
+	var previousTerms map[string]int
+	err = store.Transaction(func(store PackageStore) error {
+		var current string
+		pkg.Owners = []string{user}
+		existing, err := store.GetPackage(pkg.Name)
+		if err == nil {
+			current = existing.LatestVersion
+			pkg.Owners = existing.Owners
+			previous = requiredBy(existing.Details)
+			previousTerms = packageTerms(existing)
+		} else if err != ErrNotFound {
+			return err
+		}
+		if err := checkOwner(existing, user, admin); err != nil {
+			return err
+		}
+		err = checkNewVersion(pkg.Name, current, pkg.LatestVersion, override)
+		if err != nil {
+			return err
+		}
+		old, err := store.GetVersion(pkg.Name, version)
+		if err == nil {
+			replacedBlob = old.BlobKey
+		} else if err != ErrNotFound {
+			return err
+		}
+		err = store.PutPackage(pkg)
+		if err != nil {
+			s.errorf(r, "Failed to save package %v", pkg.Name)
+			return err
+		}
+		contents := Contents{
+			BlobKey:           file.BlobKey,
+			Version:           pkg.LatestVersion,
+			UploadTime:        time.Now().UTC(),
+			Type:              pkg.Type,
+			Details:           pkg.Details,
+			Description:       pkg.Description,
+			Author:            pkg.Author,
+			Signature:         signature,
+			UploaderSignature: uploaderSignature,
+			SignedBy:          signedBy,
+		}
+		err = store.PutVersion(pkg.Name, version, &contents)
+		if err != nil {
+			s.errorf(r, "Failed to save contents for version %v, package %v",
+				pkg.LatestVersion, pkg.Name)
+		}
+		return err
+	})
+	if err != nil {
+		// Leave the blob if we don't know whether the version was
+		// saved.
+		if uploadStatus(err) != http.StatusInternalServerError {
+			store.DeleteBlob(file.BlobKey)
+		}
+		return nil, err
+	}
+	if replacedBlob != "" && replacedBlob != file.BlobKey {
+		if err := store.DeleteBlob(replacedBlob); err != nil {
+			s.errorf(r, "Failed to delete replaced blob for %v %v: %v",
+				pkg.Name, pkg.LatestVersion, err)
+		}
+	}
+	s.updateDependents(r, store, pkg.Name, previous, requiredBy(pkg.Details))
+	s.updateSearchIndex(r, store, pkg.Name, previousTerms, packageTerms(pkg))
+	s.archiveChanged(r, store)
+	return pkg, nil
+}
+
+// parseUpload reads the package variables from an uploaded file.  A
+// compressed tar file is replaced by a decompressed copy, so on return
+// file.BlobKey may have changed.
+func (s *Server) parseUpload(store PackageStore, file *Upload) (*Package, error) {
+	blob, err := store.OpenBlob(file.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	reader := bufio.NewReader(blob)
+	contentType, err := sniffContentType(reader, file.Filename)
+	if err != nil {
+		return nil, badUpload(err)
+	}
+	if isCompressed(contentType) {
+		key, err := s.decompressUpload(store, contentType, reader)
+		if err == errUnpackedTooLarge {
+			return nil, &uploadError{http.StatusRequestEntityTooLarge,
+				errors.New(fmt.Sprintf("%v (%d bytes)", err, s.maxUnpackedSize()))}
+		}
+		if err != nil {
+			return nil, badUpload(errors.New("Could not decompress upload: " + err.Error()))
+		}
+		store.DeleteBlob(file.BlobKey)
+		file.BlobKey = key
+		file.Decompressed = true
+		blob, err := store.OpenBlob(key)
+		if err != nil {
+			return nil, err
+		}
+		defer blob.Close()
+		reader = bufio.NewReader(blob)
+		if contentType, _ = sniffContentType(reader, ""); contentType != tarContentType {
+			return nil, badUpload(errors.New("The compressed file is not a tar file"))
+		}
+	}
+	var pkg *Package
+	switch contentType {
+	case tarContentType:
+		pkg, err = parsePackageVarsFromTar(reader)
+		if err == nil {
+			pkg.Type = TAR
+		}
+	case elispContentType:
+		pkg, err = parsePackageVarsFromFile(reader)
+		if err == nil {
+			pkg.Type = SINGLE
+		}
+	default:
+		return nil, badUpload(errors.New("Unknown content type " + contentType))
+	}
+	if err != nil {
+		return nil, badUpload(err)
+	}
+	return pkg, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file implements version parsing and comparison the way Emacs's
+// version-to-list and version-list-< do, so that we agree with
+// package.el about which version of a package is newest.
+
+package elpa
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionRegexpAlist mirrors version-regexp-alist in subr.el.  The
+// non-numeric parts of a version are matched against these in order,
+// and replaced by the corresponding (negative) number.
+var versionRegexpAlist = []struct {
+	re    *regexp.Regexp
+	value int
+}{
+	{regexp.MustCompile(`^[-._+ ]?snapshot$`), -4},
+	{regexp.MustCompile(`^[-._+]$`), -4},
+	{regexp.MustCompile(`^[-._+ ]?(cvs|git|bzr|svn|hg|darcs)$`), -4},
+	{regexp.MustCompile(`^[-._+ ]?unknown$`), -4},
+	{regexp.MustCompile(`^[-._+ ]?alpha$`), -3},
+	{regexp.MustCompile(`^[-._+ ]?beta$`), -2},
+	{regexp.MustCompile(`^[-._+ ]?(pre|rc)$`), -1},
+}
+
+const versionSeparator = "."
+
+var versionNumberRE = regexp.MustCompile(`^[0-9]+`)
+var versionNonNumberRE = regexp.MustCompile(`^[^0-9]+`)
+var versionLetterRE = regexp.MustCompile(`^[-._+ ]?([a-z])$`)
+
+// versionToList converts a version string into a list of integers, as
+// version-to-list does.  For example "1.0pre7" becomes (1 0 -1 7) and
+// "22.8beta3" becomes (22 8 -2 3).
+func versionToList(version string) ([]int, error) {
+	ver := version
+	// Change .x.y to 0.x.y
+	if strings.HasPrefix(ver, versionSeparator) {
+		ver = "0" + ver
+	}
+	// version-to-list matches with case-fold-search bound to t.
+	lower := strings.ToLower(ver)
+	var list []int
+	i := 0
+	for {
+		num := versionNumberRE.FindString(lower[i:])
+		if len(num) == 0 {
+			break
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, errors.New("Invalid version syntax: '" + version + "'")
+		}
+		list = append(list, n)
+		i += len(num)
+		s := versionNonNumberRE.FindString(lower[i:])
+		if len(s) == 0 || s == versionSeparator {
+			i += len(s)
+			continue
+		}
+		i += len(s)
+		matched := false
+		for _, alt := range versionRegexpAlist {
+			if alt.re.MatchString(s) {
+				list = append(list, alt.value)
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		// Convert 22.3a to 22.3.1, 22.3b to 22.3.2, etc., but only
+		// if the letter is the end of the version string.
+		if letter := versionLetterRE.FindStringSubmatch(s); len(letter) > 0 && i == len(lower) {
+			list = append(list, int(letter[1][0]-'a')+1)
+			continue
+		}
+		return nil, errors.New("Invalid version syntax: '" + version + "'")
+	}
+	if len(list) == 0 {
+		return nil, errors.New("Invalid version syntax: '" + version + "' (must start with a number)")
+	}
+	if i != len(lower) {
+		return nil, errors.New("Invalid version syntax: '" + version + "'")
+	}
+	return list, nil
+}
+
+// compareVersionLists returns -1, 0 or 1 as a is older than, the same
+// as, or newer than b.  Like version-list-<, missing trailing elements
+// count as zero, so (1 0) equals (1) and (1 -1) is older than (1).
+func compareVersionLists(a, b []int) int {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	switch {
+	case len(a) > 0 && len(b) > 0:
+		return sign(a[0] - b[0])
+	case len(a) > 0:
+		return sign(firstNonZero(a))
+	case len(b) > 0:
+		return -sign(firstNonZero(b))
+	}
+	return 0
+}
+
+// Version is a parsed package version.  Two versions that Emacs
+// considers equal, such as "1.0" and "1.0.0", compare equal, but keep
+// their own String forms.
+type Version struct {
+	list []int
+}
+
+// ParseVersion parses a version string with the same rules as
+// version-to-list.
+func ParseVersion(s string) (Version, error) {
+	list, err := versionToList(s)
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{list: list}, nil
+}
+
+// List returns the version as a list of integers, as version-to-list
+// would.
+func (v Version) List() []int {
+	return append([]int(nil), v.list...)
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as, or newer
+// than o.
+func (v Version) Compare(o Version) int {
+	return compareVersionLists(v.list, o.list)
+}
+
+// versionSuffixes are the names package-version-join uses for the
+// negative elements of a version list.
+var versionSuffixes = map[int]string{
+	-1: "pre",
+	-2: "beta",
+	-3: "alpha",
+	-4: "snapshot",
+}
+
+// String returns the normalized form of the version, as produced by
+// package-version-join.  This is the form package.el uses in the names
+// of the files it downloads, so "2.3-rc1" is "2.3pre1" and "1.05" is
+// "1.5".
+func (v Version) String() string {
+	var b strings.Builder
+	for i, n := range v.list {
+		if n >= 0 {
+			if i > 0 && v.list[i-1] >= 0 {
+				b.WriteString(versionSeparator)
+			}
+			b.WriteString(strconv.Itoa(n))
+		} else {
+			b.WriteString(versionSuffixes[n])
+		}
+	}
+	return b.String()
+}
+
+// Sexp returns the version as the list package.el expects in
+// archive-contents, such as (1 0 -1 7).
+func (v Version) Sexp() Sexp {
+	elems := make([]Sexp, 0, len(v.list))
+	for _, n := range v.list {
+		elems = append(elems, Integer(n))
+	}
+	return sexpList(elems...)
+}
+
+// normalizeVersion returns the normalized form of a version string.
+func normalizeVersion(s string) (string, error) {
+	v, err := ParseVersion(s)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+func firstNonZero(l []int) int {
+	for _, n := range l {
+		if n != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// VersionConflictError is returned when an upload is not newer than
+// the version of the package already in the archive.
+type VersionConflictError struct {
+	Name     string
+	Current  string
+	Uploaded string
+}
+
+func (e *VersionConflictError) Error() string {
+	if e.Current == e.Uploaded {
+		return "Version " + e.Uploaded + " of " + e.Name + " has already been uploaded"
+	}
+	return "Version " + e.Uploaded + " of " + e.Name +
+		" is not newer than the current version " + e.Current
+}
+
+// checkNewVersion implements the upload policy: a package can only be
+// replaced by a newer version, unless override is set.  A current
+// version that can't be parsed (from before we checked versions) never
+// blocks an upload.
+func checkNewVersion(name string, current string, uploaded string, override bool) error {
+	uploadedVersion, err := ParseVersion(uploaded)
+	if err != nil {
+		return err
+	}
+	if override || len(current) == 0 {
+		return nil
+	}
+	currentVersion, err := ParseVersion(current)
+	if err != nil {
+		return nil
+	}
+	if uploadedVersion.Compare(currentVersion) <= 0 {
+		return &VersionConflictError{Name: name, Current: current, Uploaded: uploaded}
+	}
+	return nil
+}
@@ -0,0 +1 @@
+../src/admin.go
\ No newline at end of file
@@ -0,0 +1 @@
+../src/api.go
\ No newline at end of file
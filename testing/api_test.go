@@ -0,0 +1,106 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// namedFile is singleFile for a package called name.
+func namedFile(name, version string) string {
+	return strings.Replace(singleFile(version), "sample-test", name, -1)
+}
+
+func getJSON(t *testing.T, ts *httptest.Server, path string, v interface{}) int {
+	code, body := get(t, ts, path)
+	if err := json.Unmarshal([]byte(body), v); err != nil {
+		t.Fatal("Bad JSON from", path, body, err)
+	}
+	return code
+}
+
+func TestServer_apiPackageList(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	for _, name := range []string{"c-pkg", "a-pkg", "b-pkg"} {
+		if resp := uploadFile(t, ts, "text/x-emacs-lisp", namedFile(name, "1.0"), nil); resp.StatusCode != http.StatusFound {
+			t.Fatal("Uploading", name, "failed:", resp.Status)
+		}
+	}
+	var list PackageList
+	if code := getJSON(t, ts, "/api/packages?per_page=2", &list); code != http.StatusOK {
+		t.Fatal("Package list returned", code)
+	}
+	if list.Total != 3 || len(list.Packages) != 2 || list.Packages[0].Name != "a-pkg" ||
+		list.Packages[1].Name != "b-pkg" || list.Next != "/api/packages?page=2&per_page=2" {
+		t.Error("First page of packages was", list)
+	}
+	next := list.Next
+	list = PackageList{}
+	getJSON(t, ts, next, &list)
+	if len(list.Packages) != 1 || list.Packages[0].Name != "c-pkg" || list.Packages[0].Version != "1.0" ||
+		list.Packages[0].Description != "A sample package" || list.Next != "" {
+		t.Error("Last page of packages was", list)
+	}
+	for _, page := range []string{"3", "9223372036854775807"} {
+		list = PackageList{}
+		if code := getJSON(t, ts, "/api/packages?per_page=2&page="+page, &list); code != http.StatusOK ||
+			list.Packages == nil || len(list.Packages) != 0 || list.Total != 3 || list.Next != "" {
+			t.Error("Page", page, "past the end returned", code, list)
+		}
+	}
+	var apiErr map[string]string
+	if code := getJSON(t, ts, "/api/packages?page=0", &apiErr); code != http.StatusBadRequest || apiErr["error"] == "" {
+		t.Error("Bad page number returned", code, apiErr)
+	}
+}
+
+func TestServer_apiPackage(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", strings.Replace(singleFile("1.1"), `(req3 "3.0.0")`, "", 1), nil)
+
+	var detail PackageDetail
+	if code := getJSON(t, ts, "/api/packages/sample-test", &detail); code != http.StatusOK {
+		t.Fatal("Package returned", code)
+	}
+	if detail.Package.Name != "sample-test" || detail.Package.Version != "1.1" ||
+		len(detail.Package.Owners) != 1 || len(detail.Details.Required) != 2 ||
+		detail.Details.Readme != "This is the package commentary,\nwhich spans multiple lines.\n" ||
+		len(detail.Versions) != 2 || detail.Versions[0].Version != "1.1" {
+		t.Error("Package returned", detail)
+	}
+
+	var version VersionDetail
+	if code := getJSON(t, ts, "/api/packages/sample-test/1.0", &version); code != http.StatusOK {
+		t.Fatal("Version returned", code)
+	}
+	if version.Name != "sample-test" || version.Version != "1.0" || version.File != "sample-test-1.0.el" ||
+		len(version.Details.Required) != 3 {
+		t.Error("Version 1.0 returned", version)
+	}
+
+	var apiErr map[string]string
+	for _, path := range []string{"/api/packages/sample-test/2.0", "/api/packages/missing", "/api/packages/sample-test/1.0/extra"} {
+		if code := getJSON(t, ts, path, &apiErr); code != http.StatusNotFound || apiErr["error"] == "" {
+			t.Error(path, "should be a 404, got", code, apiErr)
+		}
+	}
+}
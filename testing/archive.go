@@ -0,0 +1 @@
+../src/archive.go
\ No newline at end of file
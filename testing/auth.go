@@ -0,0 +1 @@
+../src/auth.go
\ No newline at end of file
@@ -0,0 +1,370 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadPasswords(t *testing.T) {
+	passwords, err := ReadPasswords(strings.NewReader(
+		"# Test users\n" +
+			"alice:$2y$04$yiFesKThvh75GdxdSVHlQOKspu5FZTkTmZv3NdzvX67mzkTJ227EG\n" +
+			"\n" +
+			"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passwords.Check("alice", "secret") || passwords.Check("alice", "wrong") {
+		t.Error("bcrypt password for alice was not checked correctly")
+	}
+	if !passwords.Check("bob", "secret") || passwords.Check("bob", "wrong") {
+		t.Error("SHA password for bob was not checked correctly")
+	}
+	if passwords.Check("carol", "secret") {
+		t.Error("Unknown users should not be able to log in")
+	}
+	for _, bad := range []string{"alice", "alice:$apr1$abc$def", ":{SHA}abc"} {
+		if _, err := ReadPasswords(strings.NewReader(bad)); err == nil {
+			t.Error("Expected an error reading password file", bad)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	sessions := &Sessions{Key: []byte("0123456789abcdef0123456789abcdef")}
+	w := httptest.NewRecorder()
+	sessions.Set(w, "alice@example.com")
+	cookie := w.Result().Cookies()[0]
+	if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Error("Session cookies should be Secure, HttpOnly and SameSite=Lax, got", cookie)
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if user := sessions.User(r); user != "alice@example.com" {
+		t.Error("Session should be for alice@example.com, got", user)
+	}
+	other := &Sessions{Key: []byte("fedcba9876543210fedcba9876543210")}
+	if user := other.User(r); user != "" {
+		t.Error("Session signed with another key should be rejected, got", user)
+	}
+	// Change the user without changing the signature.
+	parts := strings.Split(cookie.Value, ".")
+	parts[0] = base64.RawURLEncoding.EncodeToString([]byte("mallory"))
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: strings.Join(parts, ".")})
+	if user := sessions.User(r); user != "" {
+		t.Error("Tampered session should be rejected, got", user)
+	}
+	// Expired sessions are rejected even if the browser still sends them.
+	value := base64.RawURLEncoding.EncodeToString([]byte("alice")) + ".1000"
+	r, _ = http.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: value + "." + sessions.sign(value)})
+	if user := sessions.User(r); user != "" {
+		t.Error("Expired session should be rejected, got", user)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	resp := uploadFileAs(t, ts, "", "text/x-emacs-lisp", singleFile("1.0"), nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != `Basic realm="test"` {
+		t.Error("Anonymous upload should ask for a password, got", resp.Status, resp.Header)
+	}
+	resp = uploadFileAs(t, ts, "mallory", "text/x-emacs-lisp", singleFile("1.0"), nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Upload by an unknown user should ask for a password, got", resp.Status)
+	}
+	if code, _ := get(t, ts, "/upload.html"); code != http.StatusUnauthorized {
+		t.Error("upload.html should ask for a password, got", code)
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+	ts, _ := newConfiguredTestServer(t, func(s *Server) {
+		s.Auth = &PasswordAuth{
+			Passwords: testPasswords,
+			Sessions:  &Sessions{Key: []byte("0123456789abcdef0123456789abcdef")},
+		}
+	})
+	defer ts.Close()
+	resp, err := noRedirects.Get(ts.URL + "/upload.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/login?return=%2Fupload.html" {
+		t.Fatal("upload.html should redirect to the login page, got", resp.Status, resp.Header.Get("Location"))
+	}
+	// post posts a form with the session cookies in cookies.
+	post := func(path string, values url.Values, cookies []*http.Cookie) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		addCSRF(req)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := noRedirects.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// Another site can't log users in as someone else.
+	resp = post("/login", url.Values{"user": {"alice"}, "password": {"secret"}}, nil)
+	if resp.StatusCode != http.StatusForbidden || len(resp.Cookies()) != 0 {
+		t.Error("Login without a CSRF token should be refused, got", resp.Status, resp.Cookies())
+	}
+	resp = post("/login", url.Values{
+		"user": {"alice"}, "password": {"wrong"}, "return": {"/upload.html"}, csrfField: {testCSRF}}, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Wrong password should be refused, got", resp.Status)
+	}
+	// Only paths on this site are allowed to be returned to.
+	resp = post("/login", url.Values{
+		"user": {"alice"}, "password": {"secret"}, "return": {"//example.com/"}, csrfField: {testCSRF}}, nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatal("Login should redirect to /, got", resp.Status, resp.Header.Get("Location"))
+	}
+	session := resp.Cookies()
+	req, _ := http.NewRequest("GET", ts.URL+"/upload.html", nil)
+	for _, cookie := range session {
+		req.AddCookie(cookie)
+	}
+	resp, err = noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "Logged in as alice") ||
+		!strings.Contains(string(b), `action="/logout"`) {
+		t.Error("upload.html should show alice is logged in, with a form to log out, got", resp.Status, string(b))
+	}
+	// Other sites can't log users out, either with a link or a form.
+	req, _ = http.NewRequest("GET", ts.URL+"/logout", nil)
+	for _, cookie := range session {
+		req.AddCookie(cookie)
+	}
+	if resp, err = noRedirects.Do(req); err != nil || resp.StatusCode != http.StatusMethodNotAllowed || len(resp.Cookies()) != 0 {
+		t.Error("Logging out with a GET should be refused, got", resp, err)
+	}
+	if resp = post("/logout", nil, session); resp.StatusCode != http.StatusForbidden || len(resp.Cookies()) != 0 {
+		t.Error("Logging out without a CSRF token should be refused, got", resp.Status)
+	}
+	resp = post("/logout", url.Values{csrfField: {testCSRF}}, session)
+	if resp.StatusCode != http.StatusFound || len(resp.Cookies()) != 1 || resp.Cookies()[0].MaxAge >= 0 {
+		t.Error("Logging out should clear the session, got", resp.Status, resp.Cookies())
+	}
+}
+
+// oidcStandIn is a minimal OpenID Connect provider, which logs everyone
+// in without asking.  It signs ID tokens with Key if it has one, and
+// with Secret otherwise.
+type oidcStandIn struct {
+	*httptest.Server
+	Secret string
+	Key    *rsa.PrivateKey
+	KeyID  string
+	// Claims are added to every ID token.
+	Claims map[string]interface{}
+}
+
+// newOIDCStandIn starts a provider that says everyone is user, with a
+// verified email address.
+func newOIDCStandIn(t *testing.T, user, secret string) *oidcStandIn {
+	mux := http.NewServeMux()
+	provider := &oidcStandIn{
+		Server: httptest.NewServer(mux),
+		Secret: secret,
+		KeyID:  "key-1",
+		Claims: map[string]interface{}{"email": user, "email_verified": true},
+	}
+	nonces := make(map[string]string)
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("response_type") != "code" || r.FormValue("client_id") != "elpa" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		nonces["code-1"] = r.FormValue("nonce")
+		redirect := r.FormValue("redirect_uri") + "?code=code-1&state=" + url.QueryEscape(r.FormValue("state"))
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		nonce, ok := nonces[r.FormValue("code")]
+		if !ok || r.FormValue("client_secret") != provider.Secret {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		alg := "HS256"
+		if provider.Key != nil {
+			alg = "RS256"
+		}
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT","kid":"` + provider.KeyID + `"}`))
+		claims := map[string]interface{}{
+			"iss":   provider.URL,
+			"sub":   "1234",
+			"aud":   []string{"elpa"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": nonce,
+		}
+		for k, v := range provider.Claims {
+			claims[k] = v
+		}
+		encoded, _ := json.Marshal(claims)
+		payload := header + "." + base64.RawURLEncoding.EncodeToString(encoded)
+		var signature []byte
+		if provider.Key != nil {
+			hash := sha256.Sum256([]byte(payload))
+			signature, _ = rsa.SignPKCS1v15(rand.Reader, provider.Key, crypto.SHA256, hash[:])
+		} else {
+			mac := hmac.New(sha256.New, []byte(provider.Secret))
+			mac.Write([]byte(payload))
+			signature = mac.Sum(nil)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": payload + "." + base64.RawURLEncoding.EncodeToString(signature),
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		keys := make([]map[string]string, 0)
+		if provider.Key != nil {
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": provider.KeyID,
+				"n":   base64.RawURLEncoding.EncodeToString(provider.Key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.Key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	return provider
+}
+
+// oidcLogin logs in to ts with a new browser, returning the upload page.
+func oidcLogin(t *testing.T, ts *httptest.Server) (*http.Response, string) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(ts.URL + "/upload.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	provider := newOIDCStandIn(t, "alice@example.com", "client-secret")
+	defer provider.Close()
+	var auth *OIDCAuth
+	ts, _ := newConfiguredTestServer(t, func(s *Server) {
+		auth = &OIDCAuth{
+			Issuer:       provider.URL,
+			AuthURL:      provider.URL + "/authorize",
+			TokenURL:     provider.URL + "/token",
+			ClientID:     "elpa",
+			ClientSecret: "client-secret",
+			Sessions:     &Sessions{Key: []byte("0123456789abcdef0123456789abcdef")},
+		}
+		s.Auth = auth
+	})
+	defer ts.Close()
+	auth.RedirectURL = ts.URL + "/login/callback"
+	if resp, body := oidcLogin(t, ts); resp.StatusCode != http.StatusOK || !strings.Contains(body, "Logged in as alice@example.com") {
+		t.Error("Logging in with OpenID Connect failed:", resp.Status, body)
+	}
+
+	// Anyone could claim an email address that isn't verified, so
+	// users without one are known by their subject.
+	for _, verified := range []interface{}{false, "false", nil} {
+		provider.Claims["email_verified"] = verified
+		if resp, body := oidcLogin(t, ts); resp.StatusCode != http.StatusOK ||
+			!strings.Contains(body, "Logged in as "+provider.URL+"#1234") {
+			t.Errorf("Users with email_verified %v should be known by their subject, got %v %v", verified, resp.Status, body)
+		}
+	}
+	provider.Claims["email_verified"] = "true"
+	if _, body := oidcLogin(t, ts); !strings.Contains(body, "Logged in as alice@example.com") {
+		t.Error("email_verified may be a string, got", body)
+	}
+
+	// A client that the provider doesn't recognize can't log in.
+	auth.ClientSecret = "other-secret"
+	if resp, _ := oidcLogin(t, ts); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Login with a badly signed token should fail, got", resp.Status)
+	}
+}
+
+func TestOIDCAuth_rs256(t *testing.T) {
+	provider := newOIDCStandIn(t, "alice@example.com", "client-secret")
+	defer provider.Close()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Key = key
+	var auth *OIDCAuth
+	ts, _ := newConfiguredTestServer(t, func(s *Server) {
+		auth = &OIDCAuth{
+			Issuer:       provider.URL,
+			AuthURL:      provider.URL + "/authorize",
+			TokenURL:     provider.URL + "/token",
+			ClientID:     "elpa",
+			ClientSecret: "client-secret",
+			Sessions:     &Sessions{Key: []byte("0123456789abcdef0123456789abcdef")},
+		}
+		s.Auth = auth
+	})
+	defer ts.Close()
+	auth.RedirectURL = ts.URL + "/login/callback"
+	if resp, _ := oidcLogin(t, ts); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("RS256 tokens can't be checked without the provider's keys, got", resp.Status)
+	}
+	auth.JWKSURL = provider.URL + "/jwks"
+	if resp, body := oidcLogin(t, ts); resp.StatusCode != http.StatusOK || !strings.Contains(body, "Logged in as alice@example.com") {
+		t.Error("Logging in with an RS256 ID token failed:", resp.Status, body)
+	}
+	// When the provider changes keys, the new ones are fetched, and
+	// tokens signed with others are refused.
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.Key, provider.KeyID = other, "key-2"
+	if resp, _ := oidcLogin(t, ts); resp.StatusCode != http.StatusOK {
+		t.Error("Logging in after the provider changed keys failed:", resp.Status)
+	}
+	auth.keys = map[string]*rsa.PublicKey{"key-2": &key.PublicKey}
+	auth.JWKSURL = provider.URL + "/missing"
+	if resp, _ := oidcLogin(t, ts); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Login with a token signed by another key should fail, got", resp.Status)
+	}
+}
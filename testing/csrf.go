@@ -0,0 +1 @@
+../src/csrf.go
\ No newline at end of file
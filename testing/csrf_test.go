@@ -0,0 +1,102 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// postOwners posts the owners form as alice from a browser with cookie.
+func postOwners(t *testing.T, ts *httptest.Server, cookie *http.Cookie, values url.Values) *http.Response {
+	req, _ := http.NewRequest("POST", ts.URL+"/owners", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("alice", "secret")
+	req.AddCookie(cookie)
+	resp, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServer_csrf(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+
+	// The owners page gives the browser a token, and puts it in its
+	// forms.
+	req, _ := http.NewRequest("GET", ts.URL+"/owners.html?package=sample-test", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == csrfCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatal("The owners page should set a Secure, HttpOnly, SameSite=Lax CSRF cookie, got", resp.Cookies())
+	}
+	field := regexp.MustCompile(`name="csrf" value="([^"]+)"`).FindStringSubmatch(string(b))
+	if field == nil || field[1] != cookie.Value {
+		t.Fatal("The owners page's forms should post the CSRF token, got", string(b))
+	}
+
+	// Forms posted from another site have the browser's cookies, but
+	// not the token.
+	for _, token := range []string{"", "guessed"} {
+		values := url.Values{"package": {"sample-test"}, "add": {"mallory"}, csrfField: {token}}
+		if resp := postOwners(t, ts, cookie, values); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Adding an owner with CSRF token %q should be forbidden, got %v", token, resp.Status)
+		}
+	}
+	if p, _ := store.GetPackage("sample-test"); len(p.Owners) != 1 {
+		t.Error("Forged forms should not change the owners, got", p.Owners)
+	}
+
+	// With the token from the page, the change is made.
+	values := url.Values{"package": {"sample-test"}, "add": {"bob"}, csrfField: {field[1]}}
+	if resp := postOwners(t, ts, cookie, values); resp.StatusCode != http.StatusFound {
+		t.Error("Adding an owner with the page's CSRF token failed:", resp.Status)
+	}
+
+	// Other forms are checked too.
+	for _, path := range []string{"/tokens.html", "/keys.html", "/delete.html"} {
+		if resp := postAs(t, ts, "alice", path, url.Values{"package": {"sample-test"}, csrfField: {"guessed"}}); resp.StatusCode != http.StatusForbidden {
+			t.Error("Posting", path, "with the wrong CSRF token should be forbidden, got", resp.Status)
+		}
+	}
+	if resp := uploadFile(t, ts, "text/x-emacs-lisp", singleFile("2.0"), map[string]string{csrfField: "guessed"}); resp.StatusCode != http.StatusForbidden {
+		t.Error("Uploading with the wrong CSRF token should be forbidden, got", resp.Status)
+	}
+	if p, _ := store.GetPackage("sample-test"); p.LatestVersion != "1.0" {
+		t.Error("A forged upload should not be stored, got version", p.LatestVersion)
+	}
+	// PUTs can't come from forms, so don't need a token.
+	if resp := putFile(t, ts, "", singleFile("2.0")); resp.StatusCode != http.StatusCreated {
+		t.Error("PUT uploads should not need a CSRF token, got", resp.Status)
+	}
+}
@@ -0,0 +1 @@
+../src/delete.go
\ No newline at end of file
@@ -0,0 +1 @@
+../src/dependencies.go
\ No newline at end of file
@@ -0,0 +1,118 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// requiringFile is a single file package that requires requires, which
+// is written as in a Package-Requires header.
+func requiringFile(name, version, requires string) string {
+	return ";;; " + name + ".el --- A package with dependencies\n" +
+		";; Version: " + version + "\n" +
+		";; Package-Requires: (" + requires + ")\n" +
+		";;; Commentary:\n;; Commentary\n;;; Code:\n"
+}
+
+var testBuiltins = []EmacsRelease{
+	{"24.3", map[string]string{"cl-lib": "1.0"}},
+	{"25.1", map[string]string{"cl-lib": "1.0", "seq": "2.3"}},
+	{"26.1", map[string]string{"cl-lib": "1.0", "seq": "2.20"}},
+}
+
+func TestServer_resolveDependencies(t *testing.T) {
+	s := &Server{Builtins: testBuiltins}
+	store := NewMemoryStore()
+	store.PutPackage(&Package{Name: "dash", LatestVersion: "2.12"})
+	resolutions, err := s.resolveDependencies(store, []PackageRef{
+		{"emacs", "25.1"}, {"seq", "2.10"}, {"seq", "3.0"}, {"dash", "2.0"}, {"dash", "3.0"},
+		{"nothing", "1.0"}, {"emacs", "27.1"}, {"dash", "not a version"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Resolution{
+		{PackageRef{"emacs", "25.1"}, "builtin", "25.1", "25.1"},
+		{PackageRef{"seq", "2.10"}, "builtin", "2.20", "26.1"},
+		{PackageRef{"seq", "3.0"}, "unavailable", "2.20", ""},
+		{PackageRef{"dash", "2.0"}, "archive", "2.12", ""},
+		{PackageRef{"dash", "3.0"}, "unavailable", "2.12", ""},
+		{PackageRef{"nothing", "1.0"}, "missing", "", ""},
+		{PackageRef{"emacs", "27.1"}, "unavailable", "26.1", ""},
+		{PackageRef{"dash", "not a version"}, "invalid", "", ""},
+	}
+	if len(resolutions) != len(expected) {
+		t.Fatal("Expected", expected, "got", resolutions)
+	}
+	for i, e := range expected {
+		if resolutions[i] != e {
+			t.Errorf("Expected %+v, got %+v", e, resolutions[i])
+		}
+	}
+}
+
+func TestReadBuiltins(t *testing.T) {
+	releases, err := ReadBuiltins(strings.NewReader(`[{"version": "25.1", "packages": {"seq": "2.3"}}]`))
+	if err != nil || len(releases) != 1 || releases[0].Packages["seq"] != "2.3" {
+		t.Error("ReadBuiltins returned", releases, err)
+	}
+	if _, err := ReadBuiltins(strings.NewReader(`[{"version": "twenty-five"}]`)); err == nil {
+		t.Error("Expected an error for a bad Emacs version")
+	}
+}
+
+func TestServer_uploadDependencies(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", namedFile("dep", "1.0"), nil)
+	resp := uploadFile(t, ts, "text/x-emacs-lisp",
+		requiringFile("user", "1.0", `(emacs "24.4") (dep "1.0") (missing "1.0")`), nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("Upload with a missing dependency should only warn, got", resp.Status)
+	}
+	code, body := get(t, ts, "/upload_complete.html?package=user")
+	if code != http.StatusOK || !strings.Contains(body, "missing 1.0 is not in the archive") ||
+		!strings.Contains(body, "emacs 24.4 comes with Emacs 24.4") {
+		t.Error("upload_complete.html should show the dependencies, got", code, body)
+	}
+
+	token := createToken(t, ts, "user")
+	resp, body = apiUpload(t, ts, token, "user.el", requiringFile("user", "1.1", `(dep "2.0")`))
+	var result UploadResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatal("API upload failed:", resp.Status, body)
+	}
+	if len(result.Dependencies) != 1 || result.Dependencies[0].Status != "unavailable" || result.Dependencies[0].Available != "1.0" {
+		t.Error("API upload should report the dependencies, got", result.Dependencies)
+	}
+
+	strict, _ := newConfiguredTestServer(t, func(s *Server) { s.StrictDependencies = true })
+	defer strict.Close()
+	if resp := uploadFile(t, strict, "text/x-emacs-lisp", requiringFile("dep", "1.0", `(emacs "24.1")`), nil); resp.StatusCode != http.StatusFound {
+		t.Fatal("Upload without missing dependencies failed:", resp.Status)
+	}
+	resp = uploadFile(t, strict, "text/x-emacs-lisp", requiringFile("user", "1.0", `(dep "2.0")`), nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Strict archive should reject unavailable dependencies, got", resp.Status)
+	}
+	resp = uploadFile(t, strict, "text/x-emacs-lisp", requiringFile("user", "1.0", `(dep "1.0") (cl-lib "1.0")`), nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Error("Strict archive should accept resolvable dependencies, got", resp.Status)
+	}
+}
@@ -0,0 +1 @@
+../src/dependents.go
\ No newline at end of file
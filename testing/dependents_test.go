@@ -0,0 +1,168 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServer_dependents(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("lib", "1.0", ""), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("app", "1.0", `(lib "1.0")`), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("other", "1.0", `(lib "2.0") (app "1.0")`), nil)
+	expected := []PackageRef{{"app", "1.0"}, {"other", "2.0"}}
+	if dependents, err := store.GetDependents("lib"); err != nil || !reflect.DeepEqual(dependents, expected) {
+		t.Error("Expected dependents", expected, "got", dependents, err)
+	}
+	var detail PackageDetail
+	getJSON(t, ts, "/api/packages/lib", &detail)
+	if !reflect.DeepEqual(detail.Dependents, expected) {
+		t.Error("API should show the dependents, got", detail.Dependents)
+	}
+	var dependents []PackageRef
+	if getJSON(t, ts, "/api/packages/other/dependents", &dependents); dependents == nil || len(dependents) != 0 {
+		t.Error("Package without dependents should have [], got", dependents)
+	}
+	if _, body := get(t, ts, "/versions.html?package=lib"); !strings.Contains(body, `<a href="/versions.html?package=app">app</a> requires 1.0`) {
+		t.Error("versions.html should show the dependents, got", body)
+	}
+
+	// A new version that no longer requires lib is removed.
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("app", "1.1", ""), nil)
+	expected = []PackageRef{{"other", "2.0"}}
+	if dependents, _ := store.GetDependents("lib"); !reflect.DeepEqual(dependents, expected) {
+		t.Error("Expected dependents", expected, "after app stopped requiring lib, got", dependents)
+	}
+
+	store.PutDependents("lib", nil)
+	// A stale entry, for a package nothing requires any more.
+	store.PutDependents("gone", []PackageRef{{"app", "1.0"}})
+	if resp := postAs(t, ts, "alice", "/admin/reindex", nil); resp.StatusCode != http.StatusForbidden {
+		t.Error("Only admins should be able to reindex, got", resp.Status)
+	}
+	admin, _ := newConfiguredTestServer(t, func(s *Server) {
+		s.Store = func(r *http.Request) PackageStore { return store }
+		s.IsAdmin = func(r *http.Request) bool { return true }
+	})
+	defer admin.Close()
+	if resp := postAs(t, admin, "carol", "/admin/reindex", nil); resp.StatusCode != http.StatusOK {
+		t.Error("Reindexing failed:", resp.Status)
+	}
+	if dependents, _ := store.GetDependents("lib"); !reflect.DeepEqual(dependents, expected) {
+		t.Error("Expected dependents", expected, "after reindexing, got", dependents)
+	}
+	if dependents, _ := store.GetDependents("gone"); dependents != nil {
+		t.Error("Reindexing should clear stale dependents, got", dependents)
+	}
+}
+
+func TestServer_remove(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	for _, v := range []string{"1.0", "2.0", "3.0"} {
+		uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("lib", v, ""), nil)
+	}
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("app", "1.0", `(lib "1.0")`), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("other", "1.0", `(lib "3.0")`), nil)
+
+	if resp := postAs(t, ts, "bob", "/delete.html", url.Values{"package": {"lib"}}); resp.StatusCode != http.StatusForbidden {
+		t.Error("Only owners should be able to delete a package, got", resp.Status)
+	}
+	// Yanking an old version breaks nothing.
+	if resp := postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"lib"}, "version": {"2.0"}}); resp.StatusCode != http.StatusFound {
+		t.Error("Yanking an old version failed:", resp.Status)
+	}
+	if _, err := store.GetVersion("lib", mustParseVersion(t, "2.0")); err != ErrNotFound {
+		t.Error("Yanked version should be gone, got", err)
+	}
+
+	code, body := get(t, ts, "/delete.html?package=lib&version=3.0")
+	if code != http.StatusUnauthorized {
+		t.Error("The delete page should need a login, got", code)
+	}
+	resp := postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"lib"}, "version": {"3.0"}})
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("Yanking a version a package requires should need confirming, got", resp.Status)
+	}
+	if p, _ := store.GetPackage("lib"); p.LatestVersion != "3.0" {
+		t.Error("Unconfirmed yank should change nothing, latest is", p.LatestVersion)
+	}
+	resp = postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"lib"}, "version": {"3.0"}, "confirm": {"1"}})
+	if resp.StatusCode != http.StatusFound {
+		t.Error("Confirmed yank failed:", resp.Status)
+	}
+	if p, _ := store.GetPackage("lib"); p.LatestVersion != "1.0" {
+		t.Error("Yanking the latest version should go back to 1.0, got", p.LatestVersion)
+	}
+	if _, body = get(t, ts, "/packages/archive-contents"); !strings.Contains(body, "(lib . [(1 0)") {
+		t.Error("archive-contents should have lib 1.0 after the yank, got", body)
+	}
+
+	resp = postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"lib"}})
+	if resp.StatusCode != http.StatusConflict {
+		t.Error("Deleting a package others require should need confirming, got", resp.Status)
+	}
+	resp = postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"lib"}, "confirm": {"1"}})
+	if resp.StatusCode != http.StatusFound {
+		t.Error("Confirmed delete failed:", resp.Status)
+	}
+	if _, err := store.GetPackage("lib"); err != ErrNotFound {
+		t.Error("Deleted package should be gone, got", err)
+	}
+	if versions, _ := store.ListVersions("lib"); len(versions) != 0 {
+		t.Error("Deleted package should have no versions, got", versions)
+	}
+	if _, body = get(t, ts, "/packages/archive-contents"); strings.Contains(body, "(lib . ") {
+		t.Error("archive-contents should not have lib after deleting it, got", body)
+	}
+	// Packages still require lib, so they are still its dependents if
+	// it is uploaded again.
+	if dependents, _ := store.GetDependents("lib"); len(dependents) != 2 {
+		t.Error("Dependents of a deleted package should be kept, got", dependents)
+	}
+	// Two versions each of app and other, and the snapshot.
+	if len(store.blobs) != 3 {
+		t.Error("Blobs of deleted versions should be deleted, have", len(store.blobs))
+	}
+}
+
+func TestServer_removeRestoresDescription(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+	changed := strings.NewReplacer("A sample package", "A changed package",
+		"Andrew Hyatt <", "Someone Else <").Replace(singleFile("1.1"))
+	uploadFile(t, ts, "text/x-emacs-lisp", changed, nil)
+	if p, _ := store.GetPackage("sample-test"); p.Description != "A changed package" {
+		t.Fatal("The new version should change the description, got", p.Description)
+	}
+	resp := postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"sample-test"}, "version": {"1.1"}})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("Yanking the latest version failed:", resp.Status)
+	}
+	p, _ := store.GetPackage("sample-test")
+	if p.LatestVersion != "1.0" || p.Description != "A sample package" || !strings.HasPrefix(p.Author, "Andrew Hyatt") {
+		t.Error("Yanking the latest version should restore the description and author, got", p)
+	}
+	if _, body := get(t, ts, "/packages/archive-contents"); !strings.Contains(body, `"A sample package"`) {
+		t.Error("archive-contents should have the old description, got", body)
+	}
+}
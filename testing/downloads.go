@@ -0,0 +1 @@
+../src/downloads.go
\ No newline at end of file
@@ -0,0 +1,135 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_downloads(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	for _, version := range []string{"1.0", "1.1"} {
+		uploadFile(t, ts, "text/x-emacs-lisp", singleFile(version), nil)
+	}
+	uploadFile(t, ts, "text/x-emacs-lisp", namedFile("unused", "1.0"), nil)
+	for _, path := range []string{"sample-test-1.0.el", "sample-test-1.0.el", "sample-test-1.1.el", "sample-test-readme.txt"} {
+		if code, _ := get(t, ts, "/packages/"+path); code != http.StatusOK {
+			t.Fatal("Downloading", path, "returned", code)
+		}
+	}
+	if resp, err := http.Head(ts.URL + "/packages/sample-test-1.1.el"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("HEAD of a package file failed:", resp, err)
+	}
+
+	var stats DownloadStats
+	getJSON(t, ts, "/api/packages/sample-test/downloads", &stats)
+	expected := []VersionDownloads{{"1.1", 1}, {"1.0", 2}}
+	if stats.Total != 3 || !reflect.DeepEqual(stats.Versions, expected) {
+		t.Error("Expected 3 downloads by version", expected, "got", stats)
+	}
+	today := time.Now().UTC().Format(dayFormat)
+	if len(stats.Days) != defaultStatsDays || stats.Days[len(stats.Days)-1] != (DayDownloads{today, 3}) ||
+		stats.Days[0].Downloads != 0 {
+		t.Error("Expected", defaultStatsDays, "days ending with today's downloads, got", stats.Days)
+	}
+	if getJSON(t, ts, "/api/packages/sample-test/downloads?days=2", &stats); len(stats.Days) != 2 {
+		t.Error("Expected 2 days of downloads, got", stats.Days)
+	}
+	if code, _ := get(t, ts, "/api/packages/sample-test/downloads?days=none"); code != http.StatusBadRequest {
+		t.Error("A bad number of days should be a 400, got", code)
+	}
+	for _, path := range []string{"/api/packages/sample-test/downloads?", "/stats.html?package=sample-test&"} {
+		if code, _ := get(t, ts, path+"days=2000000000"); code != http.StatusBadRequest {
+			t.Error("Too many days should be a 400 from", path, "got", code)
+		}
+	}
+	if getJSON(t, ts, "/api/packages/sample-test/downloads?days=366", &stats); len(stats.Days) != maxStatsDays {
+		t.Error("Expected a year of downloads, got", len(stats.Days))
+	}
+
+	var totals []PackageDownloads
+	getJSON(t, ts, "/api/downloads", &totals)
+	if !reflect.DeepEqual(totals, []PackageDownloads{{"sample-test", 3}, {"unused", 0}}) {
+		t.Error("/api/downloads returned", totals)
+	}
+	if code, body := get(t, ts, "/stats.html"); code != http.StatusOK ||
+		!strings.Contains(body, `<a href="/stats.html?package=sample-test">sample-test</a></td><td>3</td>`) {
+		t.Error("stats.html should list every package's downloads, got", code, body)
+	}
+	if code, body := get(t, ts, "/stats.html?package=sample-test"); code != http.StatusOK ||
+		!strings.Contains(body, "1.0: 2") || !strings.Contains(body, "<td>"+today+"</td><td>3</td>") {
+		t.Error("stats.html should show the package's downloads, got", code, body)
+	}
+	if _, body := get(t, ts, "/package/sample-test"); !strings.Contains(body, `<span class="fieldvalue">3</span>`) {
+		t.Error("The package page should show the downloads, got", body)
+	}
+}
+
+func TestServer_rollUpDownloads(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	for _, c := range []DownloadCount{
+		{"foo", "1.0", "2013-05-01", 0, 1},
+		{"foo", "1.0", "2013-05-01", 3, 2},
+		{"foo", "1.0", "2013-05-01", 7, 5},
+		{"foo", "2.0", "2013-05-01", 4, 1},
+		{"bar", "1.0", "2013-05-01", 0, 4},
+		{"foo", "1.0", "2013-05-02", 3, 1},
+	} {
+		if err := store.AddDownloads(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp := postAs(t, ts, "alice", "/admin/rollup-downloads?day=2013-05-01", nil); resp.StatusCode != http.StatusForbidden {
+		t.Error("Only admins should be able to roll up downloads, got", resp.Status)
+	}
+	req, _ := http.NewRequest("GET", ts.URL+"/admin/rollup-downloads?day=2013-05-01", nil)
+	req.Header.Set("X-Appengine-Cron", "true")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Rolling up from cron failed:", resp, err)
+	}
+	counts, _ := store.ListDownloadsOn("2013-05-01")
+	expected := []DownloadCount{
+		{"bar", "1.0", "2013-05-01", 0, 4},
+		{"foo", "1.0", "2013-05-01", 0, 8},
+		{"foo", "2.0", "2013-05-01", 0, 1},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Error("Expected rolled up counts", expected, "got", counts)
+	}
+	if counts, _ := store.ListDownloadsOn("2013-05-02"); len(counts) != 1 || counts[0].Shard != 3 {
+		t.Error("Other days should not be rolled up, got", counts)
+	}
+
+	admin, _ := newConfiguredTestServer(t, func(s *Server) {
+		s.Store = func(r *http.Request) PackageStore { return store }
+		s.IsAdmin = func(r *http.Request) bool { return true }
+	})
+	defer admin.Close()
+	if resp := postAs(t, admin, "carol", "/admin/rollup-downloads?day=May+1", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Error("A bad day should be a 400, got", resp.Status)
+	}
+	if resp := postAs(t, admin, "carol", "/admin/rollup-downloads?day=2013-05-02", nil); resp.StatusCode != http.StatusOK {
+		t.Error("Rolling up as an admin failed:", resp.Status)
+	}
+	if counts, _ := store.ListDownloads("foo"); len(counts) != 3 || counts[2] != (DownloadCount{"foo", "1.0", "2013-05-02", 0, 1}) {
+		t.Error("Expected the second day rolled up, got", counts)
+	}
+}
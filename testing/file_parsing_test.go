@@ -94,6 +94,16 @@ func TestParsePackageVarsFromFile_complete(t *testing.T) {
 	if details.Readme != "This is the package commentary,\nwhich spans multiple lines.\n" {
 		t.Fatal("details.Readme incorrect: ", details.Readme)
 	}
+	if details.URL != "http://also.ignored" {
+		t.Error("details.URL incorrect: ", details.URL)
+	}
+	if strings.Join(details.Keywords, "|") != "fee|fi|fo|fum" {
+		t.Error("details.Keywords incorrect: ", details.Keywords)
+	}
+	if len(details.Authors) != 1 ||
+		details.Authors[0] != (Person{"Andrew Hyatt", "ahyatt@gmail.com"}) {
+		t.Error("details.Authors incorrect: ", details.Authors)
+	}
 }
 
 func WriteTarFile(t *testing.T, tw *tar.Writer, filename string, contents string) {
@@ -104,7 +114,7 @@ func WriteTarFile(t *testing.T, tw *tar.Writer, filename string, contents string
 	}); err != nil {
 		t.Fatal("Could not create the header for testing")
 	}
-	fmt.Fprintf(tw, contents)
+	tw.Write([]byte(contents))
 }
 
 func TestParsePackageVarsFromTar_noDirectory(t *testing.T) {
@@ -177,23 +187,39 @@ func TestParsePackageVarsFromTar_allValidForms(t *testing.T) {
 	}
 }
 
-func parsePackageDefinitionTester(pkg *Package, details *Details, def string) error {
-	cin := make(chan int)
-	cout := make(chan *Token)
-	cerr := make(chan error)
-	cdone := make(chan bool)
-	go parseSimpleSexp(cin, cout, cdone)
-	go readPackageDefinition(cout, cerr, pkg, details)
-	for _, b := range []byte(def) {
-		select {
-		case err := <-cerr:
-			return err
-		default:
-			cin <- int(b)
+func TestParsePackageVarsFromTar_readmeFormats(t *testing.T) {
+	for _, test := range []struct {
+		files  []string
+		readme string
+		format string
+	}{
+		{[]string{"README.txt"}, "README.txt", "text"},
+		{[]string{"README", "README.md"}, "README.md", "markdown"},
+		{[]string{"README.org", "README.md", "README"}, "README.org", "org"},
+		{[]string{"README.txt", "README"}, "README", "text"},
+		{[]string{"readme.md", "NEWS"}, "", ""},
+	} {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		WriteTarFile(t, tw, "sample-test-0.1.2.3/sample-test-pkg.el", `(define-package "sample-test" "0.1.2.3")`)
+		for _, f := range test.files {
+			WriteTarFile(t, tw, "sample-test-0.1.2.3/"+f, f)
+		}
+		tw.Close()
+		pkg, err := parsePackageVarsFromTar(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		details, _ := decodeDetails(&pkg.Details)
+		if details.Readme != test.readme || details.ReadmeFormat != test.format {
+			t.Errorf("With %v expected the readme to be %v (%q), got %v (%q)",
+				test.files, test.readme, test.format, details.Readme, details.ReadmeFormat)
 		}
 	}
-	cdone <- true
-	return <-cerr
+}
+
+func parsePackageDefinitionTester(pkg *Package, details *Details, def string) error {
+	return parsePackageDefinition(strings.NewReader(def), pkg, details)
 }
 
 func TestParsePackageVarsFromTar_validMinimalPkgFile(t *testing.T) {
@@ -245,4 +271,87 @@ func TestBadPackageDefs(t *testing.T) {
 	assertParsePackageFails(`(define-package "foo" "1.2.3"`, &pkg, t)
 	// No define-package
 	assertParsePackageFails(`(+ 3 3)`, &pkg, t)
+	// Dependency that isn't a list
+	assertParsePackageFails(`(define-package "foo" "1.2.3" "A sample package" '(req1 "1.0.0"))`, &pkg, t)
+	// Trailing garbage
+	assertParsePackageFails(`(define-package "foo" "1.2.3") (+ 3 3)`, &pkg, t)
+}
+
+func TestParsePackageDefinition_commentsAndNumbers(t *testing.T) {
+	pkg := Package{Name: "foo2", LatestVersion: "1.2.3"}
+	var details Details
+	err := parsePackageDefinitionTester(&pkg, &details, `;;; foo2-pkg.el --- generated
+;; Some comment (with parens
+(define-package "foo2" "1.2.3" "A package; with a semicolon"
+  '((emacs "24.3") (s2 "1.10.0"))) ; trailing comment
+`)
+	if err != nil {
+		t.Fatal("No errors should be detected: ", err)
+	}
+	if pkg.Description != "A package; with a semicolon" {
+		t.Error("pkg.Description incorrect: ", pkg.Description)
+	}
+	if len(details.Required) != 2 || details.Required[1].Name != "s2" ||
+		details.Required[1].Version != "1.10.0" {
+		t.Error("details.Required incorrect: ", details.Required)
+	}
+}
+
+func TestParsePackageDefinition_caseSensitive(t *testing.T) {
+	pkg := Package{Name: "foo", LatestVersion: "1.2.3"}
+	var details Details
+	err := parsePackageDefinitionTester(&pkg, &details, `(define-package "foo" "1.2.3" "A sample package"
+  '((Mixed-Case "1.0.0")) :URL "http://example.com/foo")`)
+	if err != nil {
+		t.Fatal("No errors should be detected: ", err)
+	}
+	if len(details.Required) != 1 || details.Required[0].Name != "Mixed-Case" {
+		t.Error("Required package names should be kept as written, got", details.Required)
+	}
+	if details.URL != "" {
+		t.Error(":URL is not :url, but set details.URL to", details.URL)
+	}
+	// Old -pkg.el files may write define-package and quote in upper
+	// case, but the names they require are still kept as written.
+	details = Details{}
+	err = parsePackageDefinitionTester(&pkg, &details,
+		`(DEFINE-PACKAGE "foo" "1.2.3" "A sample package" (QUOTE ((REQ1 "1.0.0"))))`)
+	if err != nil || len(details.Required) != 1 || details.Required[0].Name != "REQ1" {
+		t.Error("Upper case -pkg.el file returned", details.Required, err)
+	}
+}
+
+func TestParsePackageDefinition_keywordArguments(t *testing.T) {
+	pkg := Package{Name: "foo", LatestVersion: "1.2.3"}
+	var details Details
+	err := parsePackageDefinitionTester(&pkg, &details, `(define-package "foo" "1.2.3" "A sample package"
+  '((req1 "1.0.0"))
+  :url "http://example.com/foo"
+  :keywords '("convenience" "tools")
+  :authors '(("Jane Doe" . "jane@example.com") ("John Roe"))
+  :maintainer '("Jane Doe" . "jane@example.com")
+  :commit "0123abcd"
+  :some-future-keyword 42)`)
+	if err != nil {
+		t.Fatal("No errors should be detected: ", err)
+	}
+	if details.URL != "http://example.com/foo" {
+		t.Error("details.URL incorrect: ", details.URL)
+	}
+	if len(details.Keywords) != 2 || details.Keywords[1] != "tools" {
+		t.Error("details.Keywords incorrect: ", details.Keywords)
+	}
+	if len(details.Authors) != 2 ||
+		details.Authors[0] != (Person{"Jane Doe", "jane@example.com"}) ||
+		details.Authors[1] != (Person{Name: "John Roe"}) {
+		t.Error("details.Authors incorrect: ", details.Authors)
+	}
+	if details.Maintainer == nil || *details.Maintainer != (Person{"Jane Doe", "jane@example.com"}) {
+		t.Error("details.Maintainer incorrect: ", details.Maintainer)
+	}
+	if details.Commit != "0123abcd" {
+		t.Error("details.Commit incorrect: ", details.Commit)
+	}
+	// Keyword arguments must come in pairs.
+	assertParsePackageFails(`(define-package "foo" "1.2.3" "A sample package" nil :url)`, &pkg, t)
 }
@@ -0,0 +1 @@
+../src/file_store.go
\ No newline at end of file
@@ -0,0 +1 @@
+../src/handlers.go
\ No newline at end of file
@@ -0,0 +1,365 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *MemoryStore) {
+	return newConfiguredTestServer(t, func(s *Server) {})
+}
+
+// newConfiguredTestServer lets configure change the Server before it
+// starts.
+func newConfiguredTestServer(t *testing.T, configure func(s *Server)) (*httptest.Server, *MemoryStore) {
+	store := NewMemoryStore()
+	s := &Server{
+		Store:     func(r *http.Request) PackageStore { return store },
+		Templates: template.Must(template.ParseGlob("../templates/*")),
+		Errorf:    func(r *http.Request, format string, args ...interface{}) { t.Logf(format, args...) },
+		Auth:      &BasicAuth{Passwords: testPasswords, Realm: "test"},
+	}
+	configure(s)
+	mux := http.NewServeMux()
+	s.Register(mux)
+	return httptest.NewServer(mux), store
+}
+
+// noRedirects makes the client return redirects instead of following
+// them, so tests can see where an upload redirects to.
+var noRedirects = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// testPasswords are the users of test servers.  Everyone's password is
+// "secret".
+var testPasswords = func() Passwords {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return Passwords{"alice": string(hash), "bob": string(hash), "carol": string(hash)}
+}()
+
+// testCSRF is the CSRF token that tests post forms with.
+const testCSRF = "test-csrf-token"
+
+// addCSRF gives req the cookie that testCSRF is checked against.
+func addCSRF(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: csrfCookie, Value: testCSRF})
+}
+
+// postAs posts a form to path as user, with testCSRF unless values has
+// a CSRF token of its own.
+func postAs(t *testing.T, ts *httptest.Server, user, path string, values url.Values) *http.Response {
+	if values == nil {
+		values = url.Values{}
+	}
+	if values.Get(csrfField) == "" {
+		values.Set(csrfField, testCSRF)
+	}
+	req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(user, "secret")
+	addCSRF(req)
+	resp, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// uploadFile uploads a file as alice.
+func uploadFile(t *testing.T, ts *httptest.Server, contentType string, contents string, fields map[string]string) *http.Response {
+	return uploadFileAs(t, ts, "alice", contentType, contents, fields)
+}
+
+func uploadFileAs(t *testing.T, ts *httptest.Server, user string, contentType string, contents string, fields map[string]string) *http.Response {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if _, ok := fields[csrfField]; !ok {
+		mw.WriteField(csrfField, testCSRF)
+	}
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(contents))
+	mw.Close()
+	req, err := http.NewRequest("POST", ts.URL+"/upload", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	addCSRF(req)
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+	resp, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func putFile(t *testing.T, ts *httptest.Server, query string, contents string) *http.Response {
+	req, err := http.NewRequest("PUT", ts.URL+"/upload?"+query, strings.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "secret")
+	resp, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func get(t *testing.T, ts *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func singleFile(version string) string {
+	return strings.Replace(sampleHeader, "0.1.2.3", version, 1)
+}
+
+func tarFile(t *testing.T, version string) string {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	WriteTarFile(t, tw, "sample-test-"+version+"/sample-test-pkg.el",
+		`(define-package "sample-test" "`+version+`" "A sample package")`)
+	WriteTarFile(t, tw, "sample-test-"+version+"/sample-test.el", "test contents")
+	tw.Close()
+	return buf.String()
+}
+
+func TestServer_uploadAndDownload(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	resp := uploadFile(t, ts, "text/x-emacs-lisp", singleFile("0.1.2.3"), nil)
+	if resp.StatusCode != http.StatusFound ||
+		resp.Header.Get("Location") != "/upload_complete.html?package=sample-test" {
+		t.Fatal("Upload should redirect to upload_complete.html, got", resp.Status, resp.Header.Get("Location"))
+	}
+	if code, body := get(t, ts, "/upload_complete.html?package=sample-test"); code != http.StatusOK ||
+		!strings.Contains(body, "A sample package") {
+		t.Error("upload_complete.html returned", code, body)
+	}
+	if code, body := get(t, ts, "/"); code != http.StatusOK || !strings.Contains(body, "sample-test") {
+		t.Error("Main page returned", code, body)
+	}
+	code, body := get(t, ts, "/packages/archive-contents")
+	if code != http.StatusOK || !strings.Contains(body, `(sample-test . [(0 1 2 3) ((req1 (1 0 0)) (req2 (2 0 0)) (req3 (3 0 0))) "A sample package" single`) {
+		t.Error("archive-contents returned", code, body)
+	}
+	if code, body := get(t, ts, "/packages/sample-test-0.1.2.3.el"); code != http.StatusOK || body != singleFile("0.1.2.3") {
+		t.Error("Download returned", code, body)
+	}
+	if code, body := get(t, ts, "/packages/sample-test-readme.txt"); code != http.StatusOK ||
+		body != "This is the package commentary,\nwhich spans multiple lines.\n" {
+		t.Error("Readme returned", code, body)
+	}
+	if code, _ := get(t, ts, "/packages/sample-test-9.9.el"); code != http.StatusNotFound {
+		t.Error("Missing version should be a 404, got", code)
+	}
+}
+
+func TestServer_versions(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	for _, version := range []string{"1.0", "1.1", "2.0-rc1"} {
+		if resp := uploadFile(t, ts, "text/x-emacs-lisp", singleFile(version), nil); resp.StatusCode != http.StatusFound {
+			t.Fatal("Uploading", version, "failed:", resp.Status)
+		}
+	}
+	code, body := get(t, ts, "/api/packages/sample-test/versions")
+	if code != http.StatusOK {
+		t.Fatal("Versions API returned", code, body)
+	}
+	var versions []VersionInfo
+	if err := json.Unmarshal([]byte(body), &versions); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || versions[0].Version != "2.0-rc1" || versions[0].File != "sample-test-2.0pre1.el" {
+		t.Error("Versions API returned", versions)
+	}
+	for i, v := range versions {
+		if v.UploadTime.IsZero() || i > 0 && v.UploadTime.After(versions[i-1].UploadTime) {
+			t.Error("Versions should have upload times, newest first, got", versions)
+		}
+	}
+	// Old versions can still be downloaded.
+	if code, body := get(t, ts, "/packages/sample-test-1.0.el"); code != http.StatusOK || body != singleFile("1.0") {
+		t.Error("Download of an old version returned", code, body)
+	}
+	if code, body := get(t, ts, "/versions.html?package=sample-test"); code != http.StatusOK ||
+		!strings.Contains(body, "sample-test-2.0pre1.el") {
+		t.Error("versions.html returned", code, body)
+	}
+	if code, _ := get(t, ts, "/api/packages/missing/versions"); code != http.StatusNotFound {
+		t.Error("Versions of a missing package should be a 404, got", code)
+	}
+}
+
+func TestServer_oldTarVersions(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	for _, version := range []string{"1.0", "1.1"} {
+		if resp := uploadFile(t, ts, "application/x-tar", tarFile(t, version), nil); resp.StatusCode != http.StatusFound {
+			t.Fatal("Uploading", version, "failed:", resp.Status)
+		}
+	}
+	for _, version := range []string{"1.0", "1.1"} {
+		if code, body := get(t, ts, "/packages/sample-test-"+version+".tar"); code != http.StatusOK || body != tarFile(t, version) {
+			t.Error("Download of version", version, "returned", code, len(body), "bytes")
+		}
+	}
+	// Only the latest version is in archive-contents.
+	if _, body := get(t, ts, "/packages/archive-contents"); !strings.Contains(body, "(sample-test . [(1 1)") ||
+		strings.Contains(body, "(1 0)") {
+		t.Error("archive-contents returned", body)
+	}
+	if code, body := get(t, ts, "/versions.html?package=sample-test"); code != http.StatusOK ||
+		!strings.Contains(body, "sample-test-1.0.tar") || !strings.Contains(body, "sample-test-1.1.tar") {
+		t.Error("versions.html returned", code, body)
+	}
+}
+
+func TestServer_packagePage(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("dep", "1.0", ""), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("app", "1.0", `(dep "1.0") (cl-lib "1.0") (missing "2.0")`), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", requiringFile("app", "1.1", `(dep "1.0") (cl-lib "1.0") (missing "2.0")`), nil)
+	code, body := get(t, ts, "/package/app")
+	if code != http.StatusOK {
+		t.Fatal("Package page returned", code, body)
+	}
+	for _, expected := range []string{
+		"A package with dependencies",
+		"package-install RET app RET",
+		`<a href="/package/dep">dep</a> 1.0`,
+		"(comes with Emacs 24.3)",
+		"missing 2.0 is not in the archive",
+		`<a href="/packages/app-1.0.el">1.0</a>`,
+		`<a href="/packages/app-1.1.el">1.1</a>`,
+		"Commentary",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Package page should contain %q, got %v", expected, body)
+		}
+	}
+	if _, body := get(t, ts, "/package/dep"); !strings.Contains(body, `<a href="/package/app">app</a> requires 1.0`) {
+		t.Error("Package page should show the dependents, got", body)
+	}
+	if _, body := get(t, ts, "/"); !strings.Contains(body, `<a href="/package/app">app</a>`) {
+		t.Error("The package list should link to the package pages, got", body)
+	}
+	for _, path := range []string{"/package/nothing", "/package/app/more"} {
+		if code, _ := get(t, ts, path); code != http.StatusNotFound {
+			t.Error(path, "should be a 404, got", code)
+		}
+	}
+}
+
+func TestServer_refusesOldVersions(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.1"), nil)
+	for _, version := range []string{"1.1", "1.0"} {
+		resp := uploadFile(t, ts, "text/x-emacs-lisp", singleFile(version), map[string]string{"force": "1"})
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusConflict || !strings.Contains(string(b), "1.1") {
+			t.Error("Uploading", version, "over 1.1 should conflict, got", resp.Status, string(b))
+		}
+	}
+}
+
+func TestServer_sniffsContentType(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	// Browsers often send tarballs as application/octet-stream.
+	resp := uploadFile(t, ts, "application/octet-stream", tarFile(t, "1.0"), nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("Uploading a tar file failed:", resp.Status)
+	}
+	if code, body := get(t, ts, "/packages/archive-contents"); !strings.Contains(body, `"A sample package" tar`) {
+		t.Error("Tar file was not detected, archive-contents returned", code, body)
+	}
+	if code, body := get(t, ts, "/packages/sample-test-1.0.tar"); code != http.StatusOK || body != tarFile(t, "1.0") {
+		t.Error("Download returned", code)
+	}
+}
+
+func TestServer_put(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	resp := putFile(t, ts, "filename=sample-test.el", singleFile("1.0"))
+	if resp.StatusCode != http.StatusCreated ||
+		resp.Header.Get("Location") != "/upload_complete.html?package=sample-test" {
+		t.Fatal("PUT should create the package, got", resp.Status, resp.Header.Get("Location"))
+	}
+	if code, body := get(t, ts, "/packages/sample-test-1.0.el"); code != http.StatusOK || body != singleFile("1.0") {
+		t.Error("Download returned", code, body)
+	}
+	if resp := putFile(t, ts, "", singleFile("1.0")); resp.StatusCode != http.StatusConflict {
+		t.Error("Uploading the same version twice should conflict, got", resp.Status)
+	}
+}
+
+func TestServer_maxUploadSize(t *testing.T) {
+	ts, store := newConfiguredTestServer(t, func(s *Server) { s.MaxUploadSize = 100 })
+	defer ts.Close()
+	if resp := putFile(t, ts, "", singleFile("1.0")); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Oversized PUT should be refused, got", resp.Status)
+	}
+	if resp := uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Oversized POST should be refused, got", resp.Status)
+	}
+	if packages, _ := store.ListPackages(); len(packages) != 0 {
+		t.Error("Oversized uploads should not be stored, got", packages)
+	}
+}
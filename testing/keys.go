@@ -0,0 +1 @@
+../src/keys.go
\ No newline at end of file
@@ -0,0 +1,159 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// addKey registers entity's public key for user, through the keys page.
+func addKey(t *testing.T, ts *httptest.Server, user string, entity *openpgp.Entity) *http.Response {
+	return addSignedKey(t, ts, user, entity, entity, user)
+}
+
+// addSignedKey adds entity's public key as user, with a signature by
+// signer of the statement for signedFor.
+func addSignedKey(t *testing.T, ts *httptest.Server, user string, entity, signer *openpgp.Entity, signedFor string) *http.Response {
+	var key bytes.Buffer
+	w, _ := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+	sig := detachSign(t, signer, keyChallenge(signedFor, strings.TrimPrefix(ts.URL, "http://")))
+	return postAs(t, ts, user, "/keys.html", url.Values{"key": {key.String()}, "signature": {sig}})
+}
+
+func detachSign(t *testing.T, entity *openpgp.Entity, contents string) string {
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, entity, strings.NewReader(contents), nil); err != nil {
+		t.Fatal(err)
+	}
+	return sig.String()
+}
+
+func TestUploaderSignatures(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	alice, bob := testEntity(t, "alice"), testEntity(t, "bob")
+	v1 := singleFile("1.0")
+	resp := uploadFile(t, ts, "text/x-emacs-lisp", v1, map[string]string{"signature": detachSign(t, alice, v1)})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Signed upload without a registered key should fail, got", resp.Status)
+	}
+	if resp := addKey(t, ts, "alice", alice); resp.StatusCode != http.StatusFound {
+		t.Fatal("Adding a key failed:", resp.Status)
+	}
+	if resp := addKey(t, ts, "alice", alice); resp.StatusCode != http.StatusFound {
+		t.Error("Adding a key again should succeed, got", resp.Status)
+	}
+	// Only the key's holder can sign the statement, which names who is
+	// adding the key.
+	if resp := addSignedKey(t, ts, "bob", alice, bob, "bob"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Adding someone else's key without their signature should fail, got", resp.Status)
+	}
+	if resp := addSignedKey(t, ts, "bob", alice, alice, "alice"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Adding someone else's key with their signature for themselves should fail, got", resp.Status)
+	}
+	addKey(t, ts, "bob", bob)
+	if keys, _ := store.ListKeys("bob"); len(keys) != 1 || !strings.HasPrefix(keys[0].Identity, "bob ") {
+		t.Error("bob should have only their own key, got", keys)
+	}
+	resp = uploadFile(t, ts, "text/x-emacs-lisp", v1, map[string]string{"signature": detachSign(t, alice, v1)})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("Signed upload failed:", resp.Status)
+	}
+	code, sig := get(t, ts, "/packages/sample-test-1.0.el.asc")
+	if code != http.StatusOK {
+		t.Fatal("Could not get the uploader's signature:", code)
+	}
+	signer, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{alice}, strings.NewReader(v1), strings.NewReader(sig))
+	if err != nil || signer != alice {
+		t.Error("Served signature does not check:", err)
+	}
+	var versions []VersionInfo
+	getJSON(t, ts, "/api/packages/sample-test/versions", &versions)
+	if len(versions) != 1 || versions[0].SignedBy == "" {
+		t.Error("Version should be shown as signed, got", versions)
+	}
+
+	v2 := singleFile("1.1")
+	resp = uploadFile(t, ts, "text/x-emacs-lisp", v2, map[string]string{"signature": detachSign(t, alice, v1)})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Signature of another file should be rejected, got", resp.Status)
+	}
+	// bob's key is registered, but bob isn't an owner.
+	resp = uploadFile(t, ts, "text/x-emacs-lisp", v2, map[string]string{"signature": detachSign(t, bob, v2)})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Signature by someone who isn't an owner should be rejected, got", resp.Status)
+	}
+	if _, err := store.GetVersion("sample-test", mustParseVersion(t, "1.1")); err != ErrNotFound {
+		t.Error("Rejected version should not be stored, got", err)
+	}
+
+	// Signatures sent with the body are in a header, and may be binary.
+	var binary bytes.Buffer
+	openpgp.DetachSign(&binary, alice, strings.NewReader(v2), nil)
+	req, _ := http.NewRequest("PUT", ts.URL+"/upload?filename=sample-test.el", strings.NewReader(v2))
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(binary.Bytes()))
+	resp, err = noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("PUT with a signature failed:", resp.Status)
+	}
+	if code, _ := get(t, ts, "/packages/sample-test-1.1.el.asc"); code != http.StatusOK {
+		t.Error("Could not get the signature of a PUT upload:", code)
+	}
+
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.2"), nil)
+	if code, _ := get(t, ts, "/packages/sample-test-1.2.el.asc"); code != http.StatusNotFound {
+		t.Error("Unsigned version should have no uploader's signature, got", code)
+	}
+}
+
+func TestUploaderSignatures_compressed(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	alice := testEntity(t, "alice")
+	addKey(t, ts, "alice", alice)
+	tar := tarFile(t, "1.0")
+	compressed := gzipped(tar)
+	// The tar is served uncompressed, so the signature must be of that.
+	resp := uploadFile(t, ts, "application/gzip", compressed, map[string]string{"signature": detachSign(t, alice, compressed)})
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), "uncompressed tar") {
+		t.Error("Signature of the compressed file should be rejected, got", resp.Status, string(b))
+	}
+	resp = uploadFile(t, ts, "application/gzip", compressed, map[string]string{"signature": detachSign(t, alice, tar)})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("Signed compressed upload failed:", resp.Status)
+	}
+	_, sig := get(t, ts, "/packages/sample-test-1.0.tar.asc")
+	_, served := get(t, ts, "/packages/sample-test-1.0.tar")
+	if _, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{alice}, strings.NewReader(served), strings.NewReader(sig)); err != nil {
+		t.Error("Served signature does not check against the served tar:", err)
+	}
+}
@@ -0,0 +1 @@
+../src/keywords.go
\ No newline at end of file
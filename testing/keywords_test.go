@@ -0,0 +1,78 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServer_keywords(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", ";;; single.el --- A single file package\n"+
+		";; Version: 1.0\n;; Keywords: Tools, convenience\n;;; Code:\n", nil)
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	WriteTarFile(t, tw, "multi-1.0/multi-pkg.el",
+		`(define-package "multi" "1.0" "A multi file package" nil :keywords '("tools" "c"))`)
+	tw.Close()
+	if resp := uploadFile(t, ts, "application/x-tar", buf.String(), nil); resp.StatusCode != http.StatusFound {
+		t.Fatal("Upload failed:", resp.Status)
+	}
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("other", "1.0", "Not about tools", "Tools."), nil)
+
+	_, body := get(t, ts, "/packages/archive-contents")
+	if !strings.Contains(body, `(:keywords "Tools" "convenience")`) || !strings.Contains(body, `(:keywords "tools" "c")`) {
+		t.Error("archive-contents should have the keywords, got", body)
+	}
+	code, body := get(t, ts, "/keywords/")
+	if code != http.StatusOK || !strings.Contains(body, `<a href="/keywords/tools">tools</a> (2)`) ||
+		!strings.Contains(body, `<a href="/keywords/convenience">convenience</a> (1)`) {
+		t.Error("/keywords/ should list every keyword, got", code, body)
+	}
+	for _, test := range []struct {
+		path     string
+		expected []string
+	}{
+		{"/keywords/tools", []string{"multi", "single"}},
+		{"/keywords/TOOLS", []string{"multi", "single"}},
+		{"/keywords/convenience", []string{"single"}},
+		{"/keywords/c", []string{"multi"}},
+	} {
+		code, body := get(t, ts, test.path)
+		if code != http.StatusOK {
+			t.Error(test.path, "returned", code, body)
+			continue
+		}
+		if strings.Contains(body, `<a href="/package/other">`) {
+			t.Error(test.path, "should only list packages with the keyword, got", body)
+		}
+		for _, name := range test.expected {
+			if !strings.Contains(body, `<a href="/package/`+name+`">`) {
+				t.Error(test.path, "should list", name, "got", body)
+			}
+		}
+	}
+	if code, _ := get(t, ts, "/keywords/nothing"); code != http.StatusNotFound {
+		t.Error("A keyword no package has should be a 404, got", code)
+	}
+	if _, body := get(t, ts, "/package/single"); !strings.Contains(body, `<a href="/keywords/Tools">Tools</a>`) {
+		t.Error("The package page should link to its keywords, got", body)
+	}
+}
@@ -0,0 +1 @@
+../src/memory_store.go
\ No newline at end of file
@@ -0,0 +1 @@
+../src/oidc.go
\ No newline at end of file
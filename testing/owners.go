@@ -0,0 +1 @@
+../src/owners.go
\ No newline at end of file
@@ -0,0 +1,91 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func changeOwners(t *testing.T, ts *httptest.Server, user string, values url.Values) *http.Response {
+	values.Set("package", "sample-test")
+	return postAs(t, ts, user, "/owners", values)
+}
+
+func TestServer_ownership(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	if resp := uploadFileAs(t, ts, "alice", "text/x-emacs-lisp", singleFile("1.0"), nil); resp.StatusCode != http.StatusFound {
+		t.Fatal("Uploading a new package failed:", resp.Status)
+	}
+	if p, _ := store.GetPackage("sample-test"); len(p.Owners) != 1 || p.Owners[0] != "alice" {
+		t.Fatal("The first uploader should own the package, got", p.Owners)
+	}
+	if resp := uploadFileAs(t, ts, "bob", "text/x-emacs-lisp", singleFile("1.1"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Error("Upload by someone who isn't an owner should be forbidden, got", resp.Status)
+	}
+	if resp := changeOwners(t, ts, "bob", url.Values{"add": {"bob"}}); resp.StatusCode != http.StatusForbidden {
+		t.Error("Someone who isn't an owner should not be able to add owners, got", resp.Status)
+	}
+	if resp := changeOwners(t, ts, "alice", url.Values{"add": {"bob"}}); resp.StatusCode != http.StatusFound {
+		t.Fatal("Adding a co-maintainer failed:", resp.Status)
+	}
+	if resp := uploadFileAs(t, ts, "bob", "text/x-emacs-lisp", singleFile("1.1"), nil); resp.StatusCode != http.StatusFound {
+		t.Error("Upload by a co-maintainer failed:", resp.Status)
+	}
+	if p, _ := store.GetPackage("sample-test"); len(p.Owners) != 2 || p.LatestVersion != "1.1" {
+		t.Error("Uploading a new version should keep the owners, got", p.Owners, p.LatestVersion)
+	}
+	if code, body := get(t, ts, "/owners.html?package=sample-test"); code != http.StatusOK ||
+		!strings.Contains(body, "alice") || !strings.Contains(body, "bob") {
+		t.Error("owners.html returned", code, body)
+	}
+	if resp := changeOwners(t, ts, "bob", url.Values{"remove": {"alice"}}); resp.StatusCode != http.StatusFound {
+		t.Fatal("Removing an owner failed:", resp.Status)
+	}
+	if resp := uploadFileAs(t, ts, "alice", "text/x-emacs-lisp", singleFile("1.2"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Error("Upload by a removed owner should be forbidden, got", resp.Status)
+	}
+	if resp := changeOwners(t, ts, "bob", url.Values{"remove": {"bob"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Removing the last owner should fail, got", resp.Status)
+	}
+}
+
+func TestServer_adminsCanUploadAnything(t *testing.T) {
+	ts, store := newConfiguredTestServer(t, func(s *Server) {
+		s.IsAdmin = func(r *http.Request) bool {
+			user, _, _ := r.BasicAuth()
+			return user == "carol"
+		}
+	})
+	defer ts.Close()
+	// Packages uploaded before owners were recorded have none.
+	store.PutPackage(&Package{Name: "sample-test", LatestVersion: "1.0"})
+	if resp := uploadFileAs(t, ts, "alice", "text/x-emacs-lisp", singleFile("1.1"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Error("Upload to a package with no owners should be forbidden, got", resp.Status)
+	}
+	if resp := changeOwners(t, ts, "carol", url.Values{"add": {"alice"}}); resp.StatusCode != http.StatusFound {
+		t.Fatal("Admin adding an owner failed:", resp.Status)
+	}
+	if resp := uploadFileAs(t, ts, "alice", "text/x-emacs-lisp", singleFile("1.1"), nil); resp.StatusCode != http.StatusFound {
+		t.Error("Upload by the new owner failed:", resp.Status)
+	}
+	if resp := uploadFileAs(t, ts, "carol", "text/x-emacs-lisp", singleFile("1.2"), nil); resp.StatusCode != http.StatusFound {
+		t.Error("Upload by an admin failed:", resp.Status)
+	}
+}
@@ -0,0 +1 @@
+../src/readme.go
\ No newline at end of file
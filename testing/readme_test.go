@@ -0,0 +1,73 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRenderReadme(t *testing.T) {
+	for _, test := range []struct {
+		readme, format string
+		expected       []string
+		unexpected     []string
+	}{
+		{"* Usage\nRun /this/ first.\n", "org",
+			[]string{"<h2 id=\"headline-1\">\nUsage\n</h2>", "<em>this</em>"}, nil},
+		{"# Usage\n\nRun *this* first.\n\n<script>alert(1)</script>\n", "markdown",
+			[]string{"Usage</h1>", "<em>this</em>"}, []string{"<script", "alert(1)"}},
+		{"#+HTML: <script>alert(1)</script>\n[[javascript:alert(2)][link]]\n", "org",
+			nil, []string{"<script", "javascript:"}},
+		{"Use <b>this</b> & that", "text",
+			[]string{"<pre>Use &lt;b&gt;this&lt;/b&gt; &amp; that</pre>"}, nil},
+		{"* Not a heading", "",
+			[]string{"<pre>* Not a heading</pre>"}, nil},
+	} {
+		html := string(renderReadme(test.readme, test.format))
+		for _, e := range test.expected {
+			if !strings.Contains(html, e) {
+				t.Errorf("Rendering %q as %q should contain %q, got %v", test.readme, test.format, e, html)
+			}
+		}
+		for _, u := range test.unexpected {
+			if strings.Contains(html, u) {
+				t.Errorf("Rendering %q as %q should not contain %q, got %v", test.readme, test.format, u, html)
+			}
+		}
+	}
+}
+
+func TestServer_readmes(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	WriteTarFile(t, tw, "sample-test-1.0/sample-test-pkg.el", `(define-package "sample-test" "1.0" "A sample package")`)
+	WriteTarFile(t, tw, "sample-test-1.0/README.md", "# Sample\n\nA *sample* package.\n")
+	tw.Close()
+	if resp := uploadFile(t, ts, "application/x-tar", buf.String(), nil); resp.StatusCode != http.StatusFound {
+		t.Fatal("Upload failed:", resp.Status)
+	}
+	if _, body := get(t, ts, "/package/sample-test"); !strings.Contains(body, "<em>sample</em>") {
+		t.Error("The package page should render the readme, got", body)
+	}
+	if _, body := get(t, ts, "/packages/sample-test-readme.txt"); body != "# Sample\n\nA *sample* package.\n" {
+		t.Error("package.el should get the readme as it was uploaded, got", body)
+	}
+}
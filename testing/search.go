@@ -0,0 +1 @@
+../src/search.go
\ No newline at end of file
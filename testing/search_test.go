@@ -0,0 +1,197 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// describedFile is a single file package with the given description
+// and commentary.
+func describedFile(name, version, description, commentary string) string {
+	return ";;; " + name + ".el --- " + description + "\n" +
+		";; Author: Ann Author <ann@example.com>\n" +
+		";; Version: " + version + "\n" +
+		";;; Commentary:\n;; " + commentary + "\n;;; Code:\n"
+}
+
+// searchNames returns the names of the packages found searching for
+// query, in order.
+func searchNames(t *testing.T, ts *httptest.Server, query string) []string {
+	var results []SearchResult
+	getJSON(t, ts, "/api/search?"+url.Values{"q": {query}}.Encode(), &results)
+	names := make([]string, 0)
+	for _, result := range results {
+		names = append(names, result.Package.Name)
+	}
+	return names
+}
+
+func TestSearchTerms(t *testing.T) {
+	terms := searchTerms("Dash-functional: a *modern* list API, v2 (Ünïcode)")
+	expected := []string{"dash", "functional", "modern", "list", "api", "v2", "ünïcode"}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Error("Expected", expected, "got", terms)
+	}
+}
+
+func TestSearchTerms_stopWords(t *testing.T) {
+	terms := searchTerms("The mode for the Go language")
+	expected := []string{"mode", "go", "language"}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Error("Expected terms", expected, "got", terms)
+	}
+}
+
+func TestPackageTerms_limit(t *testing.T) {
+	var readme []string
+	for i := 0; i < 2*maxPackageTerms; i++ {
+		readme = append(readme, "word"+strconv.Itoa(i))
+	}
+	details, _ := encodeDetails(&Details{Readme: strings.Join(readme, " "), Keywords: []string{"lists"}})
+	terms := packageTerms(&Package{Name: "big", Description: "A big package", Details: *details})
+	if len(terms) != maxPackageTerms {
+		t.Error("Expected", maxPackageTerms, "terms, got", len(terms))
+	}
+	for _, term := range []string{"big", "package", "lists", "word0"} {
+		if terms[term] == 0 {
+			t.Error("Expected", term, "to be indexed")
+		}
+	}
+	if _, ok := terms["word999"]; ok {
+		t.Error("The end of a long README should not be indexed")
+	}
+}
+
+// countingStore counts the transactions run on a store.
+type countingStore struct {
+	PackageStore
+	transactions int
+}
+
+func (s *countingStore) Transaction(f func(PackageStore) error) error {
+	s.transactions++
+	return s.PackageStore.Transaction(f)
+}
+
+func TestServer_updateSearchIndex(t *testing.T) {
+	store := &countingStore{PackageStore: NewMemoryStore()}
+	s := &Server{Errorf: func(r *http.Request, format string, args ...interface{}) { t.Errorf(format, args...) }}
+	terms := make(map[string]int)
+	for i := 0; i < 45; i++ {
+		terms["term"+strconv.Itoa(i)] = fieldReadme
+	}
+	s.updateSearchIndex(nil, store, "big", nil, terms)
+	if store.transactions != 3 {
+		t.Error("45 terms should be updated in 3 transactions, used", store.transactions)
+	}
+	if postings, _ := store.GetPostings("term44"); len(postings) != 1 || postings[0].Name != "big" {
+		t.Error("Expected big to be indexed under term44, got", postings)
+	}
+	// Only the terms that changed are updated.
+	store.transactions = 0
+	updated := map[string]int{"term0": fieldReadme | fieldName}
+	for term := range terms {
+		if term != "term0" && term != "term1" {
+			updated[term] = fieldReadme
+		}
+	}
+	s.updateSearchIndex(nil, store, "big", terms, updated)
+	if store.transactions != 1 {
+		t.Error("Two changed terms should be updated in one transaction, used", store.transactions)
+	}
+	if postings, _ := store.GetPostings("term1"); postings != nil {
+		t.Error("term1 should have been removed, got", postings)
+	}
+}
+
+func TestServer_search(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("listy", "1.0", "Helpers for lists", "Works well with dash."), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("dash-functional", "1.0", "Useful combinators", "Combinators."), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("dash", "1.0", "A modern list library", "Lists."), nil)
+
+	expected := []string{"dash", "dash-functional", "listy"}
+	if names := searchNames(t, ts, "Dash"); !reflect.DeepEqual(names, expected) {
+		t.Error("Searching for dash should find", expected, "got", names)
+	}
+	expected = []string{"dash-functional"}
+	if names := searchNames(t, ts, "dash combinators"); !reflect.DeepEqual(names, expected) {
+		t.Error("Searching for two words should find", expected, "got", names)
+	}
+	expected = []string{"dash", "dash-functional", "listy"}
+	if names := searchNames(t, ts, "ann author"); !reflect.DeepEqual(names, expected) {
+		t.Error("Searching by author should find", expected, "got", names)
+	}
+	if names := searchNames(t, ts, "nothing"); len(names) != 0 {
+		t.Error("Searching for an unknown word should find nothing, got", names)
+	}
+	if code, _ := get(t, ts, "/api/search?q=-"); code != http.StatusBadRequest {
+		t.Error("Searching for no words should be a 400, got", code)
+	}
+	// A package whose name is the query comes first, whatever its case.
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("zlib-extra", "1.0", "More zlib", "Uses zlib."), nil)
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("ZLib", "1.0", "Compression", "Deflate."), nil)
+	expected = []string{"ZLib", "zlib-extra"}
+	for _, query := range []string{"zlib", "ZLib", " zLIB "} {
+		if names := searchNames(t, ts, query); !reflect.DeepEqual(names, expected) {
+			t.Error("Searching for", query, "should find", expected, "got", names)
+		}
+	}
+	code, body := get(t, ts, "/search.html?q=lists")
+	if code != http.StatusOK || !strings.Contains(body, `<a href="/package/dash">dash</a>`) ||
+		!strings.Contains(body, `<a href="/package/listy">listy</a>`) {
+		t.Error("search.html should list the results, got", code, body)
+	}
+
+	// A new version is indexed in place of the old one.
+	uploadFile(t, ts, "text/x-emacs-lisp", describedFile("listy", "1.1", "Helpers for lists", "Standalone."), nil)
+	expected = []string{"dash", "dash-functional"}
+	if names := searchNames(t, ts, "dash"); !reflect.DeepEqual(names, expected) {
+		t.Error("After listy stopped mentioning dash expected", expected, "got", names)
+	}
+	postAs(t, ts, "alice", "/delete.html", url.Values{"package": {"dash-functional"}})
+	expected = []string{"dash"}
+	if names := searchNames(t, ts, "dash"); !reflect.DeepEqual(names, expected) {
+		t.Error("After deleting dash-functional expected", expected, "got", names)
+	}
+	if postings, _ := store.GetPostings("combinators"); postings != nil {
+		t.Error("Terms only a deleted package had should be removed, got", postings)
+	}
+
+	store.PutPostings("dash", nil)
+	store.PutPostings("stale", []Posting{{"listy", fieldName}})
+	admin, _ := newConfiguredTestServer(t, func(s *Server) {
+		s.Store = func(r *http.Request) PackageStore { return store }
+		s.IsAdmin = func(r *http.Request) bool { return true }
+	})
+	defer admin.Close()
+	if resp := postAs(t, admin, "carol", "/admin/reindex", nil); resp.StatusCode != http.StatusOK {
+		t.Fatal("Reindexing failed:", resp.Status)
+	}
+	if names := searchNames(t, ts, "dash"); !reflect.DeepEqual(names, expected) {
+		t.Error("After reindexing expected", expected, "got", names)
+	}
+	if postings, _ := store.GetPostings("stale"); postings != nil {
+		t.Error("Reindexing should remove stale terms, got", postings)
+	}
+}
@@ -0,0 +1 @@
+../src/sexp_printer.go
\ No newline at end of file
@@ -0,0 +1,101 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var printedSexps = []struct {
+	sexp     Sexp
+	expected string
+}{
+	{String(`say "hi" \ bye`), `"say \"hi\" \\ bye"`},
+	{Symbol("foo-bar"), `foo-bar`},
+	{Symbol("foo bar"), `foo\ bar`},
+	{Symbol("a(b)"), `a\(b\)`},
+	{Symbol("42"), `\42`},
+	{Symbol("1.5"), `\1.5`},
+	{Symbol("?x"), `\?x`},
+	{Symbol(""), `##`},
+	{Integer(-3), `-3`},
+	{Float(2), `2.0`},
+	{sexpList(), `nil`},
+	{sexpList(Symbol("a"), Integer(1)), `(a 1)`},
+	{sexpCons(Symbol("a"), String("b")), `(a . "b")`},
+	{sexpCons(Symbol("a"), sexpCons(String("b"), String("c"))), `(a "b" . "c")`},
+	{Vector{Integer(1), sexpList(Symbol("x"))}, `[1 (x)]`},
+}
+
+func TestPrintSexp(t *testing.T) {
+	for _, p := range printedSexps {
+		if s := sexpString(p.sexp); s != p.expected {
+			t.Errorf("Printing %#v: expected %s, got %s", p.sexp, p.expected, s)
+		}
+	}
+}
+
+func TestPrintSexp_roundTrip(t *testing.T) {
+	for _, p := range printedSexps {
+		read, err := readSexp(sexpString(p.sexp))
+		if err != nil {
+			t.Errorf("Could not read back %s: %v", sexpString(p.sexp), err)
+			continue
+		}
+		if sexpString(read) != p.expected {
+			t.Errorf("Round trip of %s gave %s", p.expected, sexpString(read))
+		}
+	}
+}
+
+func TestArchiveContents(t *testing.T) {
+	details := Details{
+		Required: []PackageRef{{Name: "req1", Version: "1.0"}},
+		URL:      "http://example.com/\"quoted\"",
+		Keywords: []string{"tools"},
+		Authors:  []Person{{Name: "Jane Doe", Email: "jane@example.com"}},
+	}
+	b, err := encodeDetails(&details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages := []*Package{
+		{Name: "foo", LatestVersion: "1.2.3", Description: `A "quoted" \ description`, Type: TAR, Details: *b},
+		{Name: "bad", LatestVersion: "1..2", Description: "Skipped", Type: SINGLE, Details: *b},
+	}
+	contents, errs := archiveContents(packages)
+	if len(errs) != 1 {
+		t.Error("Expected one error for the bad version, got", errs)
+	}
+	var buf bytes.Buffer
+	if err := writeArchiveContents(&buf, contents); err != nil {
+		t.Fatal(err)
+	}
+	expected := `(1
+(foo . [(1 2 3) ((req1 (1 0))) "A \"quoted\" \\ description" tar ((:url . "http://example.com/\"quoted\"") (:keywords "tools") (:authors ("Jane Doe" . "jane@example.com")))]))
+`
+	if buf.String() != expected {
+		t.Errorf("Expected archive-contents\n%s\ngot\n%s", expected, buf.String())
+	}
+	read, err := readSexp(buf.String())
+	if err != nil {
+		t.Fatal("archive-contents should be readable: ", err)
+	}
+	if sexpString(read) != strings.Replace(strings.TrimSpace(expected), "\n", " ", -1) {
+		t.Error("archive-contents did not read back the same: ", sexpString(read))
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func list(elems ...Sexp) *List {
+	return &List{Elems: elems}
+}
+
+var validSexps = []struct {
+	text     string
+	expected Sexp
+}{
+	{`foo`, Symbol("foo")},
+	{`s2`, Symbol("s2")},
+	{`1+`, Symbol("1+")},
+	{`foo\ bar`, Symbol("foo bar")},
+	{`\1`, Symbol("1")},
+	{`-`, Symbol("-")},
+	{`42`, Integer(42)},
+	{`-7`, Integer(-7)},
+	{`+3.`, Integer(3)},
+	{`1.5`, Float(1.5)},
+	{`.5`, Float(0.5)},
+	{`1e3`, Float(1000)},
+	{`#x1F`, Integer(31)},
+	{`#b101`, Integer(5)},
+	{`#24r1k`, Integer(44)},
+	{`"a \"quoted\" \\ string\n"`, String("a \"quoted\" \\ string\n")},
+	{`"\x41é\101\s"`, String("Aé\x41 ")},
+	{`?a`, Char('a')},
+	{`?\n`, Char('\n')},
+	{`?\C-a`, Char(1)},
+	{`?\^?`, Char(127)},
+	{`?\M-x`, Char('x' | charMeta)},
+	{`()`, nilSymbol},
+	{`(a . b)`, &List{Elems: []Sexp{Symbol("a")}, Dotted: Symbol("b")}},
+	{`(a b . (c))`, &List{Elems: []Sexp{Symbol("a"), Symbol("b")}, Dotted: list(Symbol("c"))}},
+	{`[1 "two" three]`, Vector{Integer(1), String("two"), Symbol("three")}},
+	{`'x`, list(quoteSymbol, Symbol("x"))},
+	{`#'car`, list(functionSymbol, Symbol("car"))},
+	{"`(a ,b ,@c)", list(backquoteSymbol,
+		list(Symbol("a"), list(commaSymbol, Symbol("b")), list(commaSplicSymbol, Symbol("c"))))},
+	{"; comment\n(a ; another\n b)", list(Symbol("a"), Symbol("b"))},
+}
+
+func TestReadSexp_valid(t *testing.T) {
+	for _, v := range validSexps {
+		s, err := readSexp(v.text)
+		if err != nil {
+			t.Errorf("Reading %q returned error: %v", v.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(s, v.expected) {
+			t.Errorf("Reading %q: expected %#v, got %#v", v.text, v.expected, s)
+		}
+	}
+}
+
+func TestReadSexp_invalid(t *testing.T) {
+	for _, text := range []string{``, `(a b`, `"unterminated`, `)`, `(a . )`,
+		`(. a)`, `(a . b c)`, `[a)`, `#s(foo)`, `a b`, `?\u12`} {
+		if s, err := readSexp(text); err == nil {
+			t.Errorf("Reading %q should have failed, got %#v", text, s)
+		}
+	}
+}
+
+func TestReadSexp_tooDeep(t *testing.T) {
+	nested := strings.Repeat("(", maxSexpDepth-1) + strings.Repeat(")", maxSexpDepth-1)
+	if _, err := readSexp(nested); err != nil {
+		t.Errorf("Reading forms nested %d deep failed: %v", maxSexpDepth-1, err)
+	}
+	for _, text := range []string{
+		strings.Repeat("(", 1<<20),
+		strings.Repeat("[", 1<<20),
+		strings.Repeat("'", 1<<20) + "a",
+		"?" + strings.Repeat(`\C-`, 1<<20) + "a",
+		`"` + strings.Repeat(`\^`, 1<<20) + `a"`,
+	} {
+		if _, err := readSexp(text); err == nil || !strings.Contains(err.Error(), "nested") {
+			t.Errorf("Reading %q... should fail as too deeply nested, got %v", text[:10], err)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	quoted, _ := readSexp("'(a b)")
+	if !reflect.DeepEqual(unquote(quoted), list(Symbol("a"), Symbol("b"))) {
+		t.Error("Expected (a b), got", unquote(quoted))
+	}
+	// Symbols are case-sensitive, so QUOTE isn't quote.
+	upper, _ := readSexp("(QUOTE (a b))")
+	if !reflect.DeepEqual(unquote(upper), upper) {
+		t.Error("(QUOTE (a b)) should be left alone, got", unquote(upper))
+	}
+}
+
+func TestSexpReader_multipleForms(t *testing.T) {
+	sr := NewSexpReader(strings.NewReader("(a) [b]\n;; done\n"))
+	for i := 0; i < 2; i++ {
+		if _, err := sr.Read(); err != nil {
+			t.Fatal("Unexpected error reading form", i, ":", err)
+		}
+	}
+	if _, err := sr.Read(); err != io.EOF {
+		t.Fatal("Expected io.EOF after the last form, got", err)
+	}
+}
@@ -0,0 +1 @@
+../src/signing.go
\ No newline at end of file
@@ -0,0 +1,128 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// testEntity makes a key pair small enough to make quickly.
+func testEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "test", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+// testKey makes a small armored private key, as it would be kept in the
+// archive's key file.
+func testKey(t *testing.T) string {
+	entity := testEntity(t, "elpa")
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.String()
+}
+
+// checkSignature checks that the file at path is signed by keyring.
+func checkSignature(t *testing.T, keyring openpgp.EntityList, ts *httptest.Server, path string) {
+	code, contents := get(t, ts, path)
+	if code != http.StatusOK {
+		t.Fatal("Could not get", path, code)
+	}
+	code, sig := get(t, ts, path+".sig")
+	if code != http.StatusOK {
+		t.Fatal("Could not get the signature of", path, code)
+	}
+	_, err := openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(contents), strings.NewReader(sig))
+	if err != nil {
+		t.Error("Bad signature for", path, err)
+	}
+}
+
+func TestSigning(t *testing.T) {
+	signer, err := NewSigner(strings.NewReader(testKey(t)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, store := newConfiguredTestServer(t, func(s *Server) { s.Signer = signer })
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+	v1, _ := ParseVersion("1.0")
+	contents, err := store.GetVersion("sample-test", v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents.Signature == nil {
+		t.Error("Uploaded version should have been signed")
+	}
+	code, key := get(t, ts, "/signing-key.asc")
+	if code != http.StatusOK {
+		t.Fatal("Could not get the public key", code)
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSignature(t, keyring, ts, "/packages/sample-test-1.0.el")
+	checkSignature(t, keyring, ts, "/packages/archive-contents")
+
+	// Versions uploaded before the archive was signed are signed when
+	// their signature is asked for.
+	contents.Signature = nil
+	store.PutVersion("sample-test", v1, contents)
+	checkSignature(t, keyring, ts, "/packages/sample-test-1.0.el")
+	if saved, _ := store.GetVersion("sample-test", v1); saved.Signature == nil {
+		t.Error("The new signature should have been saved")
+	}
+
+	// A version uploaded again while the old file was being signed
+	// doesn't get the old file's signature.
+	replaced := *contents
+	replaced.BlobKey = "replaced"
+	store.PutVersion("sample-test", v1, &replaced)
+	if err := saveSignature(store, "sample-test", v1, contents.BlobKey, []byte("old signature")); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := store.GetVersion("sample-test", v1); saved.Signature != nil {
+		t.Error("A replaced version should not get the old file's signature, got", string(saved.Signature))
+	}
+}
+
+func TestNoSigning(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+	for _, path := range []string{"/packages/sample-test-1.0.el.sig", "/packages/archive-contents.sig", "/signing-key.asc"} {
+		if code, _ := get(t, ts, path); code != http.StatusNotFound {
+			t.Error("Expected a 404 without a signing key for", path, "got", code)
+		}
+	}
+}
@@ -0,0 +1 @@
+../src/snapshot.go
\ No newline at end of file
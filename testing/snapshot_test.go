@@ -0,0 +1,108 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getConditional gets path with the given request header set.
+func getConditional(t *testing.T, ts *httptest.Server, path, header, value string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Set(header, value)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestServer_archiveContentsSnapshot(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+	resp, body := getConditional(t, ts, "/packages/archive-contents", "If-None-Match", `"other"`)
+	etag, modified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK || etag == "" || modified == "" || !strings.Contains(body, "(1 0)") {
+		t.Fatal("archive-contents returned", resp.Status, resp.Header, body)
+	}
+	if resp, _ := getConditional(t, ts, "/packages/archive-contents", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Error("Expected 304 for a matching If-None-Match, got", resp.Status)
+	}
+	if resp, _ := getConditional(t, ts, "/packages/archive-contents", "If-Modified-Since", modified); resp.StatusCode != http.StatusNotModified {
+		t.Error("Expected 304 for If-Modified-Since the last change, got", resp.Status)
+	}
+	earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if resp, _ := getConditional(t, ts, "/packages/archive-contents", "If-Modified-Since", earlier); resp.StatusCode != http.StatusOK {
+		t.Error("Expected 200 for If-Modified-Since before the last change, got", resp.Status)
+	}
+
+	// Changes made without going through the server aren't seen until
+	// the next upload.
+	p, _ := store.GetPackage("sample-test")
+	p.Description = "Changed behind the server's back"
+	store.PutPackage(p)
+	if _, body := get(t, ts, "/packages/archive-contents"); strings.Contains(body, "behind") {
+		t.Error("archive-contents should be served from the snapshot, got", body)
+	}
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.1"), nil)
+	resp, body = getConditional(t, ts, "/packages/archive-contents", "If-None-Match", etag)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag || !strings.Contains(body, "(1 1)") {
+		t.Error("archive-contents after an upload returned", resp.Status, resp.Header, body)
+	}
+	// Two versions, and one snapshot.
+	if len(store.blobs) != 3 {
+		t.Error("Old snapshots should be deleted, have", len(store.blobs), "blobs")
+	}
+}
+
+func TestServer_archiveContentsReupload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elpa-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := newConfiguredTestServer(t, func(s *Server) {
+		s.Store = func(r *http.Request) PackageStore { return store }
+	})
+	defer ts.Close()
+	uploadFile(t, ts, "text/x-emacs-lisp", singleFile("1.0"), nil)
+	_, contents := get(t, ts, "/packages/archive-contents")
+
+	// The file store keeps identical files in one blob, so uploading
+	// archive-contents would share the snapshot's blob, which must
+	// not be deleted when the upload is refused.
+	if resp := uploadFileAs(t, ts, "", "text/plain", contents, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Anonymous upload should need a login, got", resp.Status)
+	}
+	if resp := uploadFile(t, ts, "text/plain", contents, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Uploading archive-contents should be refused, got", resp.Status)
+	}
+	if code, body := get(t, ts, "/packages/archive-contents"); code != http.StatusOK || body != contents {
+		t.Error("archive-contents after refused uploads of it returned", code, body)
+	}
+}
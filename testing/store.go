@@ -0,0 +1 @@
+../src/store.go
\ No newline at end of file
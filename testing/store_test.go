@@ -0,0 +1,323 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, store PackageStore) {
+	if _, err := store.GetPackage("foo"); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for a missing package, got", err)
+	}
+	for _, name := range []string{"foo", "bar"} {
+		if err := store.PutPackage(&Package{Name: name, LatestVersion: "1.0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := store.GetPackage("foo")
+	if err != nil || p.Name != "foo" || p.LatestVersion != "1.0" {
+		t.Fatal("GetPackage returned", p, err)
+	}
+	packages, err := store.ListPackages()
+	if err != nil || len(packages) != 2 {
+		t.Fatal("ListPackages returned", packages, err)
+	}
+
+	key, err := store.PutBlob(strings.NewReader("contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, _ := ParseVersion("1.0")
+	v2, _ := ParseVersion("2.0-rc1")
+	now := time.Now().UTC()
+	if err := store.PutVersion("foo", v1, &Contents{BlobKey: key, Version: "1.0", UploadTime: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutVersion("foo", v2, &Contents{BlobKey: key, Version: "2.0-rc1", UploadTime: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	// Versions can be found by any equivalent version string.
+	same, _ := ParseVersion("2.0pre1")
+	contents, err := store.GetVersion("foo", same)
+	if err != nil || contents.Version != "2.0-rc1" {
+		t.Fatal("GetVersion returned", contents, err)
+	}
+	versions, err := getVersions(store, "foo")
+	if err != nil || len(versions) != 2 || versions[0].Version != "2.0-rc1" {
+		t.Fatal("getVersions returned", versions, err)
+	}
+	if versions, err := store.ListVersions("bar"); err != nil || len(versions) != 0 {
+		t.Fatal("ListVersions for a package without versions returned", versions, err)
+	}
+
+	blob, err := store.OpenBlob(contents.BlobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(blob)
+	blob.Close()
+	if err != nil || string(b) != "contents" {
+		t.Fatal("OpenBlob returned", string(b), err)
+	}
+	unused, err := store.PutBlob(strings.NewReader("unused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteBlob(unused); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.OpenBlob(unused); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for a deleted blob, got", err)
+	}
+
+	err = store.Transaction(func(tx PackageStore) error {
+		p, err := tx.GetPackage("bar")
+		if err != nil {
+			return err
+		}
+		p.LatestVersion = "1.1"
+		return tx.PutPackage(p)
+	})
+	if p, _ := store.GetPackage("bar"); err != nil || p.LatestVersion != "1.1" {
+		t.Fatal("Transaction did not update the package:", err)
+	}
+
+	for i, user := range []string{"alice", "alice", "bob"} {
+		err := store.PutToken(&APIToken{Hash: hashToken(string(rune('a' + i))), User: user,
+			Packages: []string{"foo"}, Created: now.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := store.GetToken(hashToken("a"))
+	if err != nil || token.User != "alice" || len(token.Packages) != 1 {
+		t.Fatal("GetToken returned", token, err)
+	}
+	tokens, err := store.ListTokens("alice")
+	if err != nil || len(tokens) != 2 || tokens[0].Hash != hashToken("a") {
+		t.Fatal("ListTokens returned", tokens, err)
+	}
+	if err := store.DeleteToken(hashToken("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetToken(hashToken("a")); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for a deleted token, got", err)
+	}
+
+	for i, user := range []string{"alice", "bob", "alice"} {
+		err := store.PutKey(&PublicKey{Fingerprint: strings.Repeat(string(rune('A'+i)), 40), User: user,
+			Key: []byte("key"), Added: now.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := store.ListKeys("alice")
+	if err != nil || len(keys) != 2 || keys[0].ShortID() != "AAAAAAAA" || string(keys[1].Key) != "key" {
+		t.Fatal("ListKeys returned", keys, err)
+	}
+	if err := store.DeleteKey(keys[0].Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetKey(keys[0].Fingerprint); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for a deleted key, got", err)
+	}
+
+	if _, err := store.GetArchiveContents(); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound before the first snapshot, got", err)
+	}
+	snapshotKey, err := store.PutBlob(strings.NewReader("snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutArchiveContents(&Snapshot{BlobKey: snapshotKey, ETag: "abc", Modified: now}); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := store.GetArchiveContents(); err != nil || snapshot.ETag != "abc" || !snapshot.Modified.Equal(now) {
+		t.Fatal("GetArchiveContents returned", snapshot, err)
+	}
+	if err := store.DeleteBlob(snapshotKey); err != nil {
+		t.Fatal(err)
+	}
+	if blob, err := store.OpenBlob(snapshotKey); err != nil {
+		t.Fatal("The snapshot's blob should not be deleted, got", err)
+	} else {
+		blob.Close()
+	}
+
+	if dependents, err := store.GetDependents("foo"); err != nil || dependents != nil {
+		t.Fatal("GetDependents for a package without dependents returned", dependents, err)
+	}
+	if err := store.PutDependents("foo", []PackageRef{{"bar", "1.0"}, {"baz", "2.0"}}); err != nil {
+		t.Fatal(err)
+	}
+	if dependents, err := store.GetDependents("foo"); err != nil || len(dependents) != 2 || dependents[1] != (PackageRef{"baz", "2.0"}) {
+		t.Fatal("GetDependents returned", dependents, err)
+	}
+	if names, err := store.ListDependents(); err != nil || !reflect.DeepEqual(names, []string{"foo"}) {
+		t.Fatal("ListDependents returned", names, err)
+	}
+	if err := store.PutDependents("foo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if dependents, err := store.GetDependents("foo"); err != nil || dependents != nil {
+		t.Fatal("GetDependents after removing them returned", dependents, err)
+	}
+
+	if postings, err := store.GetPostings("word"); err != nil || postings != nil {
+		t.Fatal("GetPostings for an unindexed term returned", postings, err)
+	}
+	for _, term := range []string{"word", "other"} {
+		if err := store.PutPostings(term, []Posting{{"foo", fieldName}, {"bar", fieldReadme}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if postings, err := store.GetPostings("word"); err != nil || len(postings) != 2 || postings[1] != (Posting{"bar", fieldReadme}) {
+		t.Fatal("GetPostings returned", postings, err)
+	}
+	if err := store.PutPostings("other", nil); err != nil {
+		t.Fatal(err)
+	}
+	if terms, err := store.ListTerms(); err != nil || !reflect.DeepEqual(terms, []string{"word"}) {
+		t.Fatal("ListTerms returned", terms, err)
+	}
+
+	for _, c := range []DownloadCount{
+		{"foo", "1.0", "2013-05-01", 1, 2},
+		{"foo", "1.0", "2013-05-01", 1, 3},
+		{"foo", "1.0", "2013-05-01", 2, 1},
+		{"foo", "1.0", "2013-05-02", 1, 1},
+		{"bar", "1.0", "2013-05-01", 0, 1},
+		{"bar", "1.0", "2013-05-01", 0, -1},
+	} {
+		if err := store.AddDownloads(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectedCounts := []DownloadCount{
+		{"foo", "1.0", "2013-05-01", 1, 5},
+		{"foo", "1.0", "2013-05-01", 2, 1},
+		{"foo", "1.0", "2013-05-02", 1, 1},
+	}
+	if counts, err := store.ListDownloads("foo"); err != nil || !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatal("ListDownloads returned", counts, err)
+	}
+	if counts, err := store.ListDownloads("bar"); err != nil || len(counts) != 0 {
+		t.Fatal("Counts that add up to zero should be removed, got", counts, err)
+	}
+	if counts, err := store.ListDownloadsOn("2013-05-02"); err != nil || !reflect.DeepEqual(counts, expectedCounts[2:]) {
+		t.Fatal("ListDownloadsOn returned", counts, err)
+	}
+
+	if err := store.DeleteVersion("foo", v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetVersion("foo", v1); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for a deleted version, got", err)
+	}
+	if versions, err := store.ListVersions("foo"); err != nil || len(versions) != 1 {
+		t.Fatal("ListVersions after deleting a version returned", versions, err)
+	}
+	if err := store.DeletePackage("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPackage("bar"); err != ErrNotFound {
+		t.Fatal("Expected ErrNotFound for a deleted package, got", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elpa-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+	if _, err := store.GetPackage("../foo"); err != ErrNotFound {
+		t.Error("Names with slashes should not be found, got", err)
+	}
+	if err := store.PutPackage(&Package{Name: "../foo"}); err == nil {
+		t.Error("Names with slashes should not be stored")
+	}
+	// Each day's downloads are in their own file, so that counting a
+	// download doesn't rewrite the older counts.
+	var counts []DownloadCount
+	if err := readJSON(filepath.Join(dir, "downloads", "2013-05-02", "foo.json"), &counts); err != nil || len(counts) != 1 {
+		t.Error("Expected one count in the file for 2013-05-02, got", counts, err)
+	}
+	if err := store.AddDownloads(DownloadCount{"foo", "1.0", "../2013", 0, 1}); err == nil {
+		t.Error("Days with slashes should not be stored")
+	}
+}
+
+func TestFileStore_heldBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elpa-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two uploads of the same file share a blob; refusing one of them
+	// mustn't remove the blob before the other saves its version.
+	release := store.holdBlobs()
+	key, err := store.PutBlob(strings.NewReader("(a)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, err := store.PutBlob(strings.NewReader("(b)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := store.holdBlobs()
+	if err := store.DeleteBlob(key); err != nil {
+		t.Fatal(err)
+	}
+	refused()
+	refused()
+	v1, _ := ParseVersion("1.0")
+	if err := store.PutVersion("foo", v1, &Contents{BlobKey: key, Version: "1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteBlob(unused); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.blobPath(unused)); err != nil {
+		t.Error("A held blob should be kept until it's released, got", err)
+	}
+	release()
+	if _, err := os.Stat(store.blobPath(key)); err != nil {
+		t.Error("The saved version's blob should be kept, got", err)
+	}
+	if _, err := os.Stat(store.blobPath(unused)); !os.IsNotExist(err) {
+		t.Error("An unused blob should be removed once released, got", err)
+	}
+}
@@ -0,0 +1 @@
+../src/tokens.go
\ No newline at end of file
@@ -0,0 +1,113 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// createToken makes an API token as alice for packages, through the
+// tokens page.
+func createToken(t *testing.T, ts *httptest.Server, packages string) string {
+	values := url.Values{"description": {"CI"}, "packages": {packages}}
+	resp := postAs(t, ts, "alice", "/tokens.html", values)
+	b, _ := ioutil.ReadAll(resp.Body)
+	token := regexp.MustCompile(`<code>(elpa_[\w-]+)</code>`).FindStringSubmatch(string(b))
+	if resp.StatusCode != http.StatusOK || token == nil {
+		t.Fatal("Creating a token failed:", resp.Status, string(b))
+	}
+	return token[1]
+}
+
+func apiUpload(t *testing.T, ts *httptest.Server, token, filename, contents string) (*http.Response, string) {
+	req, _ := http.NewRequest("POST", ts.URL+"/api/upload?filename="+filename, strings.NewReader(contents))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := noRedirects.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestServer_apiUpload(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	token := createToken(t, ts, "sample-test, other")
+	resp, body := apiUpload(t, ts, token, "sample-test.el", singleFile("1.0"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("Upload with a token failed:", resp.Status, body)
+	}
+	var result UploadResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Package.Name != "sample-test" || result.Package.Version != "1.0" ||
+		result.Package.Type != "single" || len(result.Package.Owners) != 1 ||
+		result.Package.Owners[0] != "alice" || len(result.Details.Required) != 3 ||
+		result.Details.Required[0].Name != "req1" {
+		t.Error("Upload returned", body)
+	}
+	resp, body = apiUpload(t, ts, token, "", tarFile(t, "1.1"))
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(body, `"type":"tar"`) {
+		t.Error("Upload of a tar file with a token failed:", resp.Status, body)
+	}
+	if resp, body := apiUpload(t, ts, token, "", tarFile(t, "1.1")); resp.StatusCode != http.StatusConflict ||
+		!strings.Contains(body, `"error"`) {
+		t.Error("Uploading the same version again should conflict, got", resp.Status, body)
+	}
+	tokens, _ := store.ListTokens("alice")
+	if len(tokens) != 1 || tokens[0].Hash == token || len(tokens[0].Packages) != 2 {
+		t.Error("Tokens should be stored by their hash, got", tokens)
+	}
+}
+
+func TestServer_apiUploadRefusals(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	token := createToken(t, ts, "other")
+	if resp, _ := apiUpload(t, ts, "", "", singleFile("1.0")); resp.StatusCode != http.StatusUnauthorized ||
+		resp.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Error("Upload without a token should be unauthorized, got", resp.Status)
+	}
+	if resp, _ := apiUpload(t, ts, "elpa_bogus", "", singleFile("1.0")); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Upload with an unknown token should be unauthorized, got", resp.Status)
+	}
+	if resp, body := apiUpload(t, ts, token, "", singleFile("1.0")); resp.StatusCode != http.StatusForbidden {
+		t.Error("Upload of a package the token isn't for should be forbidden, got", resp.Status, body)
+	}
+	// Tokens can't upload packages their user doesn't own.
+	uploadFileAs(t, ts, "bob", "text/x-emacs-lisp", strings.Replace(singleFile("1.0"), "sample-test", "other", -1), nil)
+	if resp, body := apiUpload(t, ts, token, "", strings.Replace(singleFile("1.1"), "sample-test", "other", -1)); resp.StatusCode != http.StatusForbidden {
+		t.Error("Upload of a package the user doesn't own should be forbidden, got", resp.Status, body)
+	}
+
+	tokens, _ := store.ListTokens("alice")
+	if resp := postAs(t, ts, "alice", "/tokens.html", url.Values{"revoke": {tokens[0].ID()}}); resp.StatusCode != http.StatusFound {
+		t.Fatal("Revoking a token failed:", resp.Status)
+	}
+	if resp, _ := apiUpload(t, ts, token, "", strings.Replace(singleFile("1.0"), "sample-test", "other", -1)); resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Upload with a revoked token should be unauthorized, got", resp.Status)
+	}
+}
@@ -0,0 +1 @@
+../src/upload.go
\ No newline at end of file
@@ -0,0 +1,236 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func gzipped(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+func xzipped(s string) string {
+	var buf bytes.Buffer
+	xw, err := xz.NewWriter(&buf)
+	if err != nil {
+		panic(err)
+	}
+	xw.Write([]byte(s))
+	xw.Close()
+	return buf.String()
+}
+
+// bzippedTar is a bzip2-compressed tar of sample-test 1.0, since Go
+// can't write bzip2.
+const bzippedTar = "QlpoOTFBWSZTWd5CGN8AAMX9hMoAIABQY/+BMABvr94AAQAICDAAubYZSMgAAGgAaAEqmnqGmowAIwAABJIKeo9JoDQ00aAPUPUr2LRzDTYAKRSQiGqhtMwQLt7iQhDCbSdHHx2Dov2KsokGZF68PkSGJsIvVhoHgGOMALlj05FaPDD+qMWMbfEEEcLxtYtHGkYpro3Fg0DYU6V5o7aI5uDxK4YAxgkUEApB68Sq+ZHgLoshdSv0mKpwA3ebUOqYCQfxdyRThQkN5CGN8A=="
+
+func TestSniffContentType(t *testing.T) {
+	tarContents := tarFile(t, "1.0")
+	tests := []struct {
+		contents, filename, contentType string
+	}{
+		{tarContents, "", tarContentType},
+		{tarContents, "sample-test.el", tarContentType},
+		{gzipped(tarContents), "", "application/gzip"},
+		{gzipped(tarContents), "sample-test-1.0.tar.gz", "application/gzip"},
+		{gzipped(tarContents), "SAMPLE-TEST.TGZ", "application/gzip"},
+		{xzipped(tarContents), "sample-test-1.0.tar.xz", "application/x-xz"},
+		{sampleHeader, "", elispContentType},
+		{sampleHeader, "sample-test.el", elispContentType},
+		{"(defun foo ())", "foo.el", elispContentType},
+		{"\n;;; foo.el --- Foo", "foo.txt", elispContentType},
+	}
+	for _, test := range tests {
+		contentType, err := sniffContentType(bufio.NewReader(strings.NewReader(test.contents)), test.filename)
+		if err != nil || contentType != test.contentType {
+			t.Error("Expected", test.contentType, "for", test.filename, "but got", contentType, err)
+		}
+	}
+}
+
+func TestSniffContentType_errors(t *testing.T) {
+	tests := []struct {
+		contents, filename, message string
+	}{
+		{"", "", "empty"},
+		{gzipped(sampleHeader), "sample-test.el.gz", "compressed tar files"},
+		{xzipped(sampleHeader), "sample-test.el.xz", ".tar.xz"},
+		{"PK\x03\x04\x00\x00", "sample-test.zip", "application/zip"},
+		{sampleHeader, "sample-test.tar", "not a tar archive"},
+		{"Some notes", "notes.txt", "Emacs Lisp"},
+	}
+	for _, test := range tests {
+		_, err := sniffContentType(bufio.NewReader(strings.NewReader(test.contents)), test.filename)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Error("Expected an error about", test.message, "for", test.filename, "but got", err)
+		}
+	}
+}
+
+func TestServer_unrecognizedUpload(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	resp := uploadFile(t, ts, "application/x-tar", "PK\x03\x04\x00\x00", nil)
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), "Unrecognized file format") {
+		t.Error("Uploading a zip file should fail, got", resp.Status, string(b))
+	}
+	if packages, _ := store.ListPackages(); len(packages) != 0 {
+		t.Error("Unrecognized uploads should not be stored, got", packages)
+	}
+}
+
+func TestServer_compressedUploads(t *testing.T) {
+	bzipped, err := base64.StdEncoding.DecodeString(bzippedTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"gzip":  gzipped(tarFile(t, "1.0")),
+		"bzip2": string(bzipped),
+		"xz":    xzipped(tarFile(t, "1.0")),
+	} {
+		ts, _ := newTestServer(t)
+		resp := uploadFile(t, ts, "application/octet-stream", contents, nil)
+		if resp.StatusCode != http.StatusFound {
+			b, _ := ioutil.ReadAll(resp.Body)
+			t.Error("Uploading a", name, "compressed tar failed:", resp.Status, string(b))
+		}
+		if _, body := get(t, ts, "/packages/archive-contents"); !strings.Contains(body, `"A sample package" tar`) {
+			t.Error("archive-contents after uploading a", name, "compressed tar returned", body)
+		}
+		code, body := get(t, ts, "/packages/sample-test-1.0.tar")
+		if _, err := parsePackageVarsFromTar(bufio.NewReader(strings.NewReader(body))); code != http.StatusOK || err != nil {
+			t.Error("Download of a", name, "compressed tar is not a plain tar:", code, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestServer_deeplyNestedUpload(t *testing.T) {
+	ts, _ := newTestServer(t)
+	defer ts.Close()
+	nested := strings.Repeat("(", 4<<20)
+	single := strings.Replace(singleFile("1.0"), `((req1 "1.0.0")`, nested, 1)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	WriteTarFile(t, tw, "sample-test-1.0/sample-test-pkg.el", `(define-package "sample-test" "1.0" "A sample package" '`+nested)
+	tw.Close()
+	for name, contents := range map[string]string{
+		"single file":    single,
+		"compressed tar": gzipped(buf.String()),
+	} {
+		resp := uploadFile(t, ts, "application/octet-stream", contents, nil)
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), "nested") {
+			t.Error("Deeply nested", name, "should be refused, got", resp.Status, string(b))
+		}
+	}
+}
+
+// xzWithDictionary xz-compresses s in blocks of blockSize bytes, and
+// changes the dictionary size in the last block's header to code.
+func xzWithDictionary(s string, blockSize int64, code byte) string {
+	var buf bytes.Buffer
+	xw, err := xz.WriterConfig{BlockSize: blockSize}.NewWriter(&buf)
+	if err != nil {
+		panic(err)
+	}
+	xw.Write([]byte(s))
+	xw.Close()
+	// The header of a block whose sizes aren't known is 12 bytes, with
+	// the LZMA2 filter's dictionary size (8 MiB, 0x16) at offset 4.
+	data := buf.Bytes()
+	i := bytes.LastIndex(data, []byte("\x02\x00\x21\x01\x16"))
+	if i < 0 {
+		panic("no block header")
+	}
+	data[i+4] = code
+	binary.LittleEndian.PutUint32(data[i+8:], crc32.ChecksumIEEE(data[i:i+8]))
+	return string(data)
+}
+
+func TestServer_xzDictionary(t *testing.T) {
+	ts, store := newTestServer(t)
+	defer ts.Close()
+	tarContents := tarFile(t, "1.0")
+	for _, test := range []struct {
+		blockSize int64
+		code      byte
+	}{
+		{1 << 20, 29}, // 96 MiB
+		{1 << 20, 40}, // 4 GiB
+		{1024, 40},
+	} {
+		resp := uploadFile(t, ts, "application/x-xz", xzWithDictionary(tarContents, test.blockSize, test.code), nil)
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), "dictionary") {
+			t.Error("An xz file with dictionary code", test.code, "in blocks of", test.blockSize,
+				"should be refused, got", resp.Status, string(b))
+		}
+	}
+	if packages, _ := store.ListPackages(); len(packages) != 0 {
+		t.Error("Refused uploads should not be stored, got", packages)
+	}
+	// 64 MiB is allowed, in any block.
+	resp := uploadFile(t, ts, "application/x-xz", xzWithDictionary(tarContents, 1024, 28), nil)
+	if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusFound {
+		t.Error("An xz file with a 64 MiB dictionary should be accepted, got", resp.Status, string(b))
+	}
+}
+
+func TestServer_compressedUploadErrors(t *testing.T) {
+	ts, store := newConfiguredTestServer(t, func(s *Server) { s.MaxUnpackedSize = 4096 })
+	defer ts.Close()
+	bomb := new(bytes.Buffer)
+	tw := tar.NewWriter(bomb)
+	WriteTarFile(t, tw, "sample-test-1.0/sample-test-pkg.el",
+		`(define-package "sample-test" "1.0" "A sample package")`)
+	WriteTarFile(t, tw, "sample-test-1.0/zeros", strings.Repeat("\x00", 1<<20))
+	tw.Close()
+	if resp := uploadFile(t, ts, "application/gzip", gzipped(bomb.String()), nil); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Uploading a gzip bomb should be refused, got", resp.Status)
+	}
+	resp := uploadFile(t, ts, "application/gzip", gzipped(sampleHeader), nil)
+	if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusBadRequest ||
+		!strings.Contains(string(b), "not a tar file") {
+		t.Error("Uploading a compressed .el file should fail, got", resp.Status, string(b))
+	}
+	if packages, _ := store.ListPackages(); len(packages) != 0 {
+		t.Error("Refused uploads should not be stored, got", packages)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.blobs) != 0 {
+		t.Error("Refused uploads should not leave blobs behind, got", len(store.blobs))
+	}
+}
@@ -0,0 +1 @@
+../src/version.go
\ No newline at end of file
@@ -0,0 +1,132 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// 	Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elpa
+
+import (
+	"reflect"
+	"testing"
+)
+
+// These are the examples from the docstring of version-to-list.
+var versionLists = map[string][]int{
+	"1":             {1},
+	"1.0pre7":       {1, 0, -1, 7},
+	"22.8beta3":     {22, 8, -2, 3},
+	"0.9alpha1":     {0, 9, -3, 1},
+	"0.9snapshot":   {0, 9, -4},
+	"0.9.3":         {0, 9, 3},
+	"1.0.7.5":       {1, 0, 7, 5},
+	"1.0-rc1":       {1, 0, -1, 1},
+	"1.0_PRE2":      {1, 0, -1, 2},
+	"22.3a":         {22, 3, 1},
+	"22.3B":         {22, 3, 2},
+	".5":            {0, 5},
+	"1.0.":          {1, 0},
+	"1.2-":          {1, 2, -4},
+	"20121127.1221": {20121127, 1221},
+}
+
+func TestVersionToList(t *testing.T) {
+	for version, expected := range versionLists {
+		list, err := versionToList(version)
+		if err != nil {
+			t.Errorf("%q returned an error: %v", version, err)
+			continue
+		}
+		if !reflect.DeepEqual(list, expected) {
+			t.Errorf("%q: expected %v, got %v", version, expected, list)
+		}
+	}
+}
+
+func TestVersionToList_invalid(t *testing.T) {
+	for _, version := range []string{"", "alpha", "1..2", "22.8X3", "1.0-foo", "1.0 "} {
+		if list, err := versionToList(version); err == nil {
+			t.Errorf("%q should have been invalid, got %v", version, list)
+		}
+	}
+}
+
+func mustParseVersion(t *testing.T, s string) Version {
+	v, err := ParseVersion(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVersionCompare(t *testing.T) {
+	ordered := []string{"1.0alpha", "1.0beta2", "1.0rc1", "1.0", "1.0.1", "1.1", "2.0"}
+	for i := range ordered {
+		for j := range ordered {
+			c := mustParseVersion(t, ordered[i]).Compare(mustParseVersion(t, ordered[j]))
+			if c != sign(i-j) {
+				t.Errorf("Comparing %q with %q gave %d", ordered[i], ordered[j], c)
+			}
+		}
+	}
+	if mustParseVersion(t, "1.0").Compare(mustParseVersion(t, "1.0.0")) != 0 {
+		t.Error("1.0 and 1.0.0 should be equal")
+	}
+}
+
+// Normalized forms are what package-version-join returns for the
+// version list.
+var normalizedVersions = map[string]string{
+	"1.2.3":         "1.2.3",
+	"1.05":          "1.5",
+	"2.3-rc1":       "2.3pre1",
+	"1.0alpha":      "1.0alpha",
+	"1.0-SNAPSHOT":  "1.0snapshot",
+	"22.3a":         "22.3.1",
+	".5":            "0.5",
+	"20231012.0930": "20231012.930",
+}
+
+func TestVersionString(t *testing.T) {
+	for version, expected := range normalizedVersions {
+		v := mustParseVersion(t, version)
+		if v.String() != expected {
+			t.Errorf("%q: expected normalized form %q, got %q", version, expected, v.String())
+		}
+		if mustParseVersion(t, v.String()).Compare(v) != 0 {
+			t.Errorf("%q: normalized form %q is not the same version", version, v.String())
+		}
+	}
+}
+
+func TestVersionSexp(t *testing.T) {
+	if s := sexpString(mustParseVersion(t, "1.0pre7").Sexp()); s != "(1 0 -1 7)" {
+		t.Error("Expected (1 0 -1 7), got", s)
+	}
+}
+
+func TestCheckNewVersion(t *testing.T) {
+	if err := checkNewVersion("foo", "", "1.0", false); err != nil {
+		t.Error("A new package should be accepted: ", err)
+	}
+	if err := checkNewVersion("foo", "1.0", "1.1", false); err != nil {
+		t.Error("A newer version should be accepted: ", err)
+	}
+	for _, uploaded := range []string{"1.0", "1.0.0", "0.9", "1.0rc1"} {
+		err := checkNewVersion("foo", "1.0", uploaded, false)
+		if _, ok := err.(*VersionConflictError); !ok {
+			t.Errorf("Uploading %s over 1.0 should conflict, got %v", uploaded, err)
+		}
+		if err := checkNewVersion("foo", "1.0", uploaded, true); err != nil {
+			t.Errorf("Uploading %s over 1.0 with override should succeed, got %v", uploaded, err)
+		}
+	}
+}